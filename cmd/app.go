@@ -1,4 +1,180 @@
 package main
 
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"goker/internal/auth"
+	"goker/internal/broker"
+	"goker/internal/gateway"
+	"goker/internal/utils"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const passwdUsage = `usage: goker passwd <add|remove|rehash> <file> <username>
+
+  add     add a user, reading its password from stdin
+  remove  remove a user
+  rehash  hash a new password of an existing user, read from stdin
+
+Passwords set this way can also be used with SCRAM-SHA-256.
+`
+
+func readPassword() ([]byte, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return nil, errors.New("Unable to read password.")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) == 0 {
+		return nil, errors.New("Password must not be empty.")
+	}
+	return []byte(password), nil
+}
+
+func passwd(args []string) error {
+	if len(args) != 3 {
+		fmt.Fprint(os.Stderr, passwdUsage)
+		os.Exit(2)
+	}
+	cmd, path, username := args[0], args[1], args[2]
+
+	f, err := auth.LoadPasswordFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "add", "rehash":
+		if exists := f.Has(username); cmd == "add" && exists {
+			return fmt.Errorf("User %s already exists.", username)
+		} else if cmd == "rehash" && !exists {
+			return fmt.Errorf("User %s does not exist.", username)
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		} else if err = f.Set(username, password); err != nil {
+			return err
+		}
+	case "remove":
+		if !f.Remove(username) {
+			return fmt.Errorf("User %s does not exist.", username)
+		}
+	default:
+		fmt.Fprint(os.Stderr, passwdUsage)
+		os.Exit(2)
+	}
+
+	return f.Save()
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("goker", flag.ExitOnError)
+	passwordFile := fs.String("password-file", "", "require clients to log in with a user of the password file")
+	aclFile := fs.String("acl-file", "", "authorize publish, subscribe and receive with the rules of the file")
+	maxPacketSize := fs.Uint("max-packet-size", 0, "disconnect clients sending packets larger than this many bytes (0 for no limit)")
+	topicAliasMax := fs.Uint("topic-alias-maximum", 0, "highest Topic Alias clients may use (0 to refuse aliases)")
+	receiveMax := fs.Uint("receive-maximum", 0, "QoS 2 messages a client may have in flight before it is disconnected (0 for 65535)")
+	serverKeepAlive := fs.Duration("server-keep-alive", 0, "Keep Alive clients must use instead of the one they request, in whole seconds (0 to keep theirs)")
+	retainAvailable := fs.Bool("retain-available", true, "accept retained messages")
+	sharedAvailable := fs.Bool("shared-subscription-available", true, "accept shared subscriptions")
+	shareStrategy := fs.String("share-strategy", "round-robin", "member of shared subscriptions receiving each message: round-robin, random,\n"+
+		"sticky (the same member for each publisher) or least-inflight")
+	var listeners []gateway.ListenerConfig
+	fs.Func("listen", "URL of a listener, such as tcp://:1883, unix:///run/goker.sock,\n"+
+		"tls://:8883?cert=server.crt&key=server.key&client-ca=ca.crt&require-client-cert=true&username-from=cn or\n"+
+		"ws://:8080/mqtt?origin=https://dashboard.example.com, wss:// taking the query of tls:// too\n"+
+		"(repeatable, default tcp://:1883)", func(s string) error {
+		cfg, err := gateway.ParseListener(s)
+		listeners = append(listeners, cfg)
+		return err
+	})
+	fs.Parse(args)
+
+	if len(listeners) == 0 {
+		listeners = append(listeners, gateway.ListenerConfig{Transport: gateway.TCP, Addr: ":1883"})
+	}
+
+	cfg := broker.DefaultConfig()
+	if *maxPacketSize > math.MaxUint32 {
+		return fmt.Errorf("Maximum packet size %d exceeds %d.", *maxPacketSize, uint32(math.MaxUint32))
+	}
+	cfg.MaximumPacketSize = uint32(*maxPacketSize)
+	if *topicAliasMax > math.MaxUint16 {
+		return fmt.Errorf("Topic Alias Maximum %d exceeds %d.", *topicAliasMax, math.MaxUint16)
+	}
+	cfg.TopicAliasMaximum = uint16(*topicAliasMax)
+	if *receiveMax > math.MaxUint16 {
+		return fmt.Errorf("Receive Maximum %d exceeds %d.", *receiveMax, math.MaxUint16)
+	}
+	cfg.ReceiveMaximum = uint16(*receiveMax)
+	if *serverKeepAlive < 0 || *serverKeepAlive > math.MaxUint16*time.Second || *serverKeepAlive%time.Second != 0 {
+		return fmt.Errorf("Server Keep Alive %s is not a whole number of seconds up to %d.", *serverKeepAlive, math.MaxUint16)
+	}
+	cfg.ServerKeepAlive = *serverKeepAlive
+	cfg.RetainAvailable = *retainAvailable
+	cfg.SharedSubscriptionAvailable = *sharedAvailable
+	share, err := broker.NewShareStrategy(*shareStrategy)
+	if err != nil {
+		return err
+	}
+	cfg.ShareStrategy = share
+	if len(*aclFile) > 0 {
+		f, err := os.Open(*aclFile)
+		if err != nil {
+			return err
+		}
+		cfg.ACL, err = auth.ParseACL(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	gateway.Configure(cfg)
+
+	if len(*passwordFile) > 0 {
+		f, err := auth.LoadPasswordFile(*passwordFile)
+		if err != nil {
+			return err
+		}
+		gateway.UseCredentials(f)
+
+		// The password file is read again on SIGHUP so that users can be
+		// changed without restarting the broker.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := f.Reload(); err != nil {
+					utils.LogError("Failed to reload password file, err:", err)
+				} else {
+					utils.LogInfo("Reloaded password file ", *passwordFile)
+				}
+			}
+		}()
+	}
+
+	return gateway.ListenAndServe(listeners...)
+}
+
 func main() {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		err = passwd(os.Args[2:])
+	} else {
+		err = serve(os.Args[1:])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
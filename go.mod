@@ -2,4 +2,10 @@ module goker
 
 go 1.24.2
 
-require github.com/eclipse/paho.golang v0.22.0
+require (
+	github.com/eclipse/paho.golang v0.22.0
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.48.0
+)
+
+require golang.org/x/sys v0.41.0 // indirect
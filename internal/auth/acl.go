@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"goker/internal/protocol"
+	"io"
+	"strings"
+)
+
+type Action byte
+
+const (
+	Publish Action = 1 << iota
+	Subscribe
+	Receive
+	AllActions = Publish | Subscribe | Receive
+)
+
+func parseAction(s string) (Action, error) {
+	switch s {
+	case "publish":
+		return Publish, nil
+	case "subscribe":
+		return Subscribe, nil
+	case "receive":
+		return Receive, nil
+	case "all":
+		return AllActions, nil
+	default:
+		return 0, fmt.Errorf("Unknown ACL action %s.", s)
+	}
+}
+
+// Identity is who a rule is evaluated for.
+type Identity struct {
+	Username string
+	ClientId string
+	// UserProperties are those the client connected with, such as a tenant
+	// identifier.
+	UserProperties protocol.UserProperties
+}
+
+// Rule allows or denies actions on a topic filter. The filter may contain %u
+// and %c which are substituted with the user name and client identifier. A
+// rule restricted to a user name or client identifier only applies to that
+// client.
+type Rule struct {
+	Allow    bool
+	Actions  Action
+	Filter   string
+	Username string
+	ClientId string
+}
+
+func (r *Rule) applies(id Identity) bool {
+	return (len(r.Username) == 0 || r.Username == id.Username) &&
+		(len(r.ClientId) == 0 || r.ClientId == id.ClientId)
+}
+
+// filter substitutes the identity in the filter of the rule. An identity
+// which is empty or contains wildcards cannot be substituted, otherwise a
+// client could widen the topics of the rule.
+func (r *Rule) filter(id Identity) (string, bool) {
+	filter := r.Filter
+	for pattern, value := range map[string]string{"%u": id.Username, "%c": id.ClientId} {
+		if !strings.Contains(filter, pattern) {
+			continue
+		} else if len(value) == 0 || strings.ContainsAny(value, protocol.SingleLevelWildcard+protocol.MultiLevelWildcard+protocol.TopicLevelSeparator) {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, pattern, value)
+	}
+	return filter, true
+}
+
+// coversFilter reports whether every topic matched by the filter is also
+// matched by the filter of the rule.
+func coversFilter(rule string, filter string) bool {
+	rLevels := strings.Split(rule, protocol.TopicLevelSeparator)
+	fLevels := strings.Split(filter, protocol.TopicLevelSeparator)
+
+	for i, level := range rLevels {
+		if level == protocol.MultiLevelWildcard {
+			return true
+		} else if i >= len(fLevels) || fLevels[i] == protocol.MultiLevelWildcard {
+			return false
+		} else if level != protocol.SingleLevelWildcard && level != fLevels[i] {
+			return false
+		}
+	}
+	return len(rLevels) == len(fLevels)
+}
+
+// overlapsFilter reports whether some topic is matched by both filters.
+func overlapsFilter(rule string, filter string) bool {
+	rLevels := strings.Split(rule, protocol.TopicLevelSeparator)
+	fLevels := strings.Split(filter, protocol.TopicLevelSeparator)
+
+	for i := 0; i < len(rLevels) || i < len(fLevels); i++ {
+		// The multi-level wildcard also matches its parent level, so a filter
+		// which ended overlaps one going on with it.
+		if i >= len(rLevels) {
+			return fLevels[i] == protocol.MultiLevelWildcard
+		} else if i >= len(fLevels) {
+			return rLevels[i] == protocol.MultiLevelWildcard
+		}
+		r, f := rLevels[i], fLevels[i]
+		if r == protocol.MultiLevelWildcard || f == protocol.MultiLevelWildcard {
+			return true
+		} else if r != protocol.SingleLevelWildcard && f != protocol.SingleLevelWildcard && r != f {
+			return false
+		}
+	}
+	return true
+}
+
+// ACL authorizes clients with an ordered list of rules where the first rule
+// matching the action and topic decides. Without any matching rule the
+// default applies.
+type ACL struct {
+	rules        []Rule
+	defaultAllow bool
+}
+
+func NewACL(defaultAllow bool, rules ...Rule) *ACL {
+	return &ACL{rules: rules, defaultAllow: defaultAllow}
+}
+
+// Authorize reports whether the client may take the action on the topic. For
+// Publish and Receive it is a topic name, while for Subscribe it is a topic
+// filter: an allow rule must cover all of its topics, whereas a deny rule
+// applies as soon as it shares a single topic with it, so that wildcards
+// cannot get around the denied topics. Shared subscriptions are authorized
+// as their topic filter.
+func (a *ACL) Authorize(id Identity, action Action, topic string) bool {
+	if _, filter, ok := protocol.SplitSharedFilter(topic); ok && action == Subscribe {
+		topic = filter
+	}
+	for i := range a.rules {
+		r := &a.rules[i]
+		if r.Actions&action == 0 || !r.applies(id) {
+			continue
+		}
+		filter, ok := r.filter(id)
+		if !ok {
+			continue
+		}
+
+		if action == Subscribe && r.Allow && coversFilter(filter, topic) {
+			return true
+		} else if action == Subscribe && !r.Allow && overlapsFilter(filter, topic) {
+			return false
+		} else if action != Subscribe && protocol.MatchTopic(filter, topic) {
+			return r.Allow
+		}
+	}
+	return a.defaultAllow
+}
+
+// ParseACL reads rules, one per line, in the form
+//
+//	<allow|deny> <publish|subscribe|receive|all> <filter> [user <name>] [client <id>]
+//
+// A line "default <allow|deny>" sets the default, which is deny otherwise.
+// Lines starting with '#' are comments.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "default" && len(fields) == 2 && (fields[1] == "allow" || fields[1] == "deny") {
+			acl.defaultAllow = fields[1] == "allow"
+			continue
+		} else if len(fields) < 3 || len(fields)%2 == 0 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("Malformed ACL rule at line %d.", n)
+		}
+
+		action, err := parseAction(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s at line %d", err.Error(), n)
+		} else if err = protocol.ValidTopicFilter(fields[2]); err != nil {
+			return nil, fmt.Errorf("Invalid ACL filter at line %d, err: %s", n, err.Error())
+		}
+		rule := Rule{Allow: fields[0] == "allow", Actions: action, Filter: fields[2]}
+
+		for i := 3; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "user":
+				rule.Username = fields[i+1]
+			case "client":
+				rule.ClientId = fields[i+1]
+			default:
+				return nil, fmt.Errorf("Unknown ACL qualifier %s at line %d.", fields[i], n)
+			}
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"goker/internal/protocol"
+)
+
+// Exchange is one run of a challenge/response authentication. Every AUTH
+// received from the client is fed to Next until the exchange is done.
+type Exchange interface {
+	// Next consumes the authentication data of the client and returns the
+	// data to send back. When done is set the client is authenticated and the
+	// data is the final one of the exchange, otherwise it is a challenge the
+	// client must answer.
+	Next(data []byte) (resp []byte, done bool, err error)
+	// Username returns the user authenticated by the exchange once done.
+	Username() string
+}
+
+// Authenticator implements an authentication method of enhanced
+// authentication.
+type Authenticator interface {
+	Method() string
+	// Begin starts an exchange for a client connected with the User
+	// Properties.
+	Begin(props protocol.UserProperties) Exchange
+}
+
+type Registry struct {
+	methods map[string]Authenticator
+}
+
+func NewRegistry(auths ...Authenticator) *Registry {
+	r := &Registry{methods: make(map[string]Authenticator)}
+	for _, a := range auths {
+		r.Register(a)
+	}
+	return r
+}
+
+func (r *Registry) Register(a Authenticator) {
+	r.methods[a.Method()] = a
+}
+
+// Begin starts an exchange of the authentication method, failing with Bad
+// Authentication Method when the method is unknown.
+func (r *Registry) Begin(method string, props protocol.UserProperties) (Exchange, error) {
+	a, ok := r.methods[method]
+	if !ok {
+		return nil, protocol.NewReasonError(protocol.BadAuthenticationMethod, "Unsupported authentication method "+method)
+	}
+	return a.Begin(props), nil
+}
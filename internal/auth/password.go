@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"goker/internal/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialProvider checks the User Name and Password of a CONNECT. The User
+// Properties of the CONNECT are given too, as they may carry a tenant
+// identifier the credentials belong to.
+type CredentialProvider interface {
+	Authenticate(username string, password []byte, props protocol.UserProperties) error
+}
+
+func errBadUsernamePassword(username string) error {
+	return protocol.NewReasonError(protocol.BadUsernamePassword, "Bad user name or password for "+username)
+}
+
+// HashPassword hashes a password with bcrypt to be stored in a password file.
+func HashPassword(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// verifyArgon2 checks a password against a hash in the PHC string format
+// "$argon2id$v=19$m=65536,t=3,p=4$salt$hash".
+func verifyArgon2(hash string, password []byte) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return errors.New("Unsupported argon2 hash.")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errors.New("Unsupported argon2 version.")
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return errors.New("Invalid argon2 parameters.")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errors.New("Invalid argon2 salt.")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return errors.New("Invalid argon2 key.")
+	}
+
+	derived := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(derived, key) != 1 {
+		return errors.New("Password mismatch.")
+	}
+	return nil
+}
+
+func verifyPassword(hash string, password []byte) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		return verifyArgon2(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), password)
+}
+
+// passwordEntry is what the password file keeps of a user: the hash checked
+// against the Password of a CONNECT and, when the password was set by the
+// broker, the credential of SCRAM-SHA-256.
+type passwordEntry struct {
+	hash  string
+	scram *ScramCredential
+}
+
+// PasswordFile is a credential provider backed by a file of
+// "username:hash[:scram]" lines, the hash being either bcrypt or argon2id and
+// scram the credential of the user encoded as in RFC 5803. Lines starting
+// with '#' are comments. It also serves the credentials of SCRAM-SHA-256 so
+// that both authentications share the same users.
+type PasswordFile struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]passwordEntry
+}
+
+// LoadPasswordFile reads the password file, a missing file holding no user.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	f := &PasswordFile{path: path, users: make(map[string]passwordEntry)}
+	if err := f.Reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the password file again so that credentials changed on disk
+// apply to the next connections. The current users are kept on failure.
+func (f *PasswordFile) Reload() error {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]passwordEntry)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || len(username) == 0 || len(hash) == 0 {
+			return fmt.Errorf("Malformed password file %s at line %d.", f.path, n)
+		}
+
+		// Neither bcrypt nor argon2id hashes contain ':'.
+		var entry passwordEntry
+		hash, scram, ok := strings.Cut(hash, ":")
+		if ok {
+			cred, err := ParseScramCredential(scram)
+			if err != nil {
+				return fmt.Errorf("Malformed password file %s at line %d: %v", f.path, n, err)
+			}
+			entry.scram = &cred
+		}
+		entry.hash = hash
+		users[username] = entry
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users = users
+	return nil
+}
+
+// dummyHash is checked against the password of unknown users, so that they
+// take as long to refuse as a wrong password and cannot be told apart.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword([]byte("dummy"))
+	return hash
+})
+
+func (f *PasswordFile) Authenticate(username string, password []byte, props protocol.UserProperties) error {
+	f.mu.RLock()
+	entry, ok := f.users[username]
+	f.mu.RUnlock()
+
+	if !ok {
+		verifyPassword(dummyHash(), password)
+		return errBadUsernamePassword(username)
+	} else if err := verifyPassword(entry.hash, password); err != nil {
+		return errBadUsernamePassword(username)
+	}
+	return nil
+}
+
+// Lookup returns the SCRAM-SHA-256 credential of the user, missing for users
+// whose password was hashed elsewhere until it is set again.
+func (f *PasswordFile) Lookup(username string) (ScramCredential, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	entry, ok := f.users[username]
+	if !ok || entry.scram == nil {
+		return ScramCredential{}, false
+	}
+	return *entry.scram, true
+}
+
+func (f *PasswordFile) Has(username string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.users[username]
+	return ok
+}
+
+// Set hashes the password of the user and derives its SCRAM-SHA-256
+// credential, adding the user when missing.
+func (f *PasswordFile) Set(username string, password []byte) error {
+	if len(username) == 0 || strings.ContainsAny(username, ":\n") {
+		return errors.New("User name must not be empty nor contain ':' or a newline.")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, scramSaltLen)
+	rand.Read(salt)
+	scram, err := NewScramCredential(string(password), salt, scramIterations)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[username] = passwordEntry{hash: hash, scram: &scram}
+	return nil
+}
+
+func (f *PasswordFile) Remove(username string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[username]; !ok {
+		return false
+	}
+	delete(f.users, username)
+	return true
+}
+
+// Save writes the users back to the password file. The file is replaced at
+// once so that a broker reloading it never reads a partial file.
+func (f *PasswordFile) Save() error {
+	f.mu.RLock()
+	usernames := make([]string, 0, len(f.users))
+	for username := range f.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	for _, username := range usernames {
+		entry := f.users[username]
+		buf.WriteString(username + ":" + entry.hash)
+		if entry.scram != nil {
+			buf.WriteString(":" + entry.scram.String())
+		}
+		buf.WriteString("\n")
+	}
+	f.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = buf.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	} else if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
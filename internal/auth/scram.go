@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"goker/internal/protocol"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ScramSHA256   = "SCRAM-SHA-256"
+	scramNonceLen = 18
+	scramSaltLen  = 16
+	// scramIterations is the iteration count of credentials derived from the
+	// passwords of the password file.
+	scramIterations = 4096
+)
+
+// ScramCredential is what the server keeps of a password, as defined in
+// RFC 5802. The password itself cannot be recovered from it.
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func scramHmac(key []byte, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func NewScramCredential(password string, salt []byte, iterations int) (ScramCredential, error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return ScramCredential{}, err
+	}
+
+	clientKey := scramHmac(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return ScramCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHmac(salted, []byte("Server Key")),
+	}, nil
+}
+
+// String encodes the credential as defined in RFC 5803,
+// "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>".
+func (c ScramCredential) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", ScramSHA256, c.Iterations,
+		base64.StdEncoding.EncodeToString(c.Salt),
+		base64.StdEncoding.EncodeToString(c.StoredKey),
+		base64.StdEncoding.EncodeToString(c.ServerKey))
+}
+
+// ParseScramCredential decodes a credential encoded by String.
+func ParseScramCredential(s string) (ScramCredential, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != ScramSHA256 {
+		return ScramCredential{}, errors.New("Unsupported SCRAM credential.")
+	}
+	iterations, salt, ok := strings.Cut(parts[1], ":")
+	if !ok {
+		return ScramCredential{}, errors.New("Malformed SCRAM salt.")
+	}
+	storedKey, serverKey, ok := strings.Cut(parts[2], ":")
+	if !ok {
+		return ScramCredential{}, errors.New("Malformed SCRAM keys.")
+	}
+
+	var c ScramCredential
+	var err error
+	if c.Iterations, err = strconv.Atoi(iterations); err != nil || c.Iterations <= 0 {
+		return ScramCredential{}, errors.New("Invalid SCRAM iteration count.")
+	}
+	if c.Salt, err = base64.StdEncoding.DecodeString(salt); err != nil {
+		return ScramCredential{}, errors.New("Invalid SCRAM salt.")
+	}
+	if c.StoredKey, err = base64.StdEncoding.DecodeString(storedKey); err != nil || len(c.StoredKey) != sha256.Size {
+		return ScramCredential{}, errors.New("Invalid SCRAM stored key.")
+	}
+	if c.ServerKey, err = base64.StdEncoding.DecodeString(serverKey); err != nil || len(c.ServerKey) != sha256.Size {
+		return ScramCredential{}, errors.New("Invalid SCRAM server key.")
+	}
+	return c, nil
+}
+
+// ScramStore looks up the credential of a user authenticating with
+// SCRAM-SHA-256.
+type ScramStore interface {
+	Lookup(username string) (ScramCredential, bool)
+}
+
+// ScramCredentials are the credentials of every user allowed to authenticate
+// with SCRAM-SHA-256.
+type ScramCredentials struct {
+	mu    sync.RWMutex
+	users map[string]ScramCredential
+}
+
+func NewScramCredentials() *ScramCredentials {
+	return &ScramCredentials{users: make(map[string]ScramCredential)}
+}
+
+func (c *ScramCredentials) Set(username string, cred ScramCredential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[username] = cred
+}
+
+func (c *ScramCredentials) Lookup(username string) (ScramCredential, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cred, ok := c.users[username]
+	return cred, ok
+}
+
+type Scram struct {
+	creds ScramStore
+	// mockKey derives the salt of unknown users.
+	mockKey []byte
+}
+
+func NewScram(creds ScramStore) *Scram {
+	mockKey := make([]byte, sha256.Size)
+	rand.Read(mockKey)
+	return &Scram{creds: creds, mockKey: mockKey}
+}
+
+func (s *Scram) Method() string {
+	return ScramSHA256
+}
+
+func (s *Scram) Begin(props protocol.UserProperties) Exchange {
+	return &scramExchange{creds: s.creds, mockKey: s.mockKey}
+}
+
+// mockScramCredential is the credential of a user who does not exist. Its
+// salt is the same at each attempt, as for a real user, and no proof matches
+// its keys.
+func mockScramCredential(mockKey []byte, username string) ScramCredential {
+	storedKey := make([]byte, sha256.Size)
+	rand.Read(storedKey)
+	return ScramCredential{
+		Salt:       scramHmac(mockKey, []byte(username))[:scramSaltLen],
+		Iterations: scramIterations,
+		StoredKey:  storedKey,
+		ServerKey:  storedKey,
+	}
+}
+
+type scramStep int
+
+const (
+	scramClientFirst scramStep = iota
+	scramClientFinal
+	scramDone
+)
+
+type scramExchange struct {
+	creds       ScramStore
+	mockKey     []byte
+	step        scramStep
+	username    string
+	gs2Header   string
+	clientFirst string
+	serverFirst string
+	nonce       string
+	cred        ScramCredential
+}
+
+func errNotAuthorized(msg string) error {
+	return protocol.NewReasonError(protocol.NotAuthorized, msg)
+}
+
+// scramAttributes splits a SCRAM message into its attributes, keeping their
+// order since messages are signed as sent.
+func scramAttributes(msg string) ([][2]string, error) {
+	var attrs [][2]string
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, errNotAuthorized("Malformed SCRAM attribute " + part)
+		}
+		attrs = append(attrs, [2]string{part[:1], part[2:]})
+	}
+	return attrs, nil
+}
+
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	switch e.step {
+	case scramClientFirst:
+		resp, err := e.clientFirstMessage(string(data))
+		if err != nil {
+			return nil, false, err
+		}
+		e.step = scramClientFinal
+		return resp, false, nil
+	case scramClientFinal:
+		resp, err := e.clientFinalMessage(string(data))
+		if err != nil {
+			return nil, false, err
+		}
+		e.step = scramDone
+		return resp, true, nil
+	default:
+		return nil, false, errors.New("SCRAM exchange already completed.")
+	}
+}
+
+func (e *scramExchange) Username() string {
+	if e.step != scramDone {
+		return ""
+	}
+	return e.username
+}
+
+// clientFirstMessage handles "n,,n=user,r=nonce" and answers with the salt
+// and iteration count of the user along with the combined nonce. An unknown
+// user is answered alike and fails at the proof, as for a wrong password, so
+// that the exchange does not tell which users exist.
+func (e *scramExchange) clientFirstMessage(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errNotAuthorized("Malformed SCRAM client first message.")
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, errNotAuthorized("SCRAM channel binding is not supported.")
+	default:
+		return nil, errNotAuthorized("Malformed SCRAM GS2 header.")
+	}
+	if len(parts[1]) > 0 {
+		return nil, errNotAuthorized("SCRAM authorization identity is not supported.")
+	}
+	e.gs2Header = parts[0] + "," + parts[1] + ","
+	e.clientFirst = parts[2]
+
+	attrs, err := scramAttributes(e.clientFirst)
+	if err != nil {
+		return nil, err
+	} else if len(attrs) < 2 || attrs[0][0] != "n" || attrs[1][0] != "r" {
+		return nil, errNotAuthorized("SCRAM client first message must start with user name and nonce.")
+	}
+
+	username := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs[0][1])
+	cred, ok := e.creds.Lookup(username)
+	if !ok {
+		cred = mockScramCredential(e.mockKey, username)
+	}
+	e.username, e.cred = username, cred
+
+	snonce := make([]byte, scramNonceLen)
+	rand.Read(snonce)
+	e.nonce = attrs[1][1] + base64.RawStdEncoding.EncodeToString(snonce)
+
+	e.serverFirst = "r=" + e.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(cred.Salt) +
+		",i=" + strconv.Itoa(cred.Iterations)
+	return []byte(e.serverFirst), nil
+}
+
+// clientFinalMessage verifies the proof of "c=...,r=...,p=..." and answers
+// with the server signature so that the client can authenticate the server.
+func (e *scramExchange) clientFinalMessage(msg string) ([]byte, error) {
+	idx := strings.LastIndex(msg, ",p=")
+	if idx < 0 {
+		return nil, errNotAuthorized("Missing SCRAM client proof.")
+	}
+	withoutProof := msg[:idx]
+
+	attrs, err := scramAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	} else if len(attrs) < 2 || attrs[0][0] != "c" || attrs[1][0] != "r" {
+		return nil, errNotAuthorized("SCRAM client final message must start with channel binding and nonce.")
+	}
+	if attrs[0][1] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) {
+		return nil, errNotAuthorized("SCRAM channel binding mismatch.")
+	} else if attrs[1][1] != e.nonce {
+		return nil, errNotAuthorized("SCRAM nonce mismatch.")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(msg[idx+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errNotAuthorized("Malformed SCRAM client proof.")
+	}
+
+	authMessage := []byte(e.clientFirst + "," + e.serverFirst + "," + withoutProof)
+	signature := scramHmac(e.cred.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	subtle.XORBytes(clientKey, proof, signature)
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.cred.StoredKey) != 1 {
+		return nil, errNotAuthorized("SCRAM authentication failed.")
+	}
+
+	verifier := base64.StdEncoding.EncodeToString(scramHmac(e.cred.ServerKey, authMessage))
+	return []byte("v=" + verifier), nil
+}
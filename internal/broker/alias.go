@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"container/list"
+	"fmt"
+	"goker/internal/protocol"
+)
+
+// inboundAliases maps the Topic Aliases a client sets on its network
+// connection to topic names.
+type inboundAliases struct {
+	max    uint16
+	topics map[uint16]string
+}
+
+func newInboundAliases(max uint16) *inboundAliases {
+	return &inboundAliases{max: max, topics: make(map[uint16]string)}
+}
+
+// resolve records the alias of a message with a topic name, or restores the
+// topic name of a message that only carries an alias.
+func (a *inboundAliases) resolve(msg *protocol.PublishRequest) error {
+	alias, ok := msg.TopicAlias()
+	if !ok {
+		return nil
+	} else if alias > a.max {
+		return protocol.NewReasonError(protocol.TopicAliasInvalid, fmt.Sprintf("Topic Alias %d exceeds maximum %d.", alias, a.max))
+	}
+
+	if len(msg.Topic()) > 0 {
+		a.topics[alias] = msg.Topic()
+		return nil
+	}
+	topic, ok := a.topics[alias]
+	if !ok {
+		return protocol.NewReasonError(protocol.ProtocolError, fmt.Sprintf("Topic Alias %d is not mapped to a topic.", alias))
+	}
+	msg.SetTopic(topic)
+	return nil
+}
+
+type outboundAlias struct {
+	topic string
+	alias uint16
+}
+
+// outboundAliases assigns Topic Aliases to the topics sent to a client, up to
+// the maximum the client accepts. Once all aliases are taken the least
+// recently used one is mapped to the new topic.
+type outboundAliases struct {
+	max     uint16
+	recent  *list.List
+	byTopic map[string]*list.Element
+}
+
+func newOutboundAliases(max uint16) *outboundAliases {
+	return &outboundAliases{max: max, recent: list.New(), byTopic: make(map[string]*list.Element)}
+}
+
+// assign returns the alias of the topic and whether the client already maps
+// the alias to the topic.
+func (a *outboundAliases) assign(topic string) (uint16, bool) {
+	if e, ok := a.byTopic[topic]; ok {
+		a.recent.MoveToFront(e)
+		return e.Value.(*outboundAlias).alias, true
+	}
+
+	if a.recent.Len() < int(a.max) {
+		e := a.recent.PushFront(&outboundAlias{topic: topic, alias: uint16(a.recent.Len() + 1)})
+		a.byTopic[topic] = e
+		return e.Value.(*outboundAlias).alias, false
+	}
+
+	e := a.recent.Back()
+	entry := e.Value.(*outboundAlias)
+	delete(a.byTopic, entry.topic)
+	entry.topic = topic
+	a.byTopic[topic] = e
+	a.recent.MoveToFront(e)
+	return entry.alias, false
+}
+
+// apply returns the message as sent to the client, with its alias.
+func (a *outboundAliases) apply(msg *protocol.PublishRequest) *protocol.PublishRequest {
+	if a.max == 0 {
+		return msg
+	}
+	alias, known := a.assign(msg.Topic())
+	return msg.WithTopicAlias(alias, known)
+}
@@ -0,0 +1,560 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"goker/internal/auth"
+	"goker/internal/protocol"
+	"goker/internal/utils"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	RetainAvailable bool
+	// ServerKeepAlive overrides the Keep Alive requested by clients when it is
+	// not 0.
+	ServerKeepAlive time.Duration
+	// ACL authorizes publish, subscribe and receive of clients. Everything is
+	// allowed when it is nil.
+	ACL *auth.ACL
+	// MaximumPacketSize is the size of the largest packet accepted from
+	// clients, unlimited when 0.
+	MaximumPacketSize uint32
+	// TopicAliasMaximum is the highest Topic Alias accepted from clients, who
+	// cannot use any when it is 0.
+	TopicAliasMaximum uint16
+	// ReceiveMaximum is the number of QoS 2 messages a client may have in
+	// flight towards the server, 65535 when 0.
+	ReceiveMaximum uint16
+	// SharedSubscriptionAvailable accepts $share/{ShareName}/{filter}
+	// subscriptions, whose messages are given to one member of the group as
+	// chosen by ShareStrategy, round-robin when it is nil.
+	SharedSubscriptionAvailable bool
+	ShareStrategy               ShareStrategy
+	// WriteTimeout bounds each write to a client, whose connection is closed
+	// when the write does not complete in time, so that a client which stops
+	// reading cannot hold up publishers or a takeover. Writes are not bounded
+	// when it is 0.
+	WriteTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		RetainAvailable:             true,
+		SharedSubscriptionAvailable: true,
+		WriteTimeout:                10 * time.Second,
+	}
+}
+
+type Broker struct {
+	mu       sync.RWMutex
+	cfg      Config
+	subs     *SubscriptionTree
+	retained *RetainedStore
+	sessions map[string]*Session
+	share    ShareStrategy
+}
+
+func NewBroker(cfg Config) *Broker {
+	share := cfg.ShareStrategy
+	if share == nil {
+		share, _ = NewShareStrategy("round-robin")
+	}
+	return &Broker{
+		cfg:      cfg,
+		subs:     NewSubscriptionTree(),
+		retained: NewRetainedStore(),
+		sessions: make(map[string]*Session),
+		share:    share,
+	}
+}
+
+func (b *Broker) MaximumPacketSize() uint32 {
+	return b.cfg.MaximumPacketSize
+}
+
+// Session Expiry Interval of 0xFFFFFFFF means that the session does not expire.
+const neverExpire = time.Duration(math.MaxUint32) * time.Second
+
+// Connect registers the session of a connecting client, taking over any
+// connection that is still using the same client identifier. Without Clean
+// Start the new session resumes the state of the existing one and Session
+// Present is set in the CONNACK. The session stays detached until Attach so
+// that no message is written before the CONNACK. A CONNECT the CONNACK refuses
+// registers nothing and returns nil.
+func (b *Broker) Connect(req *protocol.ConnectRequest) *Session {
+	if req.ClientIdentifier() == "" {
+		req.AssignClientIdentifier(assignClientId())
+	}
+	clientId := req.ClientIdentifier()
+	req.SetRetainAvailable(b.cfg.RetainAvailable)
+	req.SetSharedSubscriptionAvailable(b.cfg.SharedSubscriptionAvailable)
+	req.SetServerKeepAlive(b.cfg.ServerKeepAlive)
+	req.SetTopicAliasMaximum(b.cfg.TopicAliasMaximum)
+	req.SetReceiveMaximum(b.cfg.ReceiveMaximum)
+	req.SetMaximumPacketSize(b.cfg.MaximumPacketSize)
+	if req.Connack().Reason() != protocol.Success {
+		return nil
+	}
+
+	var will *protocol.PublishRequest
+
+	b.mu.Lock()
+	s := newSession(clientId, req.SessionExpiryInterval())
+	s.username, _ = req.Username()
+	s.userProperties = req.UserProperties()
+	s.inAliases = newInboundAliases(b.cfg.TopicAliasMaximum)
+	s.outAliases = newOutboundAliases(req.TopicAliasMaximum())
+	s.sendQuota = req.ReceiveMaximum()
+	s.maxPacketSize = req.MaximumPacketSize()
+	s.writeTimeout = b.cfg.WriteTimeout
+	if b.cfg.ReceiveMaximum > 0 {
+		s.receiveMaximum = b.cfg.ReceiveMaximum
+	}
+	s.will, s.willDelay = req.Will(), req.WillDelayInterval()
+	if s.will != nil && !b.authorize(s, auth.Publish, s.will.Topic()) {
+		utils.LogWarn("Will message of ", clientId, " on ", s.will.Topic(), " is not authorized")
+		s.will = nil
+	}
+	old, takeover := b.sessions[clientId]
+	if takeover {
+		old.stopTimers()
+		if req.CleanStart() {
+			will, old.will = old.will, nil
+			b.unsubscribeAll(old)
+		} else {
+			old.will = nil
+			s.resume(old)
+			req.SetSessionPresent(true)
+		}
+	}
+	b.sessions[clientId] = s
+	b.mu.Unlock()
+
+	// The old client may be slow to take its DISCONNECT, which must not hold
+	// up the rest of the broker.
+	if takeover {
+		old.Close(protocol.SessionTakenOver)
+	}
+	if will != nil {
+		b.publishWill(will)
+	}
+	return s
+}
+
+func (b *Broker) Attach(s *Session, conn io.WriteCloser) {
+	if err := s.attach(conn); err != nil {
+		utils.LogError("Failed to resume session of ", s.clientId, ", err:", err)
+	}
+}
+
+// Disconnect handles a DISCONNECT from the client. Normal Disconnection
+// discards the Will Message, any other reason code keeps it for Detach. The
+// client may also update the Session Expiry Interval, unless it was 0.
+func (b *Broker) Disconnect(s *Session, req *protocol.DisconnectRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if expiry, ok := req.SessionExpiryInterval(); ok {
+		if s.expiry == 0 && expiry != 0 {
+			return protocol.NewReasonError(protocol.ProtocolError, "Session Expiry Interval was 0 on CONNECT.")
+		}
+		s.expiry = expiry
+	}
+
+	if req.Reason() == protocol.NormalDisconnection {
+		s.will = nil
+	}
+	return nil
+}
+
+// Detach detaches the network connection. The session is discarded at once
+// when its Session Expiry Interval is 0, otherwise when it expires. A Will
+// Message still set is published after the Will Delay Interval, or when the
+// session ends if that happens first. Unacknowledged messages of shared
+// subscriptions are given to other members of their groups.
+func (b *Broker) Detach(s *Session) {
+	var will *protocol.PublishRequest
+
+	b.mu.Lock()
+	if b.sessions[s.clientId] != s {
+		b.mu.Unlock()
+		return
+	}
+	s.detach()
+	pending := s.takeShared(func(share string) bool {
+		return b.sharedWith(share, s)
+	})
+
+	if s.will != nil {
+		if delay := min(s.willDelay, s.expiry); delay > 0 {
+			s.willTimer = time.AfterFunc(delay, func() {
+				b.willDelayElapsed(s)
+			})
+		} else {
+			will, s.will = s.will, nil
+		}
+	}
+
+	switch {
+	case s.expiry == 0:
+		b.discard(s)
+	case s.expiry < neverExpire:
+		s.timer = time.AfterFunc(s.expiry, func() {
+			b.expire(s)
+		})
+	}
+	b.mu.Unlock()
+
+	b.redistribute(s, pending)
+	if will != nil {
+		b.publishWill(will)
+	}
+}
+
+// sharedWith reports whether a member of the shared subscription other than
+// the session is connected.
+func (b *Broker) sharedWith(share string, s *Session) bool {
+	for _, match := range b.subs.Members(share) {
+		if other, ok := b.sessions[match.ClientId]; ok && other != s && other.Connected() {
+			return true
+		}
+	}
+	return false
+}
+
+// redistribute delivers the messages of shared subscriptions taken from a
+// session to another connected member of their group. Messages that no such
+// member may receive go back to the session.
+func (b *Broker) redistribute(from *Session, pending []outboundMessage) {
+	for _, out := range pending {
+		b.mu.RLock()
+		s, sub := b.selectMember(out.share, out.publisher, out.msg.Topic(), b.subs.Members(out.share), from)
+		b.mu.RUnlock()
+
+		if s == nil || !s.Connected() {
+			s = from
+		} else {
+			out.msg = out.msg.Forward(minQoS(out.msg.QoS(), sub.GrantedQoS()), out.msg.Retain())
+		}
+		if err := s.deliver(out); err != nil {
+			utils.LogError("Failed to deliver message to ", s.clientId, ", err:", err)
+		}
+	}
+}
+
+// selectMember chooses the member of a shared subscription receiving a message
+// of the topic, among the sessions allowed to receive it. Connected members
+// are preferred to offline ones.
+func (b *Broker) selectMember(share string, publisher string, topic string, subs []Subscriber, exclude *Session) (*Session, protocol.Subscription) {
+	granted := make(map[*Session]protocol.Subscription)
+	var members, connected []*Session
+	for _, match := range subs {
+		s, ok := b.sessions[match.ClientId]
+		if !ok || s == exclude || !b.authorize(s, auth.Receive, topic) {
+			continue
+		}
+		granted[s] = match.Subscription
+		members = append(members, s)
+		if s.Connected() {
+			connected = append(connected, s)
+		}
+	}
+
+	if len(connected) > 0 {
+		members = connected
+	} else if len(members) == 0 {
+		return nil, protocol.Subscription{}
+	}
+	slices.SortFunc(members, func(a, b *Session) int {
+		return strings.Compare(a.clientId, b.clientId)
+	})
+	s := b.share.Select(share, publisher, members)
+	return s, granted[s]
+}
+
+func (b *Broker) willDelayElapsed(s *Session) {
+	var will *protocol.PublishRequest
+
+	b.mu.Lock()
+	if b.sessions[s.clientId] == s && !s.Connected() {
+		will, s.will = s.will, nil
+	}
+	b.mu.Unlock()
+
+	if will != nil {
+		b.publishWill(will)
+	}
+}
+
+func (b *Broker) publishWill(will *protocol.PublishRequest) {
+	if err := b.Publish(nil, will); err != nil {
+		utils.LogError("Failed to publish will message on ", will.Topic(), ", err:", err)
+	}
+}
+
+func (b *Broker) expire(s *Session) {
+	var will *protocol.PublishRequest
+
+	b.mu.Lock()
+	if b.sessions[s.clientId] == s && !s.Connected() {
+		will, s.will = s.will, nil
+		b.discard(s)
+	}
+	b.mu.Unlock()
+
+	if will != nil {
+		b.publishWill(will)
+	}
+}
+
+func (b *Broker) discard(s *Session) {
+	s.stopTimers()
+	b.unsubscribeAll(s)
+	delete(b.sessions, s.clientId)
+}
+
+// authorize checks the action of the session against the ACL. Messages
+// published by the broker itself have no session and are always allowed.
+func (b *Broker) authorize(s *Session, action auth.Action, topic string) bool {
+	if b.cfg.ACL == nil || s == nil {
+		return true
+	}
+	return b.cfg.ACL.Authorize(auth.Identity{Username: s.username, ClientId: s.clientId, UserProperties: s.userProperties}, action, topic)
+}
+
+func assignClientId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "goker-" + hex.EncodeToString(b)
+}
+
+func (b *Broker) unsubscribeAll(s *Session) {
+	for filter := range s.subscriptions {
+		b.subs.Unsubscribe(s.clientId, filter)
+	}
+	s.subscriptions = make(map[string]protocol.Subscription)
+}
+
+// Subscribe registers the accepted subscriptions and answers with SUBACK,
+// followed by the retained messages selected by each Retain Handling option.
+func (b *Broker) Subscribe(s *Session, req *protocol.SubscribeRequest) error {
+	var retained []*protocol.PublishRequest
+
+	b.mu.Lock()
+	for _, sub := range req.Subscriptions() {
+		if sub.Reason() >= protocol.Unspecified {
+			continue
+		} else if req.SubscriptionIdentifier() != 0 {
+			// CONNACK tells the client Subscription Identifiers are unavailable.
+			sub.Reject(protocol.SubscriptionIdentifiersNotSupported)
+			continue
+		} else if sub.Shared() && !b.cfg.SharedSubscriptionAvailable {
+			sub.Reject(protocol.SharedSubscriptionsNotSupported)
+			continue
+		} else if !b.authorize(s, auth.Subscribe, sub.Filter()) {
+			sub.Reject(protocol.NotAuthorized)
+			continue
+		}
+		existed := b.subs.Subscribe(s.clientId, *sub)
+		s.subscriptions[sub.Filter()] = *sub
+
+		// Retained messages are not sent for shared subscriptions.
+		rh := sub.Options().RetainHandling()
+		if sub.Shared() || rh == protocol.DoNotSendRetained || (rh == protocol.SendRetainedIfNew && existed) {
+			continue
+		}
+		for _, msg := range b.retained.Match(sub.Filter()) {
+			if !b.authorize(s, auth.Receive, msg.Topic()) {
+				continue
+			}
+			retained = append(retained, msg.Forward(minQoS(msg.QoS(), sub.GrantedQoS()), true))
+		}
+	}
+	b.mu.Unlock()
+
+	if err := s.Respond(req); err != nil {
+		return err
+	}
+	for _, msg := range retained {
+		if err := s.deliver(outboundMessage{msg: msg}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscriptions of the topic filters and answers with
+// UNSUBACK, No Subscription Existed for filters the session did not subscribe
+// to.
+func (b *Broker) Unsubscribe(s *Session, req *protocol.UnsubscribeRequest) error {
+	b.mu.Lock()
+	for i, filter := range req.Filters() {
+		if _, ok := s.subscriptions[filter]; !ok {
+			req.SetReason(i, protocol.NoSubscriptionExisted)
+			continue
+		}
+		b.subs.Unsubscribe(s.clientId, filter)
+		delete(s.subscriptions, filter)
+	}
+	b.mu.Unlock()
+
+	return s.Respond(req)
+}
+
+// Publish delivers the application message to every session with a matching
+// subscription and acknowledges it to the publisher. A retained message also
+// replaces the retained message of its topic.
+func (b *Broker) Publish(from *Session, req *protocol.PublishRequest) error {
+	if from != nil {
+		// Only the server sends Subscription Identifiers.
+		if _, ok := req.SubscriptionIdentifier(); ok {
+			return protocol.NewReasonError(protocol.ProtocolError, "PUBLISH of a client must not have a Subscription Identifier.")
+		}
+		if err := from.resolveTopic(req); err != nil {
+			return err
+		}
+	}
+
+	if req.Retain() && !b.cfg.RetainAvailable {
+		return protocol.NewReasonError(protocol.RetainNotSupported, "Retain is not supported.")
+	}
+
+	// A denied message is acknowledged with Not Authorized but never routed.
+	if !b.authorize(from, auth.Publish, req.Topic()) {
+		req.SetReason(protocol.NotAuthorized)
+		return from.Respond(req)
+	}
+
+	req.StartExpiry(time.Now())
+	fresh := true
+	if req.QoS() == protocol.QoS2 && from != nil {
+		var err error
+		if fresh, err = from.receive(req.PacketId()); err != nil {
+			return err
+		}
+	}
+	if fresh {
+		if req.Retain() {
+			b.retained.Store(req)
+		}
+		b.route(from, req)
+	}
+
+	if from == nil {
+		return nil
+	}
+	return from.Respond(req)
+}
+
+// route forwards the message to matching sessions. When a client has several
+// overlapping subscriptions it receives a single copy with the highest granted
+// QoS. Each matching shared subscription gives a copy to one of its members.
+func (b *Broker) route(from *Session, req *protocol.PublishRequest) {
+	var publisher string
+	if from != nil {
+		publisher = from.clientId
+	}
+
+	granted := make(map[string]protocol.Subscription)
+	shares := make(map[string][]Subscriber)
+	for _, match := range b.subs.Match(req.Topic()) {
+		if match.Subscription.Shared() {
+			shares[match.Subscription.Filter()] = append(shares[match.Subscription.Filter()], match)
+			continue
+		}
+		opts := match.Subscription.Options()
+		if opts.NoLocal() && from != nil && match.ClientId == from.clientId {
+			continue
+		}
+
+		cur, ok := granted[match.ClientId]
+		if !ok || match.Subscription.GrantedQoS() > cur.GrantedQoS() {
+			granted[match.ClientId] = match.Subscription
+		}
+	}
+
+	type target struct {
+		s     *Session
+		sub   protocol.Subscription
+		share string
+	}
+	var targets []target
+
+	b.mu.RLock()
+	for clientId, sub := range granted {
+		if s, ok := b.sessions[clientId]; ok && b.authorize(s, auth.Receive, req.Topic()) {
+			targets = append(targets, target{s: s, sub: sub})
+		}
+	}
+	for share, subs := range shares {
+		if s, sub := b.selectMember(share, publisher, req.Topic(), subs, nil); s != nil {
+			targets = append(targets, target{s: s, sub: sub, share: share})
+		}
+	}
+	b.mu.RUnlock()
+
+	if len(targets) == 0 {
+		req.SetReason(protocol.NoMatchingSubscribers)
+	}
+
+	for _, t := range targets {
+		qos := minQoS(req.QoS(), t.sub.GrantedQoS())
+		retain := req.Retain() && t.sub.Options().RetainAsPublished()
+		out := outboundMessage{msg: req.Forward(qos, retain)}
+		if t.share != "" {
+			out.share, out.publisher = t.share, publisher
+		}
+		if err := t.s.deliver(out); err != nil {
+			utils.LogError("Failed to deliver message to ", t.s.clientId, ", err:", err)
+		}
+	}
+}
+
+// Acknowledge advances the publish flows on receipt of PUBACK, PUBREC, PUBREL
+// or PUBCOMP and sends the next packet of the QoS 2 handshake.
+func (b *Broker) Acknowledge(s *Session, req *protocol.AckRequest) error {
+	id := req.PacketId()
+
+	var ok bool
+	var err error
+	switch req.Type() {
+	case protocol.PUBACK:
+		ok, err = s.acknowledge(id, protocol.QoS1, false)
+	case protocol.PUBREC:
+		if req.Reason() >= protocol.Unspecified {
+			ok, err = s.acknowledge(id, protocol.QoS2, false)
+			break
+		}
+		rc := protocol.Success
+		if ok = s.release(id); !ok {
+			rc = protocol.PacketIdentifierNotFound
+		}
+		err = s.Send(protocol.NewAck(protocol.PUBREL, id, rc))
+	case protocol.PUBREL:
+		rc := protocol.Success
+		if ok = s.complete(id); !ok {
+			rc = protocol.PacketIdentifierNotFound
+		}
+		err = s.Send(protocol.NewAck(protocol.PUBCOMP, id, rc))
+	case protocol.PUBCOMP:
+		ok, err = s.acknowledge(id, protocol.QoS2, true)
+	}
+
+	if !ok {
+		utils.LogWarn("Unknown packet identifier ", id, " acknowledged by ", s.clientId)
+	}
+	return err
+}
+
+func minQoS(a protocol.QoS, b protocol.QoS) protocol.QoS {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"goker/internal/protocol"
+	"sync"
+	"time"
+)
+
+type RetainedStore struct {
+	mu       sync.RWMutex
+	messages map[string]*protocol.PublishRequest
+}
+
+func NewRetainedStore() *RetainedStore {
+	return &RetainedStore{messages: make(map[string]*protocol.PublishRequest)}
+}
+
+// Store replaces the retained message of the topic. A message with a
+// zero-length payload deletes it instead.
+func (r *RetainedStore) Store(msg *protocol.PublishRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(msg.Payload()) == 0 {
+		delete(r.messages, msg.Topic())
+		return
+	}
+	r.messages[msg.Topic()] = msg.Forward(msg.QoS(), true)
+}
+
+// Match returns the retained messages of the topics matching the filter.
+// Messages whose Message Expiry Interval elapsed are deleted instead.
+func (r *RetainedStore) Match(filter string) []*protocol.PublishRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var msgs []*protocol.PublishRequest
+	for topic, msg := range r.messages {
+		if !protocol.MatchTopic(filter, topic) {
+			continue
+		} else if msg.Expired(now) {
+			delete(r.messages, topic)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (r *RetainedStore) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.messages)
+}
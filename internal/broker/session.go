@@ -0,0 +1,457 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"goker/internal/protocol"
+	"goker/internal/utils"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// outboundMessage is a message for the client. A message of a shared
+// subscription keeps the topic filter of the subscription and its publisher,
+// so that another member of the group can receive it instead.
+type outboundMessage struct {
+	msg       *protocol.PublishRequest
+	share     string
+	publisher string
+}
+
+// inflightMessage is an outbound QoS 1 or QoS 2 message waiting for
+// acknowledgement. A released QoS 2 message has received its PUBREC and is
+// waiting for PUBCOMP.
+type inflightMessage struct {
+	outboundMessage
+	released bool
+}
+
+// Session is the state of a client. It outlives the network connection until
+// the Session Expiry Interval elapses, and messages published while the client
+// is offline are queued.
+type Session struct {
+	mu       sync.Mutex
+	clientId string
+	username string
+	// userProperties are those of the CONNECT.
+	userProperties protocol.UserProperties
+	conn           io.WriteCloser
+	expiry         time.Duration
+	timer          *time.Timer
+	will           *protocol.PublishRequest
+	willDelay      time.Duration
+	willTimer      *time.Timer
+	subscriptions  map[string]protocol.Subscription
+	inflight       map[uint16]*inflightMessage
+	order          []uint16
+	nextId         uint16
+	received       map[uint16]bool
+	queue          []outboundMessage
+	// Topic Aliases only last as long as the network connection, which is
+	// also the life of the session until another connection resumes it.
+	inAliases  *inboundAliases
+	outAliases *outboundAliases
+	// sendQuota is the Receive Maximum of the client, the number of QoS 1
+	// and QoS 2 messages it accepts in flight. receiveMaximum is that of the
+	// server for the messages of the client.
+	sendQuota      uint16
+	receiveMaximum uint16
+	// maxPacketSize is the Maximum Packet Size of the client.
+	maxPacketSize uint32
+	writeTimeout  time.Duration
+}
+
+func newSession(clientId string, expiry time.Duration) *Session {
+	return &Session{
+		clientId:       clientId,
+		expiry:         expiry,
+		subscriptions:  make(map[string]protocol.Subscription),
+		inflight:       make(map[uint16]*inflightMessage),
+		nextId:         1,
+		received:       make(map[uint16]bool),
+		inAliases:      newInboundAliases(0),
+		outAliases:     newOutboundAliases(0),
+		sendQuota:      math.MaxUint16,
+		receiveMaximum: math.MaxUint16,
+		maxPacketSize:  math.MaxUint32,
+	}
+}
+
+func (s *Session) ClientId() string {
+	return s.clientId
+}
+
+// Username returns the User Name the client connected with, empty without.
+func (s *Session) Username() string {
+	return s.username
+}
+
+// UserProperties returns the User Properties the client connected with.
+func (s *Session) UserProperties() protocol.UserProperties {
+	return s.userProperties
+}
+
+// Write serializes writes from the connection goroutine and from the
+// goroutines of publishing clients, so each packet must be written at once.
+func (s *Session) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(b)
+}
+
+// write bounds the write by the write timeout of the session when the
+// connection supports deadlines. A failed write may have sent part of the
+// packet, after which nothing else can be sent, so the connection is closed.
+func (s *Session) write(b []byte) (int, error) {
+	if s.conn == nil {
+		return 0, errors.New("Session is not connected.")
+	}
+	if d, ok := s.conn.(interface{ SetWriteDeadline(time.Time) error }); ok && s.writeTimeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	n, err := s.conn.Write(b)
+	if err != nil {
+		s.conn.Close()
+	}
+	return n, err
+}
+
+// Close sends a DISCONNECT with the reason code before closing the network
+// connection, giving up on the DISCONNECT after the write timeout.
+func (s *Session) Close(rc protocol.ReasonCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	protocol.NewDisconnect(rc, "").WriteTo(buf)
+	s.write(buf.Bytes())
+	return s.conn.Close()
+}
+
+func (s *Session) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+func (s *Session) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Send writes the packet within the Maximum Packet Size of the client, leaving
+// out its Reason String and User Properties when they do not fit.
+func (s *Session) Send(p io.WriterTo) error {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if _, err := protocol.WriteWithin(buf, p, s.maxPacketSize); err != nil {
+		return err
+	}
+	_, err := s.Write(buf.Bytes())
+	return err
+}
+
+// Respond writes the response to the request, which the server builds without
+// Reason String nor User Properties, so it either fits the Maximum Packet
+// Size of the client or is not sent.
+func (s *Session) Respond(req protocol.Request) error {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if _, err := req.ResponseTo(buf); err != nil {
+		return err
+	} else if buf.Len() == 0 {
+		return nil
+	} else if uint64(buf.Len()) > uint64(s.maxPacketSize) {
+		return protocol.NewReasonError(protocol.PacketTooLarge, fmt.Sprintf("Response of %d bytes exceeds the maximum packet size of %s.", buf.Len(), s.clientId))
+	}
+	_, err := s.Write(buf.Bytes())
+	return err
+}
+
+func (s *Session) Inflight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inflight)
+}
+
+func (s *Session) allocatePacketId() (uint16, error) {
+	for i := 0; i < 0xFFFF; i++ {
+		id := s.nextId
+		s.nextId++
+		if s.nextId == 0 {
+			s.nextId = 1
+		}
+		if _, ok := s.inflight[id]; !ok {
+			return id, nil
+		}
+	}
+	return 0, errors.New("No packet identifier available.")
+}
+
+// deliver writes an outbound message. QoS 1 and QoS 2 messages are assigned a
+// packet identifier and kept in flight until the client acknowledges them.
+// They are queued while the client is offline or has as many messages in
+// flight as its Receive Maximum.
+func (s *Session) deliver(out outboundMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if out.msg.QoS() > protocol.QoS0 {
+			s.queue = append(s.queue, out)
+		}
+		return nil
+	} else if out.msg.QoS() > protocol.QoS0 && (len(s.queue) > 0 || len(s.inflight) >= int(s.sendQuota)) {
+		s.queue = append(s.queue, out)
+		return nil
+	}
+	return s.send(out)
+}
+
+// flush sends the queued messages the Receive Maximum of the client allows.
+func (s *Session) flush() error {
+	for len(s.queue) > 0 && len(s.inflight) < int(s.sendQuota) && s.conn != nil {
+		out := s.queue[0]
+		s.queue = s.queue[1:]
+		if err := s.send(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxAliasOverhead is what a Topic Alias may add to a packet: the property,
+// and a byte more for each of the property length and Remaining Length.
+const maxAliasOverhead = 3 + 2
+
+// send writes the message with a Topic Alias when the client accepts them.
+// The message kept in flight has none, as it may be resent on another network
+// connection.
+//
+// A message whose Message Expiry Interval elapsed is discarded, and a message
+// larger than the Maximum Packet Size of the client is sent without User
+// Properties, or else discarded as if it had been delivered.
+func (s *Session) send(out outboundMessage) error {
+	now := time.Now()
+	if out.msg.Expired(now) {
+		return nil
+	}
+	msg := out.msg.Aged(now)
+	size, limit := int64(msg.Size()), int64(s.maxPacketSize)
+	if size > limit {
+		msg = msg.WithoutUserProperties()
+		if size = int64(msg.Size()); size > limit {
+			utils.LogWarn("Message on ", msg.Topic(), " of ", size, " bytes exceeds the maximum packet size of ", s.clientId, ", discarded")
+			return nil
+		}
+	}
+
+	if msg.QoS() > protocol.QoS0 {
+		id, err := s.allocatePacketId()
+		if err != nil {
+			return err
+		}
+		msg.SetPacketId(id)
+		out.msg = msg
+		s.inflight[id] = &inflightMessage{outboundMessage: out}
+		s.order = append(s.order, id)
+	}
+
+	wire := msg
+	if size+maxAliasOverhead <= limit {
+		wire = s.outAliases.apply(msg)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if _, err := wire.WriteTo(buf); err != nil {
+		return err
+	}
+	_, err := s.write(buf.Bytes())
+	return err
+}
+
+// acknowledge completes the outbound flow of a message. PUBACK completes
+// QoS 1 messages, PUBCOMP completes released QoS 2 messages, and a PUBREC
+// with a failure reason code completes unreleased QoS 2 messages. Each
+// completed message lets a queued one be sent.
+func (s *Session) acknowledge(packetId uint16, qos protocol.QoS, released bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.inflight[packetId]
+	if !ok || m.msg.QoS() != qos || m.released != released {
+		return false, nil
+	}
+	delete(s.inflight, packetId)
+	for i, id := range s.order {
+		if id == packetId {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return true, s.flush()
+}
+
+func (s *Session) release(packetId uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.inflight[packetId]
+	if !ok || m.msg.QoS() != protocol.QoS2 {
+		return false
+	}
+	m.released = true
+	return true
+}
+
+// takeShared removes the messages of the shared subscriptions accepted by
+// take which the client has not acknowledged, queued ones included, so that
+// other members of the groups can receive them. Released QoS 2 messages stay,
+// their PUBREC being received.
+func (s *Session) takeShared(take func(share string) bool) []outboundMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	taking := make(map[string]bool)
+	takes := func(share string) bool {
+		if share == "" {
+			return false
+		} else if t, ok := taking[share]; ok {
+			return t
+		}
+		taking[share] = take(share)
+		return taking[share]
+	}
+
+	var taken []outboundMessage
+	var order []uint16
+	for _, id := range s.order {
+		if m := s.inflight[id]; takes(m.share) && !m.released {
+			taken = append(taken, m.outboundMessage)
+			delete(s.inflight, id)
+			continue
+		}
+		order = append(order, id)
+	}
+	s.order = order
+
+	var queue []outboundMessage
+	for _, out := range s.queue {
+		if takes(out.share) {
+			taken = append(taken, out)
+			continue
+		}
+		queue = append(queue, out)
+	}
+	s.queue = queue
+	return taken
+}
+
+// resolveTopic restores the topic name of an inbound message sent with a
+// Topic Alias.
+func (s *Session) resolveTopic(msg *protocol.PublishRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inAliases.resolve(msg)
+}
+
+// receive records the packet identifier of an inbound QoS 2 message and
+// reports whether it is new, so that retransmissions are not delivered twice.
+// A new message is refused once the client has as many messages in flight as
+// the Receive Maximum of the server.
+func (s *Session) receive(packetId uint16) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.received[packetId] {
+		return false, nil
+	} else if len(s.received) >= int(s.receiveMaximum) {
+		return false, protocol.NewReasonError(protocol.ReceiveMaximumExceeded, fmt.Sprintf("More than %d QoS 2 messages in flight.", s.receiveMaximum))
+	}
+	s.received[packetId] = true
+	return true, nil
+}
+
+func (s *Session) complete(packetId uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.received[packetId] {
+		return false
+	}
+	delete(s.received, packetId)
+	return true
+}
+
+// resume takes over the state of the previous session of the same client.
+func (s *Session) resume(old *Session) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+
+	s.subscriptions, old.subscriptions = old.subscriptions, make(map[string]protocol.Subscription)
+	s.inflight, old.inflight = old.inflight, make(map[uint16]*inflightMessage)
+	s.order, old.order = old.order, nil
+	s.nextId = old.nextId
+	s.received, old.received = old.received, make(map[uint16]bool)
+	s.queue, old.queue = old.queue, nil
+}
+
+// attach binds the network connection to the session. Unacknowledged messages
+// are resent in their original order with the DUP flag set and their Message
+// Expiry Interval reduced, or dropped once expired, or as PUBREL for QoS 2
+// messages that were already released, then queued messages are sent.
+func (s *Session) attach(conn io.WriteCloser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = conn
+	now := time.Now()
+	order := s.order[:0]
+	for _, id := range s.order {
+		if m := s.inflight[id]; !m.released && m.msg.Expired(now) {
+			delete(s.inflight, id)
+			continue
+		}
+		order = append(order, id)
+	}
+	s.order = order
+
+	for _, id := range s.order {
+		var p io.WriterTo
+		if m := s.inflight[id]; m.released {
+			p = protocol.NewAck(protocol.PUBREL, id, protocol.Success)
+		} else {
+			m.msg.SetDuplicate()
+			p = m.msg.Aged(now)
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if _, err := p.WriteTo(buf); err != nil {
+			return err
+		}
+		if _, err := s.write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return s.flush()
+}
+
+func (s *Session) stopTimers() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if s.willTimer != nil {
+		s.willTimer.Stop()
+	}
+}
+
+func (s *Session) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = nil
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+)
+
+// ShareStrategy chooses the member of a shared subscription which receives a
+// message, so that each message goes to a single member of the group.
+type ShareStrategy interface {
+	// Select returns one of the members of the shared subscription, sorted by
+	// client identifier, for a message of the publisher. The publisher is
+	// empty for messages of the server, such as Will Messages.
+	Select(filter string, publisher string, members []*Session) *Session
+}
+
+// NewShareStrategy returns the strategy of the name: round-robin, random,
+// sticky or least-inflight.
+func NewShareStrategy(name string) (ShareStrategy, error) {
+	switch name {
+	case "round-robin":
+		return &roundRobin{next: make(map[string]uint)}, nil
+	case "random":
+		return random{}, nil
+	case "sticky":
+		return sticky{}, nil
+	case "least-inflight":
+		return leastInflight{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown shared subscription strategy %s.", name)
+	}
+}
+
+// roundRobin gives messages to each member in turn.
+type roundRobin struct {
+	mu   sync.Mutex
+	next map[string]uint
+}
+
+func (r *roundRobin) Select(filter string, publisher string, members []*Session) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.next[filter] % uint(len(members))
+	r.next[filter] = i + 1
+	return members[i]
+}
+
+type random struct{}
+
+func (random) Select(filter string, publisher string, members []*Session) *Session {
+	return members[rand.IntN(len(members))]
+}
+
+// sticky gives the messages of a publisher to the same member as long as the
+// members of the group do not change.
+type sticky struct{}
+
+func (sticky) Select(filter string, publisher string, members []*Session) *Session {
+	h := fnv.New32a()
+	h.Write([]byte(publisher))
+	return members[h.Sum32()%uint32(len(members))]
+}
+
+// leastInflight gives messages to the member with the fewest messages in
+// flight or queued, the first one on a tie.
+type leastInflight struct{}
+
+func (leastInflight) Select(filter string, publisher string, members []*Session) *Session {
+	var selected *Session
+	least := 0
+	for _, s := range members {
+		if n := s.Inflight() + s.Queued(); selected == nil || n < least {
+			selected, least = s, n
+		}
+	}
+	return selected
+}
@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"goker/internal/protocol"
+	"strings"
+	"sync"
+)
+
+type Subscriber struct {
+	ClientId     string
+	Subscription protocol.Subscription
+}
+
+type subscriptionNode struct {
+	children    map[string]*subscriptionNode
+	subscribers map[string]protocol.Subscription
+	// shared holds the members of the shared subscriptions to the topic
+	// filter of the node, by Share Name then client identifier.
+	shared map[string]map[string]protocol.Subscription
+}
+
+func newSubscriptionNode() *subscriptionNode {
+	return &subscriptionNode{
+		children:    make(map[string]*subscriptionNode),
+		subscribers: make(map[string]protocol.Subscription),
+		shared:      make(map[string]map[string]protocol.Subscription),
+	}
+}
+
+func (n *subscriptionNode) empty() bool {
+	return len(n.children) == 0 && len(n.subscribers) == 0 && len(n.shared) == 0
+}
+
+func (n *subscriptionNode) collect(subs []Subscriber) []Subscriber {
+	for clientId, sub := range n.subscribers {
+		subs = append(subs, Subscriber{ClientId: clientId, Subscription: sub})
+	}
+	for _, members := range n.shared {
+		for clientId, sub := range members {
+			subs = append(subs, Subscriber{ClientId: clientId, Subscription: sub})
+		}
+	}
+	return subs
+}
+
+// members returns the subscribers of the node for the topic filter, which is
+// a shared subscription when the Share Name is set.
+func (n *subscriptionNode) members(share string, create bool) map[string]protocol.Subscription {
+	if share == "" {
+		return n.subscribers
+	}
+	members, ok := n.shared[share]
+	if !ok && create {
+		members = make(map[string]protocol.Subscription)
+		n.shared[share] = members
+	}
+	return members
+}
+
+// splitFilter returns the Share Name of a shared subscription, empty for
+// other subscriptions, and the levels of the topic filter.
+func splitFilter(filter string) (string, []string) {
+	if share, topicFilter, ok := protocol.SplitSharedFilter(filter); ok {
+		return share, strings.Split(topicFilter, protocol.TopicLevelSeparator)
+	}
+	return "", strings.Split(filter, protocol.TopicLevelSeparator)
+}
+
+type SubscriptionTree struct {
+	mu   sync.RWMutex
+	root *subscriptionNode
+}
+
+func NewSubscriptionTree() *SubscriptionTree {
+	return &SubscriptionTree{root: newSubscriptionNode()}
+}
+
+// Subscribe adds or replaces the subscription of a client and reports whether
+// the client was already subscribed to the same topic filter. A shared
+// subscription adds the client to the members of the group.
+func (t *SubscriptionTree) Subscribe(clientId string, sub protocol.Subscription) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	share, levels := splitFilter(sub.Filter())
+	n := t.root
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			child = newSubscriptionNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+
+	members := n.members(share, true)
+	_, existed := members[clientId]
+	members[clientId] = sub
+	return existed
+}
+
+func (t *SubscriptionTree) Unsubscribe(clientId string, filter string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	share, levels := splitFilter(filter)
+	path := []*subscriptionNode{t.root}
+	n := t.root
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			return false
+		}
+		path = append(path, child)
+		n = child
+	}
+
+	members := n.members(share, false)
+	if _, ok := members[clientId]; !ok {
+		return false
+	}
+	delete(members, clientId)
+	if share != "" && len(members) == 0 {
+		delete(n.shared, share)
+	}
+
+	for i := len(levels) - 1; i >= 0 && path[i+1].empty(); i-- {
+		delete(path[i].children, levels[i])
+	}
+	return true
+}
+
+// Match returns every subscription whose topic filter matches the topic name.
+// Topics starting with '$' are not matched by wildcards at the first level.
+func (t *SubscriptionTree) Match(topic string) []Subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	levels := strings.Split(topic, protocol.TopicLevelSeparator)
+	system := strings.HasPrefix(topic, "$")
+
+	var subs []Subscriber
+	var walk func(n *subscriptionNode, i int)
+	walk = func(n *subscriptionNode, i int) {
+		wildcard := !(i == 0 && system)
+
+		if child, ok := n.children[protocol.MultiLevelWildcard]; ok && wildcard {
+			subs = child.collect(subs)
+		}
+		if i == len(levels) {
+			subs = n.collect(subs)
+			return
+		}
+		if child, ok := n.children[levels[i]]; ok {
+			walk(child, i+1)
+		}
+		if child, ok := n.children[protocol.SingleLevelWildcard]; ok && wildcard {
+			walk(child, i+1)
+		}
+	}
+	walk(t.root, 0)
+
+	return subs
+}
+
+// Members returns the members of a shared subscription.
+func (t *SubscriptionTree) Members(filter string) []Subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	share, levels := splitFilter(filter)
+	n := t.root
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+
+	var subs []Subscriber
+	for clientId, sub := range n.members(share, false) {
+		subs = append(subs, Subscriber{ClientId: clientId, Subscription: sub})
+	}
+	return subs
+}
@@ -1,54 +1,235 @@
 package gateway
 
 import (
-	"bytes"
+	"errors"
+	"goker/internal/auth"
+	"goker/internal/broker"
 	"goker/internal/protocol"
 	"goker/internal/utils"
 	"net"
+	"time"
 )
 
-func ListenAndServe() {
-	l, err := net.Listen("tcp", ":8883")
-	utils.AssertFail(err != nil)
-	defer l.Close()
+var gBroker = broker.NewBroker(broker.DefaultConfig())
+var gAuth = auth.NewRegistry(auth.NewScram(auth.NewScramCredentials()))
+var gCredentials auth.CredentialProvider
 
+// Configure replaces the broker with one using the configuration. It must be
+// called before serving any listener.
+func Configure(cfg broker.Config) {
+	gBroker = broker.NewBroker(cfg)
+}
+
+// UseCredentials requires clients not using enhanced authentication to log
+// in with a User Name and Password known by the provider. A provider which
+// also keeps SCRAM credentials, such as the password file, serves the users
+// of SCRAM-SHA-256 too.
+func UseCredentials(p auth.CredentialProvider) {
+	gCredentials = p
+	store, ok := p.(auth.ScramStore)
+	if !ok {
+		store = auth.NewScramCredentials()
+	}
+	gAuth.Register(auth.NewScram(store))
+}
+
+// disconnect logs why the connection is closed and, once the client is
+// connected, notifies it with a DISCONNECT carrying the matching reason code.
+func disconnect(s *broker.Session, rc protocol.ReasonCode, err error) {
+	utils.LogError("Close connection with reason, err:", err)
+	if s == nil {
+		return
+	}
+
+	rc = protocol.ReasonOf(err, rc)
+	if sErr := s.Send(protocol.NewDisconnect(rc, err.Error())); sErr != nil {
+		utils.LogError("Failed to send DISCONNECT, err:", sErr)
+	}
+}
+
+func readFailed(s *broker.Session, err error) {
+	var nErr net.Error
+	var rErr *protocol.ReasonError
+	if errors.As(err, &nErr) && nErr.Timeout() {
+		disconnect(s, protocol.KeepAliveTimeout, errors.New("Keep Alive timeout"))
+	} else if errors.As(err, &rErr) {
+		disconnect(s, protocol.MalformedPacket, err)
+	} else {
+		utils.LogError("Failed to read packet, err:", err)
+	}
+}
+
+// authenticate runs the enhanced authentication requested by the CONNECT,
+// challenging the client with AUTH packets until it is authenticated. The
+// session then belongs to the authenticated user, so a User Name of the
+// CONNECT naming anyone else is refused.
+func authenticate(c net.Conn, r *protocol.PacketReader, connect *protocol.ConnectRequest) error {
+	method := connect.AuthenticationMethod()
+	ex, err := gAuth.Begin(method, connect.UserProperties())
+	if err != nil {
+		return err
+	}
+
+	data := connect.AuthenticationData()
 	for {
-		c, err := l.Accept()
-		utils.AssertFail(err != nil)
+		resp, done, err := ex.Next(data)
+		if err != nil {
+			return err
+		} else if done {
+			if user := ex.Username(); len(user) > 0 {
+				if username, ok := connect.Username(); ok && username != user {
+					return protocol.NewReasonError(protocol.NotAuthorized, "User Name does not match the authenticated user "+user)
+				}
+				connect.SetUsername(user)
+			}
+			connect.SetAuthenticationData(resp)
+			return nil
+		}
+
+		if _, err = protocol.NewAuth(protocol.ContinueAuthentication, method, resp).WriteTo(c); err != nil {
+			return err
+		}
+
+		req, err := r.ReadPacket()
+		if err != nil {
+			return err
+		}
+		a, ok := req.(*protocol.AuthRequest)
+		if !ok || a.Reason() != protocol.ContinueAuthentication || a.AuthenticationMethod() != method {
+			return protocol.NewReasonError(protocol.ProtocolError, "Expected AUTH to continue authentication.")
+		}
+		data = a.AuthenticationData()
+	}
+}
+
+// login authenticates the client of the CONNECT, either by its certificate,
+// through enhanced authentication or with its User Name and Password.
+func login(c net.Conn, r *protocol.PacketReader, connect *protocol.ConnectRequest, tlsCfg *TLSConfig) error {
+	identified, err := tlsCfg.identify(c, connect)
+	if err != nil {
+		return err
+	}
 
-		go clientHandle(c)
+	if len(connect.AuthenticationMethod()) > 0 {
+		return authenticate(c, r, connect)
+	} else if gCredentials != nil && !identified {
+		username, _ := connect.Username()
+		return gCredentials.Authenticate(username, connect.Password(), connect.UserProperties())
 	}
+	return nil
 }
 
-func clientHandle(c net.Conn) {
+// reauthenticate handles an AUTH received once connected. Re-authenticate
+// starts a new exchange with the method of the CONNECT, which is returned
+// until completed since other packets may be exchanged meanwhile.
+func reauthenticate(s *broker.Session, method string, ex auth.Exchange, req *protocol.AuthRequest) (auth.Exchange, error) {
+	if len(method) == 0 || req.AuthenticationMethod() != method {
+		return nil, protocol.NewReasonError(protocol.ProtocolError, "Authentication method must match the one of CONNECT.")
+	}
+
+	switch {
+	case req.Reason() == protocol.ReAuthenticate && ex == nil:
+		var err error
+		if ex, err = gAuth.Begin(method, s.UserProperties()); err != nil {
+			return nil, err
+		}
+	case req.Reason() == protocol.ContinueAuthentication && ex != nil:
+	default:
+		return nil, protocol.NewReasonError(protocol.ProtocolError, "Unexpected AUTH reason code.")
+	}
+
+	resp, done, err := ex.Next(req.AuthenticationData())
+	if err != nil {
+		return nil, err
+	} else if done {
+		if user := ex.Username(); len(user) > 0 && user != s.Username() {
+			return nil, protocol.NewReasonError(protocol.NotAuthorized, "Re-authenticated as another user "+user)
+		}
+		return nil, s.Send(protocol.NewAuth(protocol.Success, method, resp))
+	}
+	return ex, s.Send(protocol.NewAuth(protocol.ContinueAuthentication, method, resp))
+}
+
+// connectTimeout bounds the wait for the CONNECT, so that connections which
+// never send one do not pile up.
+const connectTimeout = 10 * time.Second
+
+func clientHandle(c net.Conn, tlsCfg *TLSConfig) {
 	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(connectTimeout))
 
-	var b []byte
+	r := protocol.NewPacketReader(c, gBroker.MaximumPacketSize())
+	var session *broker.Session
+	var keepAlive time.Duration
+	var method string
+	var reauth auth.Exchange
 	for {
-		b = make([]byte, protocol.FixedHeaderLen)
-		if _, err := c.Read(b); err != nil {
-			utils.LogError("Failed to read header, err:", err)
-			return
+		// The client is considered gone after one and a half times the Keep
+		// Alive without any control packet.
+		if keepAlive > 0 {
+			c.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
 		}
 
-		h, err := protocol.ParseHeader(bytes.NewBuffer(b))
+		req, err := r.ReadPacket()
 		if err != nil {
-			utils.LogError(err != nil, "Failed to parse header, err:", err)
+			readFailed(session, err)
 			return
 		}
 
-		b = make([]byte, h.BodyLength())
-		if _, err = c.Read(b); err != nil {
-			utils.LogError("Failed to read body, err:", err)
-			return
+		if session == nil {
+			connect, ok := req.(*protocol.ConnectRequest)
+			if !ok {
+				utils.LogError("First packet must be CONNECT, got:", req.ToString())
+				return
+			}
+			if err := login(c, r, connect, tlsCfg); err != nil {
+				utils.LogError("Authentication failed, err:", err)
+				connect.Refuse(protocol.ReasonOf(err, protocol.NotAuthorized))
+				connect.ResponseTo(c)
+				return
+			}
+			method = connect.AuthenticationMethod()
+			if session = gBroker.Connect(connect); session == nil {
+				utils.LogError("Connection refused, reason:", connect.Connack().Reason())
+				connect.ResponseTo(c)
+				return
+			}
+			defer gBroker.Detach(session)
+			if _, err := connect.ResponseTo(c); err != nil {
+				utils.LogError("Close connection with reason, err:", err)
+				return
+			}
+			gBroker.Attach(session, c)
+			if keepAlive = connect.KeepAlive(); keepAlive == 0 {
+				c.SetReadDeadline(time.Time{})
+			}
+			continue
+		}
+
+		switch req := req.(type) {
+		case *protocol.ConnectRequest:
+			err = protocol.NewReasonError(protocol.ProtocolError, "Duplicate CONNECT packet")
+		case *protocol.SubscribeRequest:
+			err = gBroker.Subscribe(session, req)
+		case *protocol.UnsubscribeRequest:
+			err = gBroker.Unsubscribe(session, req)
+		case *protocol.PublishRequest:
+			err = gBroker.Publish(session, req)
+		case *protocol.AckRequest:
+			err = gBroker.Acknowledge(session, req)
+		case *protocol.AuthRequest:
+			reauth, err = reauthenticate(session, method, reauth, req)
+		case *protocol.DisconnectRequest:
+			if err = gBroker.Disconnect(session, req); err == nil {
+				return
+			}
+		default:
+			err = session.Respond(req)
 		}
 
-		req, err := h.ParseBody(bytes.NewBuffer(b))
 		if err != nil {
-			utils.LogError("Close connection with reason, err:", err)
+			disconnect(session, protocol.Unspecified, err)
 			return
 		}
-
-		req.ResponseTo(c)
 	}
 }
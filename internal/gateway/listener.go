@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"goker/internal/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Transport string
+
+const (
+	TCP  Transport = "tcp"
+	TLS  Transport = "tls"
+	Unix Transport = "unix"
+	WS   Transport = "ws"
+	WSS  Transport = "wss"
+)
+
+const DefaultWebSocketPath = "/mqtt"
+
+// ListenerConfig describes one endpoint of the broker. Addr is a host:port
+// for TCP, TLS and WebSocket, and the path of the socket for Unix.
+type ListenerConfig struct {
+	Transport Transport
+	Addr      string
+	// TLS is required by the TLS and WSS transports and ignored by the others.
+	TLS *TLSConfig
+	// Path is the HTTP path upgraded to MQTT by the WebSocket transports,
+	// DefaultWebSocketPath when empty.
+	Path string
+	// Origins are the origins browsers may connect from over WebSocket, any
+	// with "*". Without them only pages served by the broker host may connect.
+	Origins []string
+}
+
+func (cfg *ListenerConfig) String() string {
+	return string(cfg.Transport) + "://" + cfg.Addr + cfg.Path
+}
+
+var certFields = map[string]CertField{"": CertNone, "cn": CertCommonName, "san": CertSAN}
+
+func parseTLS(s string, q url.Values) (*TLSConfig, error) {
+	cfg := &TLSConfig{
+		CertFile:     q.Get("cert"),
+		KeyFile:      q.Get("key"),
+		ClientCAFile: q.Get("client-ca"),
+	}
+	if v := q.Get("require-client-cert"); len(v) > 0 {
+		var err error
+		if cfg.RequireClientCert, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid require-client-cert of listener %s.", s)
+		}
+	}
+
+	var ok bool
+	if cfg.UsernameFrom, ok = certFields[q.Get("username-from")]; !ok {
+		return nil, fmt.Errorf("Invalid username-from of listener %s.", s)
+	} else if cfg.ClientIdFrom, ok = certFields[q.Get("clientid-from")]; !ok {
+		return nil, fmt.Errorf("Invalid clientid-from of listener %s.", s)
+	} else if len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0 {
+		return nil, fmt.Errorf("Listener %s requires cert and key.", s)
+	}
+	return cfg, nil
+}
+
+// ParseListener reads a listener from a URL such as tcp://:1883,
+// unix:///run/goker.sock or
+// tls://:8883?cert=server.crt&key=server.key&client-ca=ca.crt&require-client-cert=true&username-from=cn
+// where client identity may be taken from the cn or san of certificates with
+// username-from and clientid-from. WebSocket listeners such as
+// ws://:8080/mqtt?origin=https://dashboard.example.com take the path from the
+// URL and any number of allowed origins, and wss ones the TLS settings too.
+func ParseListener(s string) (ListenerConfig, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ListenerConfig{}, err
+	}
+
+	cfg := ListenerConfig{Transport: Transport(u.Scheme), Addr: u.Host}
+	q := u.Query()
+	switch cfg.Transport {
+	case TCP:
+	case Unix:
+		cfg.Addr = u.Path
+	case TLS:
+		if cfg.TLS, err = parseTLS(s, q); err != nil {
+			return ListenerConfig{}, err
+		}
+	case WS, WSS:
+		cfg.Path, cfg.Origins = u.Path, q["origin"]
+		if cfg.Transport == WSS {
+			if cfg.TLS, err = parseTLS(s, q); err != nil {
+				return ListenerConfig{}, err
+			}
+		}
+	default:
+		return ListenerConfig{}, fmt.Errorf("Unsupported transport of listener %s.", s)
+	}
+
+	if len(cfg.Addr) == 0 {
+		return ListenerConfig{}, fmt.Errorf("Missing address of listener %s.", s)
+	}
+	return cfg, nil
+}
+
+// Listener accepts the connections of an endpoint and feeds them to the
+// connection pipeline shared by every listener.
+type Listener struct {
+	cfg ListenerConfig
+	l   net.Listener
+	// ws upgrades the connections of WebSocket transports.
+	ws *wsHandler
+}
+
+// removeStaleSocket removes the socket file left by a process which did not
+// shut down cleanly, as long as nothing accepts connections on it.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+func Listen(cfg ListenerConfig) (*Listener, error) {
+	var l net.Listener
+	var err error
+	switch cfg.Transport {
+	case TCP, WS:
+		l, err = net.Listen("tcp", cfg.Addr)
+	case TLS, WSS:
+		if cfg.TLS == nil {
+			return nil, errors.New("Missing TLS configuration of listener " + cfg.String())
+		}
+		var conf *tls.Config
+		if conf, err = NewTLSConfig(*cfg.TLS); err != nil {
+			return nil, err
+		}
+		l, err = tls.Listen("tcp", cfg.Addr, conf)
+	case Unix:
+		removeStaleSocket(cfg.Addr)
+		l, err = net.Listen("unix", cfg.Addr)
+	default:
+		return nil, errors.New("Unsupported transport of listener " + cfg.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Transport != TLS && cfg.Transport != WSS {
+		cfg.TLS = nil
+	}
+
+	listener := &Listener{cfg: cfg, l: l}
+	if cfg.Transport == WS || cfg.Transport == WSS {
+		listener.ws = newWSHandler(cfg)
+	}
+	return listener, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+func (l *Listener) Close() error {
+	return l.l.Close()
+}
+
+// Serve accepts connections until the listener is closed. Failing accepts,
+// such as when running out of file descriptors, are retried with a backoff
+// instead of stopping the listener. WebSocket listeners are served over HTTP
+// which retries the same way.
+func (l *Listener) Serve() error {
+	utils.LogInfo("Listening on ", l.cfg.String())
+
+	if l.ws != nil {
+		err := (&http.Server{Handler: l.ws, ReadHeaderTimeout: 10 * time.Second}).Serve(l.l)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+
+	var backoff time.Duration
+	for {
+		c, err := l.l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			utils.LogError("Failed to accept connection on ", l.cfg.String(), ", err:", err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		go clientHandle(c, l.cfg.TLS)
+	}
+}
+
+// ListenAndServe opens every listener before serving them, so that a broker
+// with a misconfigured endpoint does not start at all. It returns once a
+// listener stops.
+func ListenAndServe(cfgs ...ListenerConfig) error {
+	if len(cfgs) == 0 {
+		return errors.New("No listener configured.")
+	}
+
+	listeners := make([]*Listener, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		l, err := Listen(cfg)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() { errs <- l.Serve() }()
+	}
+	err := <-errs
+	for _, l := range listeners {
+		l.Close()
+	}
+	return err
+}
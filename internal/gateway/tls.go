@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"goker/internal/protocol"
+	"goker/internal/utils"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertField selects what identifies a client in its certificate.
+type CertField int
+
+const (
+	CertNone CertField = iota
+	CertCommonName
+	// CertSAN is the first Subject Alternative Name of the certificate, looked
+	// up in DNS names, email addresses then URIs.
+	CertSAN
+)
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the CA bundle client certificates are verified against.
+	// Without it clients are not asked for a certificate.
+	ClientCAFile string
+	// RequireClientCert refuses clients without a valid certificate, otherwise
+	// a certificate is only verified when the client presents one.
+	RequireClientCert bool
+	// UsernameFrom and ClientIdFrom replace the User Name and Client
+	// Identifier of the CONNECT with the identity of the certificate. A client
+	// whose User Name comes from its certificate does not need a password.
+	UsernameFrom CertField
+	ClientIdFrom CertField
+}
+
+// CertIdentity returns the field of the certificate identifying the client.
+func CertIdentity(cert *x509.Certificate, field CertField) (string, bool) {
+	switch field {
+	case CertCommonName:
+		return cert.Subject.CommonName, len(cert.Subject.CommonName) > 0
+	case CertSAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], true
+		} else if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0], true
+		} else if len(cert.URIs) > 0 {
+			return cert.URIs[0].String(), true
+		}
+	}
+	return "", false
+}
+
+// identify applies the identity of the client certificate to the CONNECT and
+// reports whether the client is authenticated by it, which requires the User
+// Name to come from the certificate.
+func (cfg *TLSConfig) identify(c net.Conn, connect *protocol.ConnectRequest) (bool, error) {
+	if cfg == nil || (cfg.UsernameFrom == CertNone && cfg.ClientIdFrom == CertNone) {
+		return false, nil
+	}
+
+	// Both TLS connections and WebSockets over TLS expose their state.
+	tc, ok := c.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok || len(tc.ConnectionState().PeerCertificates) == 0 {
+		return false, protocol.NewReasonError(protocol.NotAuthorized, "Missing client certificate.")
+	}
+	cert := tc.ConnectionState().PeerCertificates[0]
+
+	if cfg.UsernameFrom != CertNone {
+		username, ok := CertIdentity(cert, cfg.UsernameFrom)
+		if !ok {
+			return false, protocol.NewReasonError(protocol.NotAuthorized, "Client certificate has no user name.")
+		}
+		connect.SetUsername(username)
+	}
+	if cfg.ClientIdFrom != CertNone {
+		clientId, ok := CertIdentity(cert, cfg.ClientIdFrom)
+		if !ok {
+			return false, protocol.NewReasonError(protocol.NotAuthorized, "Client certificate has no client identifier.")
+		}
+		if clientId != connect.ClientIdentifier() {
+			connect.AssignClientIdentifier(clientId)
+		}
+	}
+	return cfg.UsernameFrom != CertNone, nil
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// certStore serves the certificate and CA bundle of a TLS listener, loading
+// them again once their files change so that certificates can be rotated
+// without restarting the broker.
+type certStore struct {
+	mu     sync.Mutex
+	cfg    TLSConfig
+	stamps [3]fileStamp
+	tls    *tls.Config
+}
+
+func (s *certStore) files() [3]string {
+	return [3]string{s.cfg.CertFile, s.cfg.KeyFile, s.cfg.ClientCAFile}
+}
+
+func (s *certStore) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(s.cfg.ClientCAFile) == 0 {
+		return conf, nil
+	}
+
+	pem, err := os.ReadFile(s.cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificate found in CA bundle " + s.cfg.ClientCAFile)
+	}
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	if s.cfg.RequireClientCert {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// config returns the configuration of the next handshake. Files are reloaded
+// when changed, and the previous configuration is kept when they cannot be
+// loaded since a rotation may be halfway through.
+func (s *certStore) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stamps [3]fileStamp
+	for i, path := range s.files() {
+		if len(path) > 0 {
+			stamps[i] = stampOf(path)
+		}
+	}
+	if stamps == s.stamps {
+		return s.tls, nil
+	}
+
+	conf, err := s.load()
+	if err != nil {
+		utils.LogError("Failed to reload certificates, err:", err)
+		return s.tls, nil
+	}
+	s.tls, s.stamps = conf, stamps
+	return s.tls, nil
+}
+
+// NewTLSConfig loads the certificates of the configuration and returns the
+// configuration of a TLS listener which picks up their changes.
+func NewTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	s := &certStore{cfg: cfg}
+	for i, path := range s.files() {
+		if len(path) > 0 {
+			s.stamps[i] = stampOf(path)
+		}
+	}
+
+	var err error
+	if s.tls, err = s.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetConfigForClient: s.config}, nil
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"errors"
+	"goker/internal/utils"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketSubprotocol is the subprotocol clients must offer to speak MQTT
+// over WebSocket.
+const WebSocketSubprotocol = "mqtt"
+
+// wsConn adapts the binary messages of a WebSocket into the byte stream of
+// control packets. A packet may be split across several messages and a
+// message may hold several packets, so reads only follow message boundaries
+// when a message is exhausted.
+type wsConn struct {
+	*websocket.Conn
+	r  io.Reader
+	mu sync.Mutex
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			t, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if t != websocket.BinaryMessage {
+				return 0, errors.New("MQTT must be carried in binary WebSocket frames.")
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(b)
+		if errors.Is(err, io.EOF) {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends b as one binary message. Callers may write concurrently, so
+// writes are serialized as the WebSocket allows a single writer.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// ConnectionState exposes the TLS state of wss connections so that clients
+// can be identified by their certificate as over the TLS transport.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.NetConn().(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// wsHandler upgrades the HTTP requests of the path into MQTT connections.
+type wsHandler struct {
+	path     string
+	tlsCfg   *TLSConfig
+	upgrader websocket.Upgrader
+}
+
+func newWSHandler(cfg ListenerConfig) *wsHandler {
+	h := &wsHandler{path: cfg.Path, tlsCfg: cfg.TLS}
+	if len(h.path) == 0 {
+		h.path = DefaultWebSocketPath
+	}
+	h.upgrader.Subprotocols = []string{WebSocketSubprotocol}
+
+	// Without allowed origins the upgrader only accepts browsers on the host
+	// of the broker. Clients which are not browsers send no Origin.
+	if len(cfg.Origins) > 0 {
+		h.upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return len(origin) == 0 || slices.ContainsFunc(cfg.Origins, func(o string) bool {
+				return o == "*" || strings.EqualFold(o, origin)
+			})
+		}
+	}
+	return h
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	if !slices.Contains(websocket.Subprotocols(r), WebSocketSubprotocol) {
+		http.Error(w, "WebSocket subprotocol "+WebSocketSubprotocol+" is required", http.StatusBadRequest)
+		return
+	}
+
+	c, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		utils.LogError("Failed to upgrade WebSocket connection, err:", err)
+		return
+	}
+	clientHandle(&wsConn{Conn: c}, h.tlsCfg)
+}
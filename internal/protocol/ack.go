@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type AckProperties struct {
+	PacketProperties
+	reasonString   UTF8String
+	userProperties UserProperties
+}
+
+func (p *AckProperties) scope() propertyScope {
+	return scopeOf(PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK)
+}
+
+func (p *AckProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case ReasonString:
+		return &p.reasonString
+	case UserProperty:
+		return &p.userProperties
+	default:
+		return nil
+	}
+}
+
+func (p *AckProperties) decode(r *bytes.Buffer) error {
+	*p = AckProperties{}
+	return decodeProperties(r, p)
+}
+
+// AckRequest is an acknowledgement in the publish flows. Those packets share
+// the same layout and only differ in their control packet type.
+type AckRequest struct {
+	ctl      CType
+	packetId TwoByteInteger
+	reason   ReasonCode
+	prop     AckProperties
+}
+
+func NewAck(ctl CType, packetId uint16, rc ReasonCode) *AckRequest {
+	return &AckRequest{ctl: ctl, packetId: TwoByteInteger(packetId), reason: rc}
+}
+
+func ackFlag(ctl CType) Flag {
+	if ctl == PUBREL {
+		return Flag{qos: QoS1}
+	}
+	return Flag{}
+}
+
+func (req *AckRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != ackFlag(h.ctl) {
+		return errors.New("Invalid acknowledgement fixed header flags.")
+	}
+
+	*req = AckRequest{ctl: h.ctl, reason: Success}
+	if err := req.packetId.Decode(r); err != nil {
+		return err
+	} else if req.packetId == 0 {
+		return errors.New("Acknowledgement packet identifier must not be 0.")
+	}
+
+	if r.Len() == 0 {
+		return nil
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return errors.New("Missing acknowledgement reason code.")
+	}
+	req.reason = ReasonCode(b)
+
+	if r.Len() == 0 {
+		return nil
+	}
+
+	return req.prop.decode(r)
+}
+
+func (req *AckRequest) Type() CType {
+	return req.ctl
+}
+
+func (req *AckRequest) properties() propertySet {
+	return &req.prop
+}
+
+func (req *AckRequest) PacketId() uint16 {
+	return uint16(req.packetId)
+}
+
+func (req *AckRequest) Reason() ReasonCode {
+	return req.reason
+}
+
+func (req *AckRequest) ToString() string {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteString(fmt.Sprintf("packet: %d, ", req.ctl))
+	buf.WriteString(fmt.Sprintf("packId: %d, ", req.packetId))
+	buf.WriteString(fmt.Sprintf("reason: %d", req.reason))
+
+	return buf.String()
+}
+
+func (req *AckRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	req.packetId.Encode(w)
+
+	prop, err := encodeProperties(&req.prop)
+	if err != nil {
+		return nil, err
+	} else if req.reason == Success && prop.Len() == 0 {
+		return w, nil
+	}
+	req.reason.encode().WriteTo(w)
+
+	if prop.Len() == 0 {
+		return w, nil
+	} else if err = VarByteInt(prop.Len()).Encode(w); err != nil {
+		return nil, err
+	}
+	prop.WriteTo(w)
+
+	return w, nil
+}
+
+func (req *AckRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, req.ctl, ackFlag(req.ctl), body)
+}
+
+func (req *AckRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+// Decode reads an acknowledgement of the type of the packet, or of any type
+// of the publish flows when the packet has none yet.
+func (req *AckRequest) Decode(r io.Reader) error {
+	h, body, err := readFrame(r, 0)
+	if err != nil {
+		return err
+	} else if h.ctl < PUBACK || h.ctl > PUBCOMP || (req.ctl != RESERVED && h.ctl != req.ctl) {
+		return NewReasonError(ProtocolError, fmt.Sprintf("Expected acknowledgement, got packet type %d.", h.ctl))
+	}
+	return decodeBody(req, h, body)
+}
+
+func (req *AckRequest) ResponseTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type AuthProperties struct {
+	PacketProperties
+	authenticationMethod UTF8String
+	authenticationData   BinaryData
+	reasonString         UTF8String
+	userProperties       UserProperties
+}
+
+func (p *AuthProperties) scope() propertyScope {
+	return scopeOf(AUTH)
+}
+
+func (p *AuthProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case AuthenticationMethod:
+		return &p.authenticationMethod
+	case AuthenticationData:
+		return &p.authenticationData
+	case ReasonString:
+		return &p.reasonString
+	case UserProperty:
+		return &p.userProperties
+	default:
+		return nil
+	}
+}
+
+func (p *AuthProperties) decode(r *bytes.Buffer) error {
+	*p = AuthProperties{}
+	return decodeProperties(r, p)
+}
+
+// AuthRequest carries one step of an enhanced authentication exchange, either
+// while connecting or when the client re-authenticates.
+type AuthRequest struct {
+	reason ReasonCode
+	prop   AuthProperties
+}
+
+// NewAuth creates the AUTH sent by the server. The authentication data is
+// omitted when empty.
+func NewAuth(rc ReasonCode, method string, data []byte) *AuthRequest {
+	req := &AuthRequest{reason: rc}
+	req.prop.fields = make(map[MqttProperty]bool)
+	req.prop.authenticationMethod = UTF8String(method)
+	req.prop.fields[AuthenticationMethod] = true
+	if len(data) > 0 {
+		req.prop.authenticationData = BinaryData(data)
+		req.prop.fields[AuthenticationData] = true
+	}
+	return req
+}
+
+func (req *AuthRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid auth fixed header flags.")
+	}
+
+	*req = AuthRequest{reason: Success}
+	req.prop.fields = make(map[MqttProperty]bool)
+	if r.Len() == 0 {
+		return nil
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return errors.New("Missing auth reason code.")
+	}
+	req.reason = ReasonCode(b)
+	switch req.reason {
+	case Success, ContinueAuthentication, ReAuthenticate:
+	default:
+		return NewReasonError(ProtocolError, "Invalid auth reason code.")
+	}
+
+	if r.Len() == 0 {
+		return nil
+	}
+
+	if err := req.prop.decode(r); err != nil {
+		return err
+	} else if req.prop.fields[AuthenticationData] && !req.prop.fields[AuthenticationMethod] {
+		return NewReasonError(ProtocolError, "Authentication Data without Authentication Method.")
+	}
+
+	return nil
+}
+
+func (req *AuthRequest) Reason() ReasonCode {
+	return req.reason
+}
+
+func (req *AuthRequest) AuthenticationMethod() string {
+	return string(req.prop.authenticationMethod)
+}
+
+func (req *AuthRequest) AuthenticationData() []byte {
+	return req.prop.authenticationData
+}
+
+func (req *AuthRequest) ToString() string {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteString(fmt.Sprintf("packet: AUTH, "))
+	buf.WriteString(fmt.Sprintf("reason: %d, ", req.reason))
+	buf.WriteString(fmt.Sprintf("method: %s", req.prop.authenticationMethod))
+
+	return buf.String()
+}
+
+func (req *AuthRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	prop, err := encodeProperties(&req.prop)
+	if err != nil {
+		return nil, err
+	} else if req.reason == Success && prop.Len() == 0 {
+		return w, nil
+	}
+	req.reason.encode().WriteTo(w)
+	if err = VarByteInt(prop.Len()).Encode(w); err != nil {
+		return nil, err
+	}
+	prop.WriteTo(w)
+
+	return w, nil
+}
+
+func (req *AuthRequest) Type() CType {
+	return AUTH
+}
+
+func (req *AuthRequest) properties() propertySet {
+	return &req.prop
+}
+
+func (req *AuthRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, AUTH, Flag{}, body)
+}
+
+func (req *AuthRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *AuthRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
+}
+
+func (req *AuthRequest) ResponseTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
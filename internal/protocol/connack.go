@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+type ConnackProperties struct {
+	PacketProperties
+	sessionExpiryInterval            FourByteInteger
+	receiveMaximum                   TwoByteInteger
+	maximumQoS                       ByteInteger
+	retainAvailable                  ByteInteger
+	maximumPacketSize                FourByteInteger
+	assignedClientIdentifier         UTF8String
+	topicAliasMaximum                TwoByteInteger
+	reasonString                     UTF8String
+	userProperties                   UserProperties
+	wildcardSubscriptionAvailable    ByteInteger
+	subscriptionIdentifiersAvailable ByteInteger
+	sharedSubscriptionAvailable      ByteInteger
+	serverKeepAlive                  TwoByteInteger
+	responseInformation              UTF8String
+	serverReference                  UTF8String
+	authenticationMethod             UTF8String
+	authenticationData               BinaryData
+}
+
+// set marks the property to be encoded, the value being already assigned.
+func (p *ConnackProperties) set(mProp MqttProperty) {
+	if p.fields == nil {
+		p.fields = make(map[MqttProperty]bool)
+	}
+	p.fields[mProp] = true
+}
+
+func (p *ConnackProperties) scope() propertyScope {
+	return scopeOf(CONNACK)
+}
+
+func (p *ConnackProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case SessionExpiryInterval:
+		return &p.sessionExpiryInterval
+	case ReceiveMaximum:
+		return &p.receiveMaximum
+	case MaximumQoS:
+		return &p.maximumQoS
+	case RetainAvailable:
+		return &p.retainAvailable
+	case MaximumPacketSize:
+		return &p.maximumPacketSize
+	case AssignedClientIdentifier:
+		return &p.assignedClientIdentifier
+	case TopicAliasMaximum:
+		return &p.topicAliasMaximum
+	case ReasonString:
+		return &p.reasonString
+	case UserProperty:
+		return &p.userProperties
+	case WildcardSubscriptionAvailable:
+		return &p.wildcardSubscriptionAvailable
+	case SubscriptionIdentifiersAvailable:
+		return &p.subscriptionIdentifiersAvailable
+	case SharedSubscriptionAvailable:
+		return &p.sharedSubscriptionAvailable
+	case ServerKeepAlive:
+		return &p.serverKeepAlive
+	case ResponseInformation:
+		return &p.responseInformation
+	case ServerReference:
+		return &p.serverReference
+	case AuthenticationMethod:
+		return &p.authenticationMethod
+	case AuthenticationData:
+		return &p.authenticationData
+	default:
+		return nil
+	}
+}
+
+func (p *ConnackProperties) decode(r *bytes.Buffer) error {
+	*p = ConnackProperties{
+		receiveMaximum:                   math.MaxUint16,
+		maximumQoS:                       true,
+		retainAvailable:                  true,
+		maximumPacketSize:                math.MaxUint32,
+		wildcardSubscriptionAvailable:    true,
+		subscriptionIdentifiersAvailable: true,
+		sharedSubscriptionAvailable:      true,
+	}
+	return decodeProperties(r, p)
+}
+
+// ConnackResponse answers a CONNECT, accepting the connection when its
+// reason code is Success.
+type ConnackResponse struct {
+	sessionPresent bool
+	reason         ReasonCode
+	prop           ConnackProperties
+}
+
+func (ack *ConnackResponse) Type() CType {
+	return CONNACK
+}
+
+func (ack *ConnackResponse) properties() propertySet {
+	return &ack.prop
+}
+
+func (ack *ConnackResponse) SessionPresent() bool {
+	return ack.sessionPresent
+}
+
+func (ack *ConnackResponse) Reason() ReasonCode {
+	return ack.reason
+}
+
+func (ack *ConnackResponse) AssignedClientIdentifier() string {
+	return string(ack.prop.assignedClientIdentifier)
+}
+
+// ServerKeepAlive returns the Keep Alive imposed by the server and whether
+// the server imposes one.
+func (ack *ConnackResponse) ServerKeepAlive() (time.Duration, bool) {
+	return time.Duration(ack.prop.serverKeepAlive) * time.Second, ack.prop.fields[ServerKeepAlive]
+}
+
+// MaximumPacketSize returns the size of the largest packet the server
+// accepts.
+func (ack *ConnackResponse) MaximumPacketSize() uint32 {
+	return uint32(ack.prop.maximumPacketSize)
+}
+
+// ReceiveMaximum returns the number of QoS 1 and QoS 2 messages the server
+// accepts in flight.
+func (ack *ConnackResponse) ReceiveMaximum() uint16 {
+	return uint16(ack.prop.receiveMaximum)
+}
+
+// TopicAliasMaximum returns the highest Topic Alias the server accepts.
+func (ack *ConnackResponse) TopicAliasMaximum() uint16 {
+	return uint16(ack.prop.topicAliasMaximum)
+}
+
+func (ack *ConnackResponse) RetainAvailable() bool {
+	return bool(ack.prop.retainAvailable)
+}
+
+func (ack *ConnackResponse) SharedSubscriptionAvailable() bool {
+	return bool(ack.prop.sharedSubscriptionAvailable)
+}
+
+func (ack *ConnackResponse) AuthenticationMethod() string {
+	return string(ack.prop.authenticationMethod)
+}
+
+func (ack *ConnackResponse) AuthenticationData() []byte {
+	return ack.prop.authenticationData
+}
+
+func (ack *ConnackResponse) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid connack fixed header flags.")
+	}
+
+	flag, err := r.ReadByte()
+	if err != nil || flag&0b11111110 != 0 {
+		return errors.New("Invalid connack acknowledge flags.")
+	}
+	rc, err := r.ReadByte()
+	if err != nil {
+		return errors.New("Missing connack reason code.")
+	}
+	*ack = ConnackResponse{sessionPresent: flag == 1, reason: ReasonCode(rc)}
+	if ack.sessionPresent && ack.reason != Success {
+		return errors.New("Session Present must be 0 when the connection is refused.")
+	}
+
+	return ack.prop.decode(r)
+}
+
+func (ack *ConnackResponse) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	if ack.sessionPresent && ack.reason == Success {
+		w.WriteByte(0b1)
+	} else {
+		w.WriteByte(0b0)
+	}
+	ack.reason.encode().WriteTo(w)
+
+	if err := writeProperties(w, &ack.prop); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (ack *ConnackResponse) WriteTo(w io.Writer) (int64, error) {
+	body, err := ack.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, CONNACK, Flag{}, body)
+}
+
+func (ack *ConnackResponse) Encode(w io.Writer) error {
+	_, err := ack.WriteTo(w)
+	return err
+}
+
+func (ack *ConnackResponse) Decode(r io.Reader) error {
+	return decodePacket(r, ack)
+}
+
+func (ack *ConnackResponse) ToString() string {
+	return fmt.Sprintf("packet: CONNACK, sessionPresent: %t, reason: %d", ack.sessionPresent, ack.reason)
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type DisconnectProperties struct {
+	PacketProperties
+	sessionExpiryInterval FourByteInteger
+	reasonString          UTF8String
+	userProperties        UserProperties
+	serverReference       UTF8String
+}
+
+func (p *DisconnectProperties) scope() propertyScope {
+	return scopeOf(DISCONNECT)
+}
+
+func (p *DisconnectProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case SessionExpiryInterval:
+		return &p.sessionExpiryInterval
+	case ReasonString:
+		return &p.reasonString
+	case UserProperty:
+		return &p.userProperties
+	case ServerReference:
+		return &p.serverReference
+	default:
+		return nil
+	}
+}
+
+func (p *DisconnectProperties) decode(r *bytes.Buffer) error {
+	*p = DisconnectProperties{}
+	return decodeProperties(r, p)
+}
+
+type DisconnectRequest struct {
+	reason ReasonCode
+	prop   DisconnectProperties
+}
+
+// NewDisconnect creates the DISCONNECT sent by the server before it closes
+// the connection. The reason string is omitted when empty.
+func NewDisconnect(rc ReasonCode, reasonString string) *DisconnectRequest {
+	req := &DisconnectRequest{reason: rc}
+	req.prop.fields = make(map[MqttProperty]bool)
+	if len(reasonString) > 0 {
+		req.prop.reasonString = UTF8String(reasonString)
+		req.prop.fields[ReasonString] = true
+	}
+	return req
+}
+
+func (req *DisconnectRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid disconnect fixed header flags.")
+	}
+
+	*req = DisconnectRequest{reason: NormalDisconnection}
+	if r.Len() == 0 {
+		return nil
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return errors.New("Missing disconnect reason code.")
+	}
+	req.reason = ReasonCode(b)
+
+	if r.Len() == 0 {
+		return nil
+	}
+
+	return req.prop.decode(r)
+}
+
+func (req *DisconnectRequest) Reason() ReasonCode {
+	return req.reason
+}
+
+// SessionExpiryInterval returns the updated Session Expiry Interval and
+// whether the client sent one.
+func (req *DisconnectRequest) SessionExpiryInterval() (time.Duration, bool) {
+	return time.Duration(req.prop.sessionExpiryInterval) * time.Second, req.prop.fields[SessionExpiryInterval]
+}
+
+func (req *DisconnectRequest) ReasonString() string {
+	return string(req.prop.reasonString)
+}
+
+func (req *DisconnectRequest) ToString() string {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteString(fmt.Sprintf("packet: DISCONNECT, "))
+	buf.WriteString(fmt.Sprintf("reason: %d, ", req.reason))
+	buf.WriteString(fmt.Sprintf("reasonString: %s", req.prop.reasonString))
+
+	return buf.String()
+}
+
+func (req *DisconnectRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	prop, err := encodeProperties(&req.prop)
+	if err != nil {
+		return nil, err
+	} else if req.reason == NormalDisconnection && prop.Len() == 0 {
+		return w, nil
+	}
+	req.reason.encode().WriteTo(w)
+	if err = VarByteInt(prop.Len()).Encode(w); err != nil {
+		return nil, err
+	}
+	prop.WriteTo(w)
+
+	return w, nil
+}
+
+func (req *DisconnectRequest) Type() CType {
+	return DISCONNECT
+}
+
+func (req *DisconnectRequest) properties() propertySet {
+	return &req.prop
+}
+
+func (req *DisconnectRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, DISCONNECT, Flag{}, body)
+}
+
+func (req *DisconnectRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *DisconnectRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
+}
+
+func (req *DisconnectRequest) ResponseTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import "errors"
+
+// ReasonError is an error that carries the reason code reported to the client
+// when the server closes the connection because of it.
+type ReasonError struct {
+	reason ReasonCode
+	msg    string
+}
+
+func NewReasonError(rc ReasonCode, msg string) *ReasonError {
+	return &ReasonError{reason: rc, msg: msg}
+}
+
+func (e *ReasonError) Error() string {
+	return e.msg
+}
+
+func (e *ReasonError) Reason() ReasonCode {
+	return e.reason
+}
+
+// ReasonOf returns the reason code carried by err, or fallback when err does
+// not carry one.
+func ReasonOf(err error, fallback ReasonCode) ReasonCode {
+	var rErr *ReasonError
+	if errors.As(err, &rErr) {
+		return rErr.reason
+	}
+	return fallback
+}
@@ -2,11 +2,12 @@ package protocol
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math"
+	"slices"
 	"time"
 )
 
@@ -36,6 +37,15 @@ const (
 	COUNT
 )
 
+var ctypeNames = [COUNT]string{"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP", "SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH"}
+
+func (t CType) String() string {
+	if t < COUNT {
+		return ctypeNames[t]
+	}
+	return fmt.Sprintf("CType(%d)", byte(t))
+}
+
 func (t CType) encode() *bytes.Buffer {
 	w := bytes.NewBuffer(make([]byte, 0))
 	w.WriteByte(byte(t << 4))
@@ -68,7 +78,7 @@ func (f Flag) encode() *bytes.Buffer {
 		b |= 0b1000
 	}
 	b |= byte(f.qos) << 1 & 0b0110
-	if f.dup {
+	if f.retain {
 		b |= 0b0001
 	}
 	w.WriteByte(b)
@@ -96,11 +106,15 @@ func (h MqttHeader) encode() *bytes.Buffer {
 	ctl, _ := h.ctl.encode().ReadByte()
 	flag, _ := h.flag.encode().ReadByte()
 	w.WriteByte(ctl | flag)
-	h.len.encode().WriteTo(w)
+	h.len.Encode(w)
 	return w
 }
 
 func ParseHeader(r *bytes.Buffer) (RequestHeader, error) {
+	return parseHeader(r)
+}
+
+func parseHeader(r *bytes.Buffer) (*MqttHeader, error) {
 	h := &MqttHeader{}
 
 	err := h.ctl.decode(r)
@@ -113,8 +127,8 @@ func ParseHeader(r *bytes.Buffer) (RequestHeader, error) {
 	}
 	r.Next(1)
 
-	if h.len.decode(r) != nil {
-		return nil, err
+	if err = h.len.Decode(r); err != nil {
+		return nil, errors.New("Malformed Fixed Header, err:" + err.Error())
 	}
 
 	return h, nil
@@ -124,15 +138,18 @@ func (p *MqttHeader) BodyLength() int {
 	return int(p.len)
 }
 
+// ParseBody parses the body of a packet a client sends to the server. Packets
+// only sent by the server fail with Protocol Error.
 func (p *MqttHeader) ParseBody(r *bytes.Buffer) (Request, error) {
-	switch p.ctl {
-	case CONNECT:
-		return ParseConnect(p, r)
-	case PUBLISH:
-		return ParsePublish(p, r)
-	default:
-		return nil, errors.New("Unsupported MQTT packet control")
+	pkt, err := newPacket(p.ctl)
+	req, ok := pkt.(Request)
+	if err != nil || !ok {
+		return nil, NewReasonError(ProtocolError, "Unsupported MQTT packet control")
 	}
+	if err = decodeBody(pkt, p, r); err != nil {
+		return nil, err
+	}
+	return req, nil
 }
 
 type ConnectFlag byte
@@ -146,7 +163,7 @@ const (
 )
 
 func (qos QoS) maxQos() QoS {
-	return QoS0
+	return QoS2
 }
 
 func (qos QoS) isSupported() bool {
@@ -157,13 +174,13 @@ func (f ConnectFlag) username() bool {
 	return byte(f)&0b10000000 != 0
 }
 func (f ConnectFlag) password() bool {
-	return byte(f)&0b00100000 != 0
+	return byte(f)&0b01000000 != 0
 }
 func (f ConnectFlag) retain() bool {
-	return byte(f)&0b00010000 != 0
+	return byte(f)&0b00100000 != 0
 }
 func (f ConnectFlag) qos() QoS {
-	return QoS(byte(f) & 0b00011000)
+	return QoS(byte(f) & 0b00011000 >> 3)
 }
 func (f ConnectFlag) will() bool {
 	return byte(f)&0b00000100 != 0
@@ -182,8 +199,10 @@ func (f ConnectFlag) valid() error {
 		return errors.New("Reserved flag must be 0.")
 	} else if f.qos() >= QoS3 {
 		return errors.New("Invalid QoS")
-	} else if f.will() && f.qos() != QoS0 {
-		return errors.New("Invalid QoS while will flag is set.")
+	} else if !f.will() && f.qos() != QoS0 {
+		return errors.New("Will QoS must be 0 while will flag is not set.")
+	} else if !f.will() && f.retain() {
+		return errors.New("Will retain must be 0 while will flag is not set.")
 	}
 	return nil
 }
@@ -228,163 +247,101 @@ func (p MqttProperty) encode() *bytes.Buffer {
 
 type ConnectProperties struct {
 	PacketProperties
-	sessionExpiryInterval time.Duration
+	sessionExpiryInterval FourByteInteger
 	receiveMaximum        TwoByteInteger
 	maximumPacketSize     FourByteInteger
 	topicAliasMaximum     TwoByteInteger
 	requestResponseInfo   ByteInteger
 	requestProblemInfo    ByteInteger
-	userProperty          UTF8StringPair
+	userProperties        UserProperties
 	authenticationMethod  UTF8String
 	authenticationData    BinaryData
 }
 
+func (p *ConnectProperties) scope() propertyScope {
+	return scopeOf(CONNECT)
+}
+
+func (p *ConnectProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case SessionExpiryInterval:
+		return &p.sessionExpiryInterval
+	case ReceiveMaximum:
+		return &p.receiveMaximum
+	case MaximumPacketSize:
+		return &p.maximumPacketSize
+	case TopicAliasMaximum:
+		return &p.topicAliasMaximum
+	case RequestResponseInformation:
+		return &p.requestResponseInfo
+	case RequestProblemInformation:
+		return &p.requestProblemInfo
+	case UserProperty:
+		return &p.userProperties
+	case AuthenticationMethod:
+		return &p.authenticationMethod
+	case AuthenticationData:
+		return &p.authenticationData
+	default:
+		return nil
+	}
+}
+
 func (p *ConnectProperties) decode(r *bytes.Buffer) error {
-	p.fields = make(map[MqttProperty]bool)
-	p.sessionExpiryInterval = 0
-	p.receiveMaximum = math.MaxUint16
-	p.maximumPacketSize = math.MaxUint32
-	p.topicAliasMaximum = 0
-	p.requestResponseInfo = false
-	p.requestProblemInfo = true
-
-	var propLen VarByteInt
-	err := propLen.decode(r)
-	if err != nil {
+	*p = ConnectProperties{
+		receiveMaximum:     math.MaxUint16,
+		maximumPacketSize:  math.MaxUint32,
+		requestProblemInfo: true,
+	}
+	if err := decodeProperties(r, p); err != nil {
 		return err
-	} else if r.Len() < int(propLen) {
-		return errors.New("Invalid Conenct Property Length.")
-	} else if propLen == 0 {
-		return nil
 	}
 
-	remain := r.Len()
-	for remain-r.Len() < int(propLen) {
-		b, err := r.ReadByte()
-		if err != nil {
-			return err
-		}
-		mProp := MqttProperty(b)
-		if p.fields[mProp] {
-			return errors.New("Duplicate connect property")
-		}
-		p.fields[mProp] = true
-
-		switch mProp {
-		case SessionExpiryInterval:
-			var d FourByteInteger
-			if err = d.decode(r); err != nil {
-				return errors.New("Invalid Session Expiry Interval, err:" + err.Error())
-			}
-			p.sessionExpiryInterval = time.Duration(d) * time.Second
-		case ReceiveMaximum:
-			if err = p.receiveMaximum.decode(r); err != nil {
-				return errors.New("Invalid Receive Maximum, err:" + err.Error())
-			}
-		case MaximumPacketSize:
-			if err = p.maximumPacketSize.decode(r); err != nil {
-				return errors.New("Invalid Maximum Packet Size, err:" + err.Error())
-			}
-		case TopicAliasMaximum:
-			if err = p.topicAliasMaximum.decode(r); err != nil {
-				return errors.New("Invalid Topic Alias Maximum")
-			}
-		case RequestResponseInformation:
-			if err = p.requestProblemInfo.decode(r); err != nil {
-				return errors.New("Invalid Request Response Information, err:" + err.Error())
-			}
-		case RequestProblemInformation:
-			if err = p.requestProblemInfo.decode(r); err != nil {
-				return errors.New("Invalid Request Problem Information, err:" + err.Error())
-			}
-		case UserProperty:
-			if err = p.userProperty.decode(r); err != nil {
-				return errors.New("Invalid User Property, err:" + err.Error())
-			}
-		case AuthenticationMethod:
-			if err = p.authenticationMethod.decode(r); err != nil {
-				return errors.New("Invalid Authentication Method" + err.Error())
-			}
-		case AuthenticationData:
-			if err = p.authenticationData.decode(r); err != nil {
-				return errors.New("Invalid Authentication Data" + err.Error())
-			}
-		default:
-			return errors.New("Unknown connect packet property")
-		}
+	if p.fields[AuthenticationData] && !p.fields[AuthenticationMethod] {
+		return NewReasonError(ProtocolError, "Authentication Data without Authentication Method.")
 	}
 	return nil
 }
 
 type WillProperties struct {
-	delayInterval          time.Duration
+	PacketProperties
+	delayInterval          FourByteInteger
 	payloadFormatIndicator ByteInteger
-	messageExpiryInterval  time.Duration
+	messageExpiryInterval  FourByteInteger
 	contentType            UTF8String
 	responseTopic          UTF8String
 	correlationData        BinaryData
-	userProperty           UTF8StringPair
+	userProperties         UserProperties
 }
 
-func (p *WillProperties) decode(r *bytes.Buffer) error {
-	p.delayInterval = 0
-	p.payloadFormatIndicator = false
+func (p *WillProperties) scope() propertyScope {
+	return willScope
+}
 
-	var propLen VarByteInt
-	err := propLen.decode(r)
-	if err != nil {
-		return errors.New("Unable to decode will property length.")
-	} else if r.Len() < int(propLen) {
-		return errors.New("Invalid Will Properties Length.")
-	} else if propLen == 0 {
+func (p *WillProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case WillDelayInterval:
+		return &p.delayInterval
+	case PayloadFormatIndicator:
+		return &p.payloadFormatIndicator
+	case MessageExpiryInterval:
+		return &p.messageExpiryInterval
+	case ContentType:
+		return &p.contentType
+	case ResponseTopic:
+		return &p.responseTopic
+	case CorrelationData:
+		return &p.correlationData
+	case UserProperty:
+		return &p.userProperties
+	default:
 		return nil
 	}
+}
 
-	remain := r.Len()
-	for remain-r.Len() < int(propLen) {
-		b, err := r.ReadByte()
-		if err != nil {
-			return err
-		}
-		mProp := MqttProperty(b)
-		switch mProp {
-		case WillDelayInterval:
-			var d FourByteInteger
-			if err = d.decode(r); err != nil {
-				return errors.New("Invalid Will Delay Interval, err:" + err.Error())
-			}
-			p.delayInterval = time.Duration(d) * time.Second
-		case PayloadFormatIndicator:
-			if err = p.payloadFormatIndicator.decode(r); err != nil {
-				return errors.New("Invalid Payload Format Indicator, err:" + err.Error())
-			}
-		case MessageExpiryInterval:
-			var d FourByteInteger
-			if err = d.decode(r); err != nil {
-				return errors.New("Invalid Will Message Expiration Interval, err:" + err.Error())
-			}
-			p.messageExpiryInterval = time.Duration(d) * time.Second
-		case ContentType:
-			if err = p.contentType.decode(r); err != nil {
-				return errors.New("Invalid Will Content Type, err:" + err.Error())
-			}
-		case ResponseTopic:
-			if err = p.responseTopic.decode(r); err != nil {
-				return errors.New("Invalid Response Topic, err:" + err.Error())
-			}
-		case CorrelationData:
-			if err = p.correlationData.decode(r); err != nil {
-				return errors.New("Invalid Correlation Data, err:" + err.Error())
-			}
-		case UserProperty:
-			if err = p.userProperty.decode(r); err != nil {
-				return errors.New("Invalid User Property, err:" + err.Error())
-			}
-		default:
-			return errors.New("Unknown connect will property")
-		}
-	}
-	return nil
+func (p *WillProperties) decode(r *bytes.Buffer) error {
+	*p = WillProperties{}
+	return decodeProperties(r, p)
 }
 
 type ConnectPayload struct {
@@ -397,7 +354,7 @@ type ConnectPayload struct {
 }
 
 func (pl *ConnectPayload) decode(f *ConnectFlag, r *bytes.Buffer) error {
-	if err := pl.clientIdentifier.decode(r); err != nil {
+	if err := pl.clientIdentifier.Decode(r); err != nil {
 		return err
 	}
 
@@ -406,24 +363,53 @@ func (pl *ConnectPayload) decode(f *ConnectFlag, r *bytes.Buffer) error {
 			return err
 		}
 
-		if err := pl.willTopic.decode(r); err != nil {
+		if err := pl.willTopic.Decode(r); err != nil {
 			return err
+		} else if err := ValidTopicName(string(pl.willTopic)); err != nil {
+			return errors.New("Invalid will topic, err:" + err.Error())
 		}
 
-		if err := pl.willPayload.decode(r); err != nil {
+		if err := pl.willPayload.Decode(r); err != nil {
 			return err
 		}
 	}
 
 	if f.username() {
-		if err := pl.username.decode(r); err != nil {
+		if err := pl.username.Decode(r); err != nil {
 			return err
 		}
 	}
 
 	if f.password() {
-		if err := pl.password.decode(r); err != nil {
+		if err := pl.password.Decode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pl *ConnectPayload) encode(w *bytes.Buffer, f ConnectFlag) error {
+	if err := pl.clientIdentifier.Encode(w); err != nil {
+		return errors.New("Unable to encode Client Identifier, err:" + err.Error())
+	}
+	if f.will() {
+		if err := writeProperties(w, &pl.willProperties); err != nil {
 			return err
+		} else if err = pl.willTopic.Encode(w); err != nil {
+			return errors.New("Unable to encode Will Topic, err:" + err.Error())
+		} else if err = pl.willPayload.Encode(w); err != nil {
+			return errors.New("Unable to encode Will Payload, err:" + err.Error())
+		}
+	}
+	if f.username() {
+		if err := pl.username.Encode(w); err != nil {
+			return errors.New("Unable to encode User Name, err:" + err.Error())
+		}
+	}
+	if f.password() {
+		if err := pl.password.Encode(w); err != nil {
+			return errors.New("Unable to encode Password, err:" + err.Error())
 		}
 	}
 
@@ -431,80 +417,149 @@ func (pl *ConnectPayload) decode(f *ConnectFlag, r *bytes.Buffer) error {
 }
 
 type ConnectRequest struct {
-	flag      ConnectFlag
-	keepAlive time.Duration
-	prop      ConnectProperties
-	payload   ConnectPayload
+	flag           ConnectFlag
+	keepAlive      time.Duration
+	prop           ConnectProperties
+	payload        ConnectPayload
+	sessionPresent bool
+	reason         ReasonCode
+	ack            ConnackProperties
 }
 
-func ParseConnect(p *MqttHeader, r *bytes.Buffer) (Request, error) {
-	var b []byte
+// NewConnect creates the CONNECT of a client.
+func NewConnect(clientId string, cleanStart bool, keepAlive time.Duration) *ConnectRequest {
+	req := &ConnectRequest{keepAlive: keepAlive}
+	req.prop.fields = make(map[MqttProperty]bool)
+	req.prop.receiveMaximum = math.MaxUint16
+	req.prop.maximumPacketSize = math.MaxUint32
+	req.prop.requestProblemInfo = true
+	req.payload.clientIdentifier = UTF8String(clientId)
+	if cleanStart {
+		req.flag |= 0b00000010
+	}
+	return req
+}
+
+var protocolName = []byte{0, 4, 'M', 'Q', 'T', 'T'}
+
+const protocolVersion = 5
 
-	name := []byte{0, 4, 'M', 'Q', 'T', 'T'}
-	b = make([]byte, len(name))
-	if _, err := r.Read(b); err != nil || !bytes.Equal(name, b) {
-		return nil, errors.New("Unsupported protocol!")
+func (req *ConnectRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid connect fixed header flags.")
 	}
+	*req = ConnectRequest{}
 
-	ver := []byte{5}
-	b = make([]byte, len(ver))
-	if _, err := r.Read(b); err != nil || !bytes.Equal(ver, b) {
-		return nil, errors.New("Unsupported protocol!")
+	if b, err := next(r, len(protocolName)); err != nil || !bytes.Equal(protocolName, b) {
+		return errors.New("Unsupported protocol!")
+	}
+	if b, err := r.ReadByte(); err != nil || b != protocolVersion {
+		return errors.New("Unsupported protocol!")
 	}
 
-	b = make([]byte, 1)
-	if _, err := r.Read(b); err != nil {
-		return nil, errors.New("Missing flag value.")
+	b, err := r.ReadByte()
+	if err != nil {
+		return errors.New("Missing flag value.")
 	}
-	flag := ConnectFlag(b[0])
-	if err := flag.valid(); err != nil {
-		return nil, err
+	req.flag = ConnectFlag(b)
+	if err := req.flag.valid(); err != nil {
+		return err
 	}
 
-	b = make([]byte, 2)
-	if _, err := r.Read(b); err != nil {
-		return nil, errors.New("Missing keep alive value.")
+	var keepAlive TwoByteInteger
+	if err := keepAlive.Decode(r); err != nil {
+		return errors.New("Missing keep alive value.")
 	}
-	keepAlive := time.Duration(binary.BigEndian.Uint16(b)) * time.Second
+	req.keepAlive = time.Duration(keepAlive) * time.Second
 
-	var prop ConnectProperties
-	if err := prop.decode(r); err != nil {
-		return nil, err
+	if err := req.prop.decode(r); err != nil {
+		return err
 	}
+	return req.payload.decode(&req.flag, r)
+}
+
+func (req *ConnectRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	w.Write(protocolName)
+	w.WriteByte(protocolVersion)
+	w.WriteByte(byte(req.flag))
+	TwoByteInteger(req.keepAlive / time.Second).Encode(w)
 
-	var pl ConnectPayload
-	if err := pl.decode(&flag, r); err != nil {
+	if err := writeProperties(w, &req.prop); err != nil {
 		return nil, err
+	} else if err = req.payload.encode(w, req.flag); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (req *ConnectRequest) Type() CType {
+	return CONNECT
+}
+
+func (req *ConnectRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
 	}
+	return writePacket(w, CONNECT, Flag{}, body)
+}
 
-	return &ConnectRequest{flag: flag, keepAlive: keepAlive, prop: prop, payload: pl}, nil
+func (req *ConnectRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *ConnectRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
 }
 
 type ReasonCode byte
 
 const (
-	Success                    ReasonCode = 0
-	Unspecified                           = 0x80
-	MalformedPacket                       = 0x81
-	ProtocolError                         = 0x82
-	ImplementationSpecific                = 0x83
-	UnsupportedProtocolVersion            = 0x84
-	InvalidClientIdentifier               = 0x85
-	BadUsernamePassword                   = 0x86
-	NotAuthorized                         = 0x87
-	ServerUnavailable                     = 0x88
-	ServerBusy                            = 0x89
-	Banned                                = 0x8A
-	BadAuthenticationMethod               = 0x8C
-	InvalidTopicName                      = 0x90
-	PacketTooLarge                        = 0x95
-	ExceedQuota                           = 0x97
-	InvalidPayloadFormat                  = 0x99
-	RetainNotSupported                    = 0x9A
-	QoSNotSupported                       = 0x9B
-	UseAnotherServer                      = 0x9C
-	ServerMoved                           = 0x9D
-	ExceededConnectionRate                = 0x9F
+	Success                             ReasonCode = 0
+	GrantedQoS0                                    = 0x00
+	GrantedQoS1                                    = 0x01
+	GrantedQoS2                                    = 0x02
+	NormalDisconnection                            = 0x00
+	DisconnectWithWillMessage                      = 0x04
+	NoMatchingSubscribers                          = 0x10
+	NoSubscriptionExisted                          = 0x11
+	ContinueAuthentication                         = 0x18
+	ReAuthenticate                                 = 0x19
+	Unspecified                                    = 0x80
+	MalformedPacket                                = 0x81
+	ProtocolError                                  = 0x82
+	ImplementationSpecific                         = 0x83
+	UnsupportedProtocolVersion                     = 0x84
+	InvalidClientIdentifier                        = 0x85
+	BadUsernamePassword                            = 0x86
+	NotAuthorized                                  = 0x87
+	ServerUnavailable                              = 0x88
+	ServerBusy                                     = 0x89
+	Banned                                         = 0x8A
+	ServerShuttingDown                             = 0x8B
+	BadAuthenticationMethod                        = 0x8C
+	KeepAliveTimeout                               = 0x8D
+	SessionTakenOver                               = 0x8E
+	TopicFilterInvalid                             = 0x8F
+	InvalidTopicName                               = 0x90
+	PacketIdentifierInUse                          = 0x91
+	PacketIdentifierNotFound                       = 0x92
+	ReceiveMaximumExceeded                         = 0x93
+	TopicAliasInvalid                              = 0x94
+	PacketTooLarge                                 = 0x95
+	ExceedQuota                                    = 0x97
+	InvalidPayloadFormat                           = 0x99
+	RetainNotSupported                             = 0x9A
+	QoSNotSupported                                = 0x9B
+	UseAnotherServer                               = 0x9C
+	ServerMoved                                    = 0x9D
+	SharedSubscriptionsNotSupported                = 0x9E
+	ExceededConnectionRate                         = 0x9F
+	SubscriptionIdentifiersNotSupported            = 0xA1
+	WildcardSubscriptionsNotSupported              = 0xA2
 )
 
 func (p ReasonCode) encode() *bytes.Buffer {
@@ -513,117 +568,210 @@ func (p ReasonCode) encode() *bytes.Buffer {
 	return w
 }
 
-type ConnackProperties struct {
-	sessionExpiryInterval           time.Duration
-	receiveMaximum                  TwoByteInteger
-	maximumQoS                      QoS
-	retainAvailable                 ByteInteger
-	maximumPacketSize               FourByteInteger
-	assignedClientIdentifier        UTF8String
-	topicAliasMinimum               TwoByteInteger
-	reasonString                    UTF8String
-	userProperty                    UTF8StringPair
-	wildcardSubscriptionAvailable   ByteInteger
-	subscriptionIdentifiersAvaiable ByteInteger
-	sharedSubscriptionAvaiable      ByteInteger
-	serverKeepAlive                 TwoByteInteger
-	responseInformation             UTF8String
-	serverReference                 UTF8String
-	authenticationMethod            UTF8String
-	authenticationData              BinaryData
-}
+// Connack returns the CONNACK answering the CONNECT, refusing it with the
+// reason code given to Refuse or when the Will requires unavailable features.
+func (req *ConnectRequest) Connack() *ConnackResponse {
+	ack := &ConnackResponse{sessionPresent: req.sessionPresent, reason: req.reason}
+	if ack.reason != Success {
+		// The connection is refused, only the reason code is relevant.
+		ack.sessionPresent = false
+		return ack
+	}
 
-func (p *ConnackProperties) encode(flag *ConnectFlag, prop *ConnectProperties) (w *bytes.Buffer, rc ReasonCode) {
-	rc = Success
-	w = bytes.NewBuffer(make([]byte, 0))
+	ack.prop = req.ack
+	ack.prop.fields = maps.Clone(req.ack.fields)
+	ack.prop.set(RetainAvailable)
+	ack.prop.set(SharedSubscriptionAvailable)
+	// Wildcards are always supported, subscription identifiers are not.
+	ack.prop.wildcardSubscriptionAvailable = true
+	ack.prop.set(WildcardSubscriptionAvailable)
+	ack.prop.subscriptionIdentifiersAvailable = false
+	ack.prop.set(SubscriptionIdentifiersAvailable)
+
+	if req.flag.retain() && !bool(req.ack.retainAvailable) {
+		ack.reason, ack.sessionPresent = RetainNotSupported, false
+	}
+	return ack
+}
 
-	// TODO: Session Expiry Interval
+func (req *ConnectRequest) ClientIdentifier() string {
+	return string(req.payload.clientIdentifier)
+}
 
-	// TODO: Received Maximum
+func (req *ConnectRequest) AssignClientIdentifier(clientId string) {
+	req.payload.clientIdentifier = UTF8String(clientId)
+	req.ack.assignedClientIdentifier = UTF8String(clientId)
+	req.ack.set(AssignedClientIdentifier)
+}
 
-	if !flag.qos().isSupported() {
-		MqttProperty(MaximumQoS).encode().WriteTo(w)
-		ByteInteger(flag.qos().maxQos() >= QoS1).encode().WriteTo(w)
+// Username returns the User Name of the CONNECT and whether it was set.
+func (req *ConnectRequest) Username() (string, bool) {
+	return string(req.payload.username), req.flag.username()
+}
 
-		rc = QoSNotSupported
-		return
-	}
+// SetUsername replaces the User Name when the server identifies the client
+// by other means.
+func (req *ConnectRequest) SetUsername(username string) {
+	req.payload.username = UTF8String(username)
+	req.flag |= 0b10000000
+}
 
-	// WARNING: Should get retail available from server configuration
-	if true {
-		MqttProperty(RetainAvailable).encode().WriteTo(w)
-		ByteInteger(false).encode().WriteTo(w)
+func (req *ConnectRequest) Password() []byte {
+	return req.payload.password
+}
 
-		if flag.retain() {
-			rc = RetainNotSupported
-			return
-		}
-	}
+func (req *ConnectRequest) SetPassword(password []byte) {
+	req.payload.password = BinaryData(password)
+	req.flag |= 0b01000000
+}
 
-	// TODO: Maximum Packet Size
+func (req *ConnectRequest) CleanStart() bool {
+	return req.flag.cleanstart()
+}
 
-	// TODO: Assigned Client Identifier
+func (req *ConnectRequest) SessionExpiryInterval() time.Duration {
+	return time.Duration(req.prop.sessionExpiryInterval) * time.Second
+}
 
-	// TODO: Topic Alias Maximum
+// MaximumPacketSize returns the size of the largest packet the client
+// accepts.
+func (req *ConnectRequest) MaximumPacketSize() uint32 {
+	return uint32(req.prop.maximumPacketSize)
+}
 
-	// TODO: Reason String
+// SetMaximumPacketSize tells the client the size of the largest packet the
+// server accepts, which is unlimited unless set.
+func (req *ConnectRequest) SetMaximumPacketSize(max uint32) {
+	req.ack.maximumPacketSize = FourByteInteger(max)
+	if max > 0 {
+		req.ack.set(MaximumPacketSize)
+	}
+}
 
-	// TODO: User Property
+// ReceiveMaximum returns the number of QoS 1 and QoS 2 messages the client
+// accepts in flight.
+func (req *ConnectRequest) ReceiveMaximum() uint16 {
+	return uint16(req.prop.receiveMaximum)
+}
 
-	// WARNING: Should get wildcard subscription available from server configuration
-	if true {
-		MqttProperty(WildcardSubscriptionAvailable).encode().WriteTo(w)
-		ByteInteger(false).encode().WriteTo(w)
+// SetReceiveMaximum tells the client the number of QoS 1 and QoS 2 messages
+// the server accepts in flight, which is 65535 unless set.
+func (req *ConnectRequest) SetReceiveMaximum(max uint16) {
+	req.ack.receiveMaximum = TwoByteInteger(max)
+	if max > 0 {
+		req.ack.set(ReceiveMaximum)
 	}
+}
+
+// TopicAliasMaximum returns the highest Topic Alias the client accepts, no
+// alias being accepted when it is 0.
+func (req *ConnectRequest) TopicAliasMaximum() uint16 {
+	return uint16(req.prop.topicAliasMaximum)
+}
 
-	// WARNING: Should get wildcard subscription available from server configuration
-	if true {
-		MqttProperty(SubscriptionIdentifiersAvailable).encode().WriteTo(w)
-		ByteInteger(false).encode().WriteTo(w)
+// SetTopicAliasMaximum tells the client the highest Topic Alias the server
+// accepts.
+func (req *ConnectRequest) SetTopicAliasMaximum(max uint16) {
+	req.ack.topicAliasMaximum = TwoByteInteger(max)
+	if max > 0 {
+		req.ack.set(TopicAliasMaximum)
 	}
+}
+
+// UserProperties returns the User Properties of the CONNECT, which tell
+// about the client rather than any message.
+func (req *ConnectRequest) UserProperties() UserProperties {
+	return req.prop.userProperties
+}
 
-	// WARNING: Should get wildcard subscription available from server configuration
-	if true {
-		MqttProperty(SharedSubscriptionAvailable).encode().WriteTo(w)
-		ByteInteger(false).encode().WriteTo(w)
+func (req *ConnectRequest) AddUserProperty(key string, value string) {
+	req.prop.userProperties = append(req.prop.userProperties, NewUTF8StringPair(key, value))
+	req.prop.fields[UserProperty] = true
+}
+
+// Will returns the Will Message as an application message, or nil when the
+// Will Flag is not set.
+func (req *ConnectRequest) Will() *PublishRequest {
+	if !req.flag.will() {
+		return nil
 	}
 
-	// TODO: Keep Alive
+	wp := &req.payload.willProperties
+	will := &PublishRequest{
+		flag:  Flag{qos: req.flag.qos(), retain: req.flag.retain()},
+		topic: req.payload.willTopic,
+		pl:    req.payload.willPayload,
+	}
 
-	// TODO: Response Information
+	prop := &will.prop
+	prop.fields = make(map[MqttProperty]bool)
+	for mProp := range wp.fields {
+		prop.fields[mProp] = mProp != WillDelayInterval
+	}
+	prop.payloadFormatIndicator = wp.payloadFormatIndicator
+	prop.messageExpiryInterval = wp.messageExpiryInterval
+	prop.contentType = wp.contentType
+	prop.responseTopic = wp.responseTopic
+	prop.correlationData = wp.correlationData
+	prop.userProperties = slices.Clone(wp.userProperties)
+
+	return will
+}
 
-	// TODO: Server Reference
+func (req *ConnectRequest) WillDelayInterval() time.Duration {
+	return time.Duration(req.payload.willProperties.delayInterval) * time.Second
+}
 
-	// TODO: Authentication Method
+func (req *ConnectRequest) SetSessionPresent(present bool) {
+	req.sessionPresent = present
+}
 
-	// TODO: Authentication Data
+func (req *ConnectRequest) SetRetainAvailable(available bool) {
+	req.ack.retainAvailable = ByteInteger(available)
+}
 
-	return
+func (req *ConnectRequest) SetSharedSubscriptionAvailable(available bool) {
+	req.ack.sharedSubscriptionAvailable = ByteInteger(available)
 }
 
-func (r *ConnectRequest) Response() (w *bytes.Buffer, err error) {
-	w = bytes.NewBuffer(make([]byte, 0))
+// KeepAlive returns the Keep Alive that applies to the connection, which is
+// the Server Keep Alive when the server overrides the value of the client.
+func (req *ConnectRequest) KeepAlive() time.Duration {
+	if req.ack.serverKeepAlive > 0 {
+		return time.Duration(req.ack.serverKeepAlive) * time.Second
+	}
+	return req.keepAlive
+}
 
-	ackFlag := make([]byte, 1)
-	if !r.flag.cleanstart() == false /*&& hasSession(r.payload.clientIdentifier)*/ {
-		ackFlag[0] = 0b1
+func (req *ConnectRequest) SetServerKeepAlive(keepAlive time.Duration) {
+	req.ack.serverKeepAlive = TwoByteInteger(keepAlive / time.Second)
+	if req.ack.serverKeepAlive > 0 {
+		req.ack.set(ServerKeepAlive)
 	}
-	w.Write(ackFlag)
+}
 
-	var prop ConnackProperties
-	buf, rc := prop.encode(&r.flag, &r.prop)
-	rc.encode().WriteTo(w)
+func (req *ConnectRequest) AuthenticationMethod() string {
+	return string(req.prop.authenticationMethod)
+}
 
-	blen := VarByteInt(buf.Len())
-	blen.encode().WriteTo(w)
-	buf.WriteTo(w)
+func (req *ConnectRequest) AuthenticationData() []byte {
+	return req.prop.authenticationData
+}
 
-	if rc != Success {
-		err = errors.New("Unsupported Connect Propeties")
-		return
+// SetAuthenticationData sets the final data of the enhanced authentication
+// exchange returned in the CONNACK along with its method.
+func (req *ConnectRequest) SetAuthenticationData(data []byte) {
+	req.ack.authenticationMethod = req.prop.authenticationMethod
+	req.ack.set(AuthenticationMethod)
+	if len(data) > 0 {
+		req.ack.authenticationData = BinaryData(data)
+		req.ack.set(AuthenticationData)
 	}
+}
 
-	return
+// Refuse makes the CONNACK refuse the connection with the reason code.
+func (req *ConnectRequest) Refuse(rc ReasonCode) {
+	req.reason = rc
 }
 
 func (req *ConnectRequest) ToString() string {
@@ -636,142 +784,307 @@ func (req *ConnectRequest) ToString() string {
 	return buf.String()
 }
 
-func (r *ConnectRequest) ResponseTo(w io.Writer) (int64, error) {
-	wBytes := int64(0)
-
-	body, err := r.Response()
-	if err != nil {
-		return 0, err
-	}
-	header := MqttHeader{ctl: CONNACK, flag: Flag{}, len: VarByteInt(body.Len())}
-
-	n, err := header.encode().WriteTo(w)
+func (req *ConnectRequest) ResponseTo(w io.Writer) (int64, error) {
+	// A CONNACK refusing the connection is still sent before the error is
+	// returned so that the client learns the reason.
+	ack := req.Connack()
+	n, err := ack.WriteTo(w)
 	if err != nil {
-		return 0, err
-	}
-	wBytes += n
-
-	n, err = body.WriteTo(w)
-	if err != nil {
-		return 0, err
+		return n, err
+	} else if ack.reason != Success {
+		return n, NewReasonError(ack.reason, "Connection refused")
 	}
-	wBytes += n
-
-	return int64(wBytes), nil
+	return n, nil
 }
 
 type PublishRequest struct {
+	flag     Flag
 	topic    UTF8String
 	packetId TwoByteInteger
 	prop     PublishProperties
 	pl       []byte
+	reason   ReasonCode
+	// expiry is when the Message Expiry Interval elapses, counted from the
+	// time the server received the message. It is zero when the message does
+	// not expire.
+	expiry time.Time
 }
 
 type PublishProperties struct {
 	PacketProperties
 	payloadFormatIndicator ByteInteger
-	messageExpiryInterval  time.Duration
+	messageExpiryInterval  FourByteInteger
 	topicAlias             TwoByteInteger
 	responseTopic          UTF8String
 	correlationData        BinaryData
-	userProperty           UTF8StringPair
+	userProperties         UserProperties
 	subscriptionIdentifier VarByteInt
 	contentType            UTF8String
 }
 
-func (p *PublishProperties) decode(r *bytes.Buffer) error {
-	p.fields = make(map[MqttProperty]bool)
-	p.payloadFormatIndicator = false
+func (p *PublishProperties) scope() propertyScope {
+	return scopeOf(PUBLISH)
+}
 
-	var propLen VarByteInt
-	err := propLen.decode(r)
-	if err != nil {
-		return errors.New("Unable to decode publish property length.")
-	} else if r.Len() < int(propLen) {
-		return errors.New("Publish property must match set length.")
-	} else if propLen == 0 {
+func (p *PublishProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case PayloadFormatIndicator:
+		return &p.payloadFormatIndicator
+	case MessageExpiryInterval:
+		return &p.messageExpiryInterval
+	case TopicAlias:
+		return &p.topicAlias
+	case ResponseTopic:
+		return &p.responseTopic
+	case CorrelationData:
+		return &p.correlationData
+	case UserProperty:
+		return &p.userProperties
+	case SubscriptionIdentifier:
+		return &p.subscriptionIdentifier
+	case ContentType:
+		return &p.contentType
+	default:
 		return nil
 	}
+}
+
+func (p *PublishProperties) decode(r *bytes.Buffer) error {
+	*p = PublishProperties{}
+	return decodeProperties(r, p)
+}
+
+// NewPublish creates an application message. The packet identifier of QoS 1
+// and 2 messages is set with SetPacketId.
+func NewPublish(topic string, payload []byte, qos QoS, retain bool) *PublishRequest {
+	req := &PublishRequest{flag: Flag{qos: qos, retain: retain}, topic: UTF8String(topic), pl: payload}
+	req.prop.fields = make(map[MqttProperty]bool)
+	return req
+}
+
+func (req *PublishRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	*req = PublishRequest{flag: h.flag}
+
+	if req.flag.qos >= QoS3 {
+		return errors.New("Invalid publish QoS.")
+	} else if !req.flag.qos.isSupported() {
+		return NewReasonError(QoSNotSupported, "Unsupported publish QoS.")
+	} else if req.flag.qos == QoS0 && req.flag.dup {
+		return errors.New("DUP flag must be 0 for QoS 0 message.")
+	}
 
-	remain := r.Len()
-	for remain-r.Len() < int(propLen) {
-		b, err := r.ReadByte()
-		if err != nil {
+	if err := req.topic.Decode(r); err != nil {
+		return errors.New("Unable to parse public topic name, err:" + err.Error())
+	}
+
+	if h.flag.qos > QoS0 {
+		if err := req.packetId.Decode(r); err != nil {
 			return err
+		} else if req.packetId == 0 {
+			return errors.New("Publish packet identifier must not be 0.")
 		}
-		mProp := MqttProperty(b)
-		if p.fields[mProp] {
-			return errors.New("Duplicate connect property")
-		}
-		p.fields[mProp] = true
-
-		switch mProp {
-		case PayloadFormatIndicator:
-			if err = p.payloadFormatIndicator.decode(r); err != nil {
-				return errors.New("Invalid Payload Format Indicator, err:" + err.Error())
-			}
-		case MessageExpiryInterval:
-			var d FourByteInteger
-			if err = d.decode(r); err != nil {
-				return errors.New("Invalid Will Message Expiration Interval, err:" + err.Error())
-			}
-			p.messageExpiryInterval = time.Duration(d) * time.Second
-		case TopicAlias:
-			if err = p.topicAlias.decode(r); err != nil {
-				return errors.New("Invalid Topic Alias, err:" + err.Error())
-			}
-		case ResponseTopic:
-			if err = p.responseTopic.decode(r); err != nil {
-				return errors.New("Invalid Response Topic, err:" + err.Error())
-			}
-		case CorrelationData:
-			if err = p.correlationData.decode(r); err != nil {
-				return errors.New("Invalid Correlation Data, err:" + err.Error())
-			}
-		case UserProperty:
-			if err = p.userProperty.decode(r); err != nil {
-				return errors.New("Invalid User Property, err:" + err.Error())
-			}
-		case SubscriptionIdentifier:
-			if err = p.subscriptionIdentifier.decode(r); err != nil || p.subscriptionIdentifier == 0 {
-				return errors.New("Invalid Subscription Identifier, err:" + err.Error())
-			}
-		case ContentType:
-			if err = p.contentType.decode(r); err != nil {
-				return errors.New("Invalid Will Content Type, err:" + err.Error())
-			}
-		default:
-			return errors.New("Unknown publish property")
+	}
+
+	if err := req.prop.decode(r); err != nil {
+		return err
+	}
+
+	// The topic name is left empty when the Topic Alias stands for it.
+	if len(req.topic) > 0 || !req.prop.fields[TopicAlias] {
+		if err := ValidTopicName(req.Topic()); err != nil {
+			return NewReasonError(InvalidTopicName, err.Error())
 		}
 	}
+
+	req.pl = bytes.Clone(r.Next(r.Len()))
 	return nil
 }
 
-func ParsePublish(h *MqttHeader, r *bytes.Buffer) (Request, error) {
-	req := &PublishRequest{}
+func (req *PublishRequest) Type() CType {
+	return PUBLISH
+}
+
+func (req *PublishRequest) Topic() string {
+	return string(req.topic)
+}
+
+func (req *PublishRequest) QoS() QoS {
+	return req.flag.qos
+}
+
+func (req *PublishRequest) Retain() bool {
+	return req.flag.retain
+}
 
-	if err := req.topic.decode(r); err != nil {
-		return nil, errors.New("Unable to parse public topic name, err:" + err.Error())
+func (req *PublishRequest) PacketId() uint16 {
+	return uint16(req.packetId)
+}
+
+func (req *PublishRequest) SetPacketId(packetId uint16) {
+	req.packetId = TwoByteInteger(packetId)
+}
+
+func (req *PublishRequest) SetDuplicate() {
+	req.flag.dup = true
+}
+
+func (req *PublishRequest) Payload() []byte {
+	return req.pl
+}
+
+func (req *PublishRequest) Reason() ReasonCode {
+	return req.reason
+}
+
+func (req *PublishRequest) SetReason(rc ReasonCode) {
+	req.reason = rc
+}
+
+// MessageExpiryInterval returns the lifetime of the message and whether it
+// has one.
+func (req *PublishRequest) MessageExpiryInterval() (time.Duration, bool) {
+	return time.Duration(req.prop.messageExpiryInterval) * time.Second, req.prop.fields[MessageExpiryInterval]
+}
+
+// StartExpiry starts the Message Expiry Interval at the time the message was
+// received.
+func (req *PublishRequest) StartExpiry(received time.Time) {
+	if interval, ok := req.MessageExpiryInterval(); ok {
+		req.expiry = received.Add(interval)
 	}
+}
 
-	// TODO: Wildcard and Subscription's Topic Filter checking
+// Expired reports whether the Message Expiry Interval has elapsed.
+func (req *PublishRequest) Expired(now time.Time) bool {
+	return !req.expiry.IsZero() && !now.Before(req.expiry)
+}
 
-	if h.flag.qos > QoS0 {
-		if err := req.packetId.decode(r); err != nil {
-			return nil, err
-		}
+// Aged returns the message with its Message Expiry Interval reduced by the
+// time it waited in the server, rounded up to the second.
+func (req *PublishRequest) Aged(now time.Time) *PublishRequest {
+	if req.expiry.IsZero() {
+		return req
 	}
+	aged := *req
+	remaining := (req.expiry.Sub(now) + time.Second - 1) / time.Second
+	aged.prop.messageExpiryInterval = FourByteInteger(max(remaining, 0))
+	return &aged
+}
 
-	if err := req.prop.decode(r); err != nil {
+// TopicAlias returns the Topic Alias of the message and whether it has one.
+func (req *PublishRequest) TopicAlias() (uint16, bool) {
+	return uint16(req.prop.topicAlias), req.prop.fields[TopicAlias]
+}
+
+// SubscriptionIdentifier returns the Subscription Identifier of the message
+// and whether it has one.
+func (req *PublishRequest) SubscriptionIdentifier() (int, bool) {
+	return int(req.prop.subscriptionIdentifier), req.prop.fields[SubscriptionIdentifier]
+}
+
+// SetTopic sets the topic name a Topic Alias stands for.
+func (req *PublishRequest) SetTopic(topic string) {
+	req.topic = UTF8String(topic)
+}
+
+// WithTopicAlias returns a copy of the message carrying the Topic Alias, and
+// without topic name when the receiver already maps the alias to it.
+func (req *PublishRequest) WithTopicAlias(alias uint16, omitTopic bool) *PublishRequest {
+	aliased := *req
+	aliased.prop.fields = maps.Clone(req.prop.fields)
+	aliased.prop.topicAlias = TwoByteInteger(alias)
+	aliased.prop.fields[TopicAlias] = true
+	if omitTopic {
+		aliased.topic = ""
+	}
+	return &aliased
+}
+
+// UserProperties returns the User Properties of the message, which are
+// forwarded unchanged and in order to every subscriber.
+func (req *PublishRequest) UserProperties() UserProperties {
+	return req.prop.userProperties
+}
+
+func (req *PublishRequest) AddUserProperty(key string, value string) {
+	req.prop.userProperties = append(req.prop.userProperties, NewUTF8StringPair(key, value))
+	req.prop.fields[UserProperty] = true
+}
+
+// WithoutUserProperties returns a copy of the message without User
+// Properties, which are the only properties a server may remove to fit the
+// Maximum Packet Size of a client, as PUBLISH carries no Reason String.
+func (req *PublishRequest) WithoutUserProperties() *PublishRequest {
+	stripped := *req
+	stripped.prop.fields = maps.Clone(req.prop.fields)
+	delete(stripped.prop.fields, UserProperty)
+	stripped.prop.userProperties = nil
+	return &stripped
+}
+
+// Forward copies the application message for delivery to a subscriber with
+// the given QoS and retain flag. Properties that only make sense on the
+// inbound hop are dropped.
+func (req *PublishRequest) Forward(qos QoS, retain bool) *PublishRequest {
+	fwd := *req
+	fwd.flag = Flag{qos: qos, retain: retain}
+	fwd.packetId = 0
+
+	fwd.prop.fields = make(map[MqttProperty]bool)
+	for mProp, ok := range req.prop.fields {
+		fwd.prop.fields[mProp] = ok
+	}
+	delete(fwd.prop.fields, TopicAlias)
+	delete(fwd.prop.fields, SubscriptionIdentifier)
+	fwd.prop.userProperties = slices.Clone(req.prop.userProperties)
+
+	return &fwd
+}
+
+func (req *PublishRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	if err := req.topic.Encode(w); err != nil {
+		return nil, errors.New("Unable to encode Topic Name, err:" + err.Error())
+	}
+	if req.flag.qos > QoS0 {
+		req.packetId.Encode(w)
+	}
+
+	if err := writeProperties(w, &req.prop); err != nil {
 		return nil, err
 	}
 
-	req.pl = make([]byte, r.Len())
-	if _, err := r.Read(req.pl); err != nil {
-		return nil, errors.New("Error reading publish payload")
+	w.Write(req.pl)
+	return w, nil
+}
+
+// Size returns the length of the whole packet, fixed header included, or 0
+// when the message cannot be encoded.
+func (req *PublishRequest) Size() int {
+	body, err := req.encode()
+	if err != nil {
+		return 0
 	}
+	n := body.Len()
+	return 1 + VarByteInt(n).Size() + n
+}
 
-	return req, nil
+func (req *PublishRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, PUBLISH, req.flag, body)
+}
+
+func (req *PublishRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *PublishRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
 }
 
 func (req *PublishRequest) ToString() string {
@@ -786,5 +1099,12 @@ func (req *PublishRequest) ToString() string {
 }
 
 func (req *PublishRequest) ResponseTo(w io.Writer) (int64, error) {
-	return 0, nil
+	switch req.flag.qos {
+	case QoS1:
+		return NewAck(PUBACK, uint16(req.packetId), req.reason).WriteTo(w)
+	case QoS2:
+		return NewAck(PUBREC, uint16(req.packetId), req.reason).WriteTo(w)
+	default:
+		return 0, nil
+	}
 }
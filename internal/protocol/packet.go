@@ -2,7 +2,10 @@ package protocol
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 )
 
 type Request interface {
@@ -16,3 +19,211 @@ type RequestHeader interface {
 type PacketProperties struct {
 	fields map[MqttProperty]bool
 }
+
+// Packet is a control packet as written on the wire, whichever end of the
+// connection sends it, so that clients can be built with this package as
+// well as the server.
+type Packet interface {
+	Type() CType
+	// Encode writes the whole packet, fixed header included.
+	Encode(w io.Writer) error
+	// Decode reads a whole packet of the type, fixed header included, and
+	// replaces the content of the packet with it.
+	Decode(r io.Reader) error
+}
+
+// packet is implemented by every Packet to decode what follows the fixed
+// header.
+type packet interface {
+	Packet
+	decode(h *MqttHeader, r *bytes.Buffer) error
+}
+
+func newPacket(t CType) (packet, error) {
+	switch t {
+	case CONNECT:
+		return &ConnectRequest{}, nil
+	case CONNACK:
+		return &ConnackResponse{}, nil
+	case PUBLISH:
+		return &PublishRequest{}, nil
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		return &AckRequest{ctl: t}, nil
+	case SUBSCRIBE:
+		return &SubscribeRequest{}, nil
+	case SUBACK:
+		return &SubackResponse{}, nil
+	case UNSUBSCRIBE:
+		return &UnsubscribeRequest{}, nil
+	case UNSUBACK:
+		return &UnsubackResponse{}, nil
+	case PINGREQ:
+		return &PingRequest{}, nil
+	case PINGRESP:
+		return &PingResponse{}, nil
+	case DISCONNECT:
+		return &DisconnectRequest{}, nil
+	case AUTH:
+		return &AuthRequest{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown MQTT Control Packet type %d.", t)
+	}
+}
+
+// NewPacket returns an empty packet of the type, ready to be decoded.
+func NewPacket(t CType) (Packet, error) {
+	return newPacket(t)
+}
+
+// maxVarByteIntLen is the number of bytes of the largest Variable Byte
+// Integer, 268435455.
+const maxVarByteIntLen = 4
+
+// byteReader reads one byte at a time from readers which cannot do it
+// themselves, so that nothing past the fixed header is consumed.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readFixedHeader reads the control byte then the Remaining Length one byte
+// at a time, as its length is only known once a byte without continuation bit
+// is read.
+func readFixedHeader(r io.ByteReader) ([]byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(make([]byte, 0, 1+maxVarByteIntLen), b)
+	for {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		header = append(header, b)
+		if b&128 == 0 {
+			return header, nil
+		} else if len(header) > maxVarByteIntLen {
+			return nil, NewReasonError(MalformedPacket, "Remaining Length exceeds 4 bytes.")
+		}
+	}
+}
+
+// readFrame reads the next packet of r, returning its fixed header and body.
+// A packet larger than maxSize fails with Packet Too Large before its body is
+// read, unless maxSize is 0.
+func readFrame(r io.Reader, maxSize uint32) (*MqttHeader, *bytes.Buffer, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+	header, err := readFixedHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, err := parseHeader(bytes.NewBuffer(header))
+	if err != nil {
+		return nil, nil, NewReasonError(MalformedPacket, err.Error())
+	}
+	if size := uint64(len(header)) + uint64(h.BodyLength()); maxSize > 0 && size > uint64(maxSize) {
+		return nil, nil, NewReasonError(PacketTooLarge, fmt.Sprintf("Packet of %d bytes exceeds maximum packet size %d.", size, maxSize))
+	}
+	body := make([]byte, h.BodyLength())
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	return h, bytes.NewBuffer(body), nil
+}
+
+func decodeBody(p packet, h *MqttHeader, r *bytes.Buffer) error {
+	if err := p.decode(h, r); err != nil {
+		return NewReasonError(ReasonOf(err, MalformedPacket), err.Error())
+	}
+	return nil
+}
+
+// decodePacket reads the next packet of r into p, which must be of the same
+// type.
+func decodePacket(r io.Reader, p packet) error {
+	h, body, err := readFrame(r, 0)
+	if err != nil {
+		return err
+	} else if h.ctl != p.Type() {
+		return NewReasonError(ProtocolError, fmt.Sprintf("Expected packet type %d, got %d.", p.Type(), h.ctl))
+	}
+	return decodeBody(p, h, body)
+}
+
+// DecodePacket reads the next packet of r, whatever its type.
+func DecodePacket(r io.Reader) (Packet, error) {
+	h, body, err := readFrame(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPacket(h.ctl)
+	if err != nil {
+		return nil, NewReasonError(MalformedPacket, err.Error())
+	}
+	if err = decodeBody(p, h, body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writePacket writes the fixed header of the body, then the body.
+func writePacket(w io.Writer, ctl CType, flag Flag, body *bytes.Buffer) (int64, error) {
+	if body.Len() > MaxVarByteInt {
+		return 0, errors.New("Packet exceeds the maximum Remaining Length.")
+	}
+	header := MqttHeader{ctl: ctl, flag: flag, len: VarByteInt(body.Len())}
+
+	n, err := header.encode().WriteTo(w)
+	if err != nil {
+		return 0, err
+	}
+	m, err := body.WriteTo(w)
+	return n + m, err
+}
+
+// diagnosed is implemented by the packets which may carry a Reason String or
+// User Properties.
+type diagnosed interface {
+	properties() propertySet
+}
+
+// WriteWithin writes the packet when it is at most maxSize bytes. A larger
+// packet is written without its Reason String and User Properties, which the
+// sender may leave out to fit the Maximum Packet Size of the receiver, and
+// fails with Packet Too Large when it is still too large.
+func WriteWithin(w io.Writer, p io.WriterTo, maxSize uint32) (int64, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if _, err := p.WriteTo(buf); err != nil {
+		return 0, err
+	}
+	if d, ok := p.(diagnosed); ok && uint64(buf.Len()) > uint64(maxSize) {
+		prop := d.properties().present()
+		fields := prop.fields
+		prop.fields = maps.Clone(fields)
+		delete(prop.fields, ReasonString)
+		delete(prop.fields, UserProperty)
+
+		buf.Reset()
+		_, err := p.WriteTo(buf)
+		prop.fields = fields
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(buf.Len()) > uint64(maxSize) {
+		return 0, NewReasonError(PacketTooLarge, fmt.Sprintf("Packet of %d bytes exceeds maximum packet size %d.", buf.Len(), maxSize))
+	}
+	return buf.WriteTo(w)
+}
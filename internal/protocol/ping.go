@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+type PingRequest struct{}
+
+func decodeEmpty(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid ping fixed header flags.")
+	} else if r.Len() != 0 {
+		return errors.New("Ping packet must not have a body.")
+	}
+	return nil
+}
+
+func (req *PingRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	return decodeEmpty(h, r)
+}
+
+func (req *PingRequest) Type() CType {
+	return PINGREQ
+}
+
+func (req *PingRequest) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, PINGREQ, Flag{}, bytes.NewBuffer(make([]byte, 0)))
+}
+
+func (req *PingRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *PingRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
+}
+
+func (req *PingRequest) ToString() string {
+	return "packet: PINGREQ"
+}
+
+func (req *PingRequest) ResponseTo(w io.Writer) (int64, error) {
+	return (&PingResponse{}).WriteTo(w)
+}
+
+type PingResponse struct{}
+
+func (resp *PingResponse) decode(h *MqttHeader, r *bytes.Buffer) error {
+	return decodeEmpty(h, r)
+}
+
+func (resp *PingResponse) Type() CType {
+	return PINGRESP
+}
+
+func (resp *PingResponse) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, PINGRESP, Flag{}, bytes.NewBuffer(make([]byte, 0)))
+}
+
+func (resp *PingResponse) Encode(w io.Writer) error {
+	_, err := resp.WriteTo(w)
+	return err
+}
+
+func (resp *PingResponse) Decode(r io.Reader) error {
+	return decodePacket(r, resp)
+}
+
+func (resp *PingResponse) ToString() string {
+	return "packet: PINGRESP"
+}
@@ -0,0 +1,269 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// wireType is the data type a property value is encoded with.
+type wireType byte
+
+const (
+	byteType wireType = iota
+	twoByteType
+	fourByteType
+	varByteType
+	utf8Type
+	utf8PairType
+	binaryType
+)
+
+// propertyScope is a set of places where properties may be carried: the
+// variable header of control packets, and the Will Properties of a CONNECT.
+type propertyScope uint32
+
+// willScope stands for the Will Properties, which are no control packet.
+const willScope propertyScope = 1 << COUNT
+
+func scopeOf(ctls ...CType) propertyScope {
+	var s propertyScope
+	for _, ctl := range ctls {
+		s |= 1 << ctl
+	}
+	return s
+}
+
+func (s propertyScope) String() string {
+	var names []string
+	for ctl := CONNECT; ctl < COUNT; ctl++ {
+		if s&scopeOf(ctl) != 0 {
+			names = append(names, ctl.String())
+		}
+	}
+	if s&willScope != 0 {
+		names = append(names, "Will Properties")
+	}
+	return strings.Join(names, ", ")
+}
+
+type propertyDef struct {
+	name  string
+	wire  wireType
+	scope propertyScope
+	// nonZero properties are a Protocol Error when they are 0.
+	nonZero bool
+	// repeatable properties may appear more than once in a packet.
+	repeatable bool
+}
+
+// propertyRegistry holds every property of the protocol, with the packets
+// allowed to carry it.
+var propertyRegistry = map[MqttProperty]propertyDef{
+	PayloadFormatIndicator:           {name: "Payload Format Indicator", wire: byteType, scope: scopeOf(PUBLISH) | willScope},
+	MessageExpiryInterval:            {name: "Message Expiry Interval", wire: fourByteType, scope: scopeOf(PUBLISH) | willScope},
+	ContentType:                      {name: "Content Type", wire: utf8Type, scope: scopeOf(PUBLISH) | willScope},
+	ResponseTopic:                    {name: "Response Topic", wire: utf8Type, scope: scopeOf(PUBLISH) | willScope},
+	CorrelationData:                  {name: "Correlation Data", wire: binaryType, scope: scopeOf(PUBLISH) | willScope},
+	SubscriptionIdentifier:           {name: "Subscription Identifier", wire: varByteType, scope: scopeOf(PUBLISH, SUBSCRIBE), nonZero: true},
+	SessionExpiryInterval:            {name: "Session Expiry Interval", wire: fourByteType, scope: scopeOf(CONNECT, CONNACK, DISCONNECT)},
+	AssignedClientIdentifier:         {name: "Assigned Client Identifier", wire: utf8Type, scope: scopeOf(CONNACK)},
+	ServerKeepAlive:                  {name: "Server Keep Alive", wire: twoByteType, scope: scopeOf(CONNACK)},
+	AuthenticationMethod:             {name: "Authentication Method", wire: utf8Type, scope: scopeOf(CONNECT, CONNACK, AUTH)},
+	AuthenticationData:               {name: "Authentication Data", wire: binaryType, scope: scopeOf(CONNECT, CONNACK, AUTH)},
+	RequestProblemInformation:        {name: "Request Problem Information", wire: byteType, scope: scopeOf(CONNECT)},
+	WillDelayInterval:                {name: "Will Delay Interval", wire: fourByteType, scope: willScope},
+	RequestResponseInformation:       {name: "Request Response Information", wire: byteType, scope: scopeOf(CONNECT)},
+	ResponseInformation:              {name: "Response Information", wire: utf8Type, scope: scopeOf(CONNACK)},
+	ServerReference:                  {name: "Server Reference", wire: utf8Type, scope: scopeOf(CONNACK, DISCONNECT)},
+	ReasonString:                     {name: "Reason String", wire: utf8Type, scope: scopeOf(CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, DISCONNECT, AUTH)},
+	ReceiveMaximum:                   {name: "Receive Maximum", wire: twoByteType, scope: scopeOf(CONNECT, CONNACK), nonZero: true},
+	TopicAliasMaximum:                {name: "Topic Alias Maximum", wire: twoByteType, scope: scopeOf(CONNECT, CONNACK)},
+	TopicAlias:                       {name: "Topic Alias", wire: twoByteType, scope: scopeOf(PUBLISH), nonZero: true},
+	MaximumQoS:                       {name: "Maximum QoS", wire: byteType, scope: scopeOf(CONNACK)},
+	RetainAvailable:                  {name: "Retain Available", wire: byteType, scope: scopeOf(CONNACK)},
+	UserProperty:                     {name: "User Property", wire: utf8PairType, scope: scopeOf(CONNECT, CONNACK, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, AUTH) | willScope, repeatable: true},
+	MaximumPacketSize:                {name: "Maximum Packet Size", wire: fourByteType, scope: scopeOf(CONNECT, CONNACK), nonZero: true},
+	WildcardSubscriptionAvailable:    {name: "Wildcard Subscription Available", wire: byteType, scope: scopeOf(CONNACK)},
+	SubscriptionIdentifiersAvailable: {name: "Subscription Identifier Available", wire: byteType, scope: scopeOf(CONNACK)},
+	SharedSubscriptionAvailable:      {name: "Shared Subscription Available", wire: byteType, scope: scopeOf(CONNACK)},
+}
+
+// propertyOrder is the order properties are encoded in.
+var propertyOrder = slices.Sorted(maps.Keys(propertyRegistry))
+
+// propertyValue is a property held by a property set, decoded and encoded as
+// its wire type.
+type propertyValue interface {
+	Encode(w *bytes.Buffer) error
+	Decode(r *bytes.Buffer) error
+}
+
+func (t wireType) holds(v propertyValue) bool {
+	switch v.(type) {
+	case *ByteInteger:
+		return t == byteType
+	case *TwoByteInteger:
+		return t == twoByteType
+	case *FourByteInteger:
+		return t == fourByteType
+	case *VarByteInt:
+		return t == varByteType
+	case *UTF8String:
+		return t == utf8Type
+	case *UTF8StringPair, *UserProperties:
+		return t == utf8PairType
+	case *BinaryData:
+		return t == binaryType
+	default:
+		return false
+	}
+}
+
+func isZero(v propertyValue) bool {
+	switch v := v.(type) {
+	case *TwoByteInteger:
+		return *v == 0
+	case *FourByteInteger:
+		return *v == 0
+	case *VarByteInt:
+		return *v == 0
+	default:
+		return false
+	}
+}
+
+// UserProperties are the User Properties of a packet in the order they were
+// sent. A key may appear more than once.
+type UserProperties []UTF8StringPair
+
+// Encode writes the pairs one after another. Each pair needs its own property
+// identifier, which encodeProperties writes.
+func (v UserProperties) Encode(w *bytes.Buffer) error {
+	for _, pair := range v {
+		if err := pair.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode appends the next pair.
+func (v *UserProperties) Decode(r *bytes.Buffer) error {
+	var pair UTF8StringPair
+	if err := pair.Decode(r); err != nil {
+		return err
+	}
+	*v = append(*v, pair)
+	return nil
+}
+
+// Get returns the value of the first pair with the key.
+func (v UserProperties) Get(key string) (string, bool) {
+	for _, pair := range v {
+		if pair.Key() == key {
+			return pair.Value(), true
+		}
+	}
+	return "", false
+}
+
+// propertySet is the properties of one packet type, or the Will Properties.
+type propertySet interface {
+	scope() propertyScope
+	// value returns the field holding the property, nil when the set has
+	// none.
+	value(mProp MqttProperty) propertyValue
+	present() *PacketProperties
+}
+
+func (p *PacketProperties) present() *PacketProperties {
+	return p
+}
+
+// decodeProperties reads the property length then the properties of the set,
+// which keeps the values it holds for properties that are absent.
+func decodeProperties(r *bytes.Buffer, p propertySet) error {
+	fields := make(map[MqttProperty]bool)
+	p.present().fields = fields
+
+	var propLen VarByteInt
+	if err := propLen.Decode(r); err != nil {
+		return errors.New("Unable to decode property length.")
+	}
+	b, err := next(r, int(propLen))
+	if err != nil {
+		return errors.New("Properties must match set length.")
+	}
+
+	pr := bytes.NewBuffer(b)
+	for pr.Len() > 0 {
+		id, _ := pr.ReadByte()
+		mProp := MqttProperty(id)
+		def, ok := propertyRegistry[mProp]
+		if !ok {
+			return fmt.Errorf("Unknown property %#x.", id)
+		} else if def.scope&p.scope() == 0 {
+			return NewReasonError(ProtocolError, fmt.Sprintf("%s is not allowed in %s.", def.name, p.scope()))
+		} else if fields[mProp] && !def.repeatable {
+			return NewReasonError(ProtocolError, fmt.Sprintf("Duplicate %s in %s.", def.name, p.scope()))
+		}
+
+		v := p.value(mProp)
+		if v == nil || !def.wire.holds(v) {
+			return fmt.Errorf("Unsupported %s in %s.", def.name, p.scope())
+		} else if err = v.Decode(pr); err != nil {
+			return fmt.Errorf("Invalid %s, err:%s", def.name, err.Error())
+		} else if def.nonZero && isZero(v) {
+			return NewReasonError(ProtocolError, def.name+" must not be 0.")
+		}
+		fields[mProp] = true
+	}
+	return nil
+}
+
+// encodeProperties writes the properties present in the set, without their
+// length.
+func encodeProperties(p propertySet) (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	fields := p.present().fields
+	for _, mProp := range propertyOrder {
+		if !fields[mProp] || propertyRegistry[mProp].scope&p.scope() == 0 {
+			continue
+		}
+		switch v := p.value(mProp).(type) {
+		case nil:
+		case *UserProperties:
+			for _, pair := range *v {
+				MqttProperty(mProp).encode().WriteTo(w)
+				if err := pair.Encode(w); err != nil {
+					return nil, errors.New("Unable to encode " + propertyRegistry[mProp].name + ", err:" + err.Error())
+				}
+			}
+		default:
+			MqttProperty(mProp).encode().WriteTo(w)
+			if err := v.Encode(w); err != nil {
+				return nil, errors.New("Unable to encode " + propertyRegistry[mProp].name + ", err:" + err.Error())
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// writeProperties writes the properties present in the set preceded by their
+// length.
+func writeProperties(w *bytes.Buffer, p propertySet) error {
+	prop, err := encodeProperties(p)
+	if err != nil {
+		return err
+	} else if err = VarByteInt(prop.Len()).Encode(w); err != nil {
+		return err
+	}
+	prop.WriteTo(w)
+	return nil
+}
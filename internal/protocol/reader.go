@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+)
+
+// PacketReader frames control packets out of a byte stream in which a packet
+// may be split across reads and several packets may arrive in one.
+//
+// Errors of the stream are returned as is, so that timeouts and closed
+// connections can be told apart. Packets that cannot be framed or parsed fail
+// with a ReasonError, Malformed Packet unless the parser tells otherwise.
+type PacketReader struct {
+	r *bufio.Reader
+	// maxSize bounds the whole packet, fixed header included. It is not
+	// enforced when 0.
+	maxSize uint32
+}
+
+func NewPacketReader(r io.Reader, maxSize uint32) *PacketReader {
+	return &PacketReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// ReadPacket reads and parses the next control packet. A packet larger than
+// the maximum size fails with Packet Too Large before its body is read.
+func (pr *PacketReader) ReadPacket() (Request, error) {
+	h, body, err := readFrame(pr.r, pr.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return h.ParseBody(body)
+}
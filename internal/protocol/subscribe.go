@@ -0,0 +1,356 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+)
+
+type RetainHandling byte
+
+const (
+	SendRetained RetainHandling = iota
+	SendRetainedIfNew
+	DoNotSendRetained
+)
+
+type SubscriptionOptions byte
+
+func (o SubscriptionOptions) QoS() QoS {
+	return QoS(byte(o) & 0b00000011)
+}
+func (o SubscriptionOptions) NoLocal() bool {
+	return byte(o)&0b00000100 != 0
+}
+func (o SubscriptionOptions) RetainAsPublished() bool {
+	return byte(o)&0b00001000 != 0
+}
+func (o SubscriptionOptions) RetainHandling() RetainHandling {
+	return RetainHandling(byte(o) & 0b00110000 >> 4)
+}
+func (o SubscriptionOptions) reserved() bool {
+	return byte(o)&0b11000000 != 0
+}
+func (o SubscriptionOptions) valid() error {
+	if o.reserved() {
+		return errors.New("Reserved subscription options must be 0.")
+	} else if o.QoS() >= QoS3 {
+		return errors.New("Invalid subscription QoS.")
+	} else if o.RetainHandling() > DoNotSendRetained {
+		return errors.New("Invalid subscription Retain Handling.")
+	}
+	return nil
+}
+
+// NewSubscriptionOptions packs the options of a subscription.
+func NewSubscriptionOptions(qos QoS, noLocal bool, retainAsPublished bool, rh RetainHandling) SubscriptionOptions {
+	o := byte(qos) | byte(rh)<<4
+	if noLocal {
+		o |= 0b00000100
+	}
+	if retainAsPublished {
+		o |= 0b00001000
+	}
+	return SubscriptionOptions(o)
+}
+
+type Subscription struct {
+	filter UTF8String
+	opts   SubscriptionOptions
+	reason ReasonCode
+}
+
+func (s Subscription) Filter() string {
+	return string(s.filter)
+}
+
+// Shared reports whether the subscription is a shared subscription, whose
+// messages go to a single member of the group.
+func (s Subscription) Shared() bool {
+	_, _, ok := SplitSharedFilter(s.Filter())
+	return ok
+}
+
+func (s Subscription) Options() SubscriptionOptions {
+	return s.opts
+}
+
+func (s Subscription) Reason() ReasonCode {
+	return s.reason
+}
+
+func (s Subscription) GrantedQoS() QoS {
+	return QoS(s.reason)
+}
+
+func (s *Subscription) Grant(qos QoS) {
+	s.reason = ReasonCode(qos)
+}
+
+func (s *Subscription) Reject(rc ReasonCode) {
+	s.reason = rc
+}
+
+type SubscribeProperties struct {
+	PacketProperties
+	subscriptionIdentifier VarByteInt
+	userProperties         UserProperties
+}
+
+func (p *SubscribeProperties) scope() propertyScope {
+	return scopeOf(SUBSCRIBE)
+}
+
+func (p *SubscribeProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case SubscriptionIdentifier:
+		return &p.subscriptionIdentifier
+	case UserProperty:
+		return &p.userProperties
+	default:
+		return nil
+	}
+}
+
+func (p *SubscribeProperties) decode(r *bytes.Buffer) error {
+	*p = SubscribeProperties{}
+	return decodeProperties(r, p)
+}
+
+type SubscribeRequest struct {
+	packetId TwoByteInteger
+	prop     SubscribeProperties
+	subs     []*Subscription
+}
+
+// NewSubscribe creates the SUBSCRIBE of a client for the topic filters with
+// their options.
+func NewSubscribe(packetId uint16, filters map[string]SubscriptionOptions) *SubscribeRequest {
+	req := &SubscribeRequest{packetId: TwoByteInteger(packetId)}
+	req.prop.fields = make(map[MqttProperty]bool)
+	for _, filter := range slices.Sorted(maps.Keys(filters)) {
+		req.subs = append(req.subs, &Subscription{filter: UTF8String(filter), opts: filters[filter]})
+	}
+	return req
+}
+
+func (req *SubscribeRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{qos: QoS1}) {
+		return errors.New("Invalid subscribe fixed header flags.")
+	}
+
+	*req = SubscribeRequest{}
+	if err := req.packetId.Decode(r); err != nil {
+		return err
+	} else if req.packetId == 0 {
+		return errors.New("Subscribe packet identifier must not be 0.")
+	}
+
+	if err := req.prop.decode(r); err != nil {
+		return err
+	}
+
+	for r.Len() > 0 {
+		sub := &Subscription{}
+		if err := sub.filter.Decode(r); err != nil {
+			return errors.New("Unable to parse topic filter, err:" + err.Error())
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return errors.New("Missing subscription options.")
+		}
+		sub.opts = SubscriptionOptions(b)
+		if err := sub.opts.valid(); err != nil {
+			return err
+		}
+
+		if ValidTopicFilter(sub.Filter()) != nil {
+			sub.Reject(TopicFilterInvalid)
+		} else if _, _, shared := SplitSharedFilter(sub.Filter()); shared && sub.opts.NoLocal() {
+			return NewReasonError(ProtocolError, "No Local must not be set on a shared subscription.")
+		} else if sub.opts.QoS() > sub.opts.QoS().maxQos() {
+			sub.Grant(sub.opts.QoS().maxQos())
+		} else {
+			sub.Grant(sub.opts.QoS())
+		}
+		req.subs = append(req.subs, sub)
+	}
+
+	if len(req.subs) == 0 {
+		return errors.New("Subscribe packet must contain at least one topic filter.")
+	}
+
+	return nil
+}
+
+func (req *SubscribeRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	req.packetId.Encode(w)
+
+	if err := writeProperties(w, &req.prop); err != nil {
+		return nil, err
+	}
+
+	for _, sub := range req.subs {
+		if err := sub.filter.Encode(w); err != nil {
+			return nil, errors.New("Unable to encode topic filter, err:" + err.Error())
+		}
+		w.WriteByte(byte(sub.opts))
+	}
+
+	return w, nil
+}
+
+func (req *SubscribeRequest) Type() CType {
+	return SUBSCRIBE
+}
+
+func (req *SubscribeRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, SUBSCRIBE, Flag{qos: QoS1}, body)
+}
+
+func (req *SubscribeRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *SubscribeRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
+}
+
+func (req *SubscribeRequest) PacketId() uint16 {
+	return uint16(req.packetId)
+}
+
+func (req *SubscribeRequest) SubscriptionIdentifier() int {
+	return int(req.prop.subscriptionIdentifier)
+}
+
+func (req *SubscribeRequest) Subscriptions() []*Subscription {
+	return req.subs
+}
+
+func (req *SubscribeRequest) ToString() string {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteString(fmt.Sprintf("packet: SUBSCRIBE, "))
+	buf.WriteString(fmt.Sprintf("packId: %d, ", req.packetId))
+	for _, sub := range req.subs {
+		buf.WriteString(fmt.Sprintf("filter: %s, qos: %d, ", sub.filter, sub.opts.QoS()))
+	}
+
+	return buf.String()
+}
+
+// Suback returns the SUBACK answering the SUBSCRIBE with the reason code of
+// each subscription.
+func (req *SubscribeRequest) Suback() *SubackResponse {
+	ack := &SubackResponse{packetId: req.packetId}
+	for _, sub := range req.subs {
+		ack.reasons = append(ack.reasons, sub.reason)
+	}
+	return ack
+}
+
+func (req *SubscribeRequest) ResponseTo(w io.Writer) (int64, error) {
+	return req.Suback().WriteTo(w)
+}
+
+// SubackResponse carries a reason code for each topic filter of a SUBSCRIBE,
+// in the same order.
+type SubackResponse struct {
+	packetId TwoByteInteger
+	prop     AckProperties
+	reasons  []ReasonCode
+}
+
+func (ack *SubackResponse) PacketId() uint16 {
+	return uint16(ack.packetId)
+}
+
+func (ack *SubackResponse) Reasons() []ReasonCode {
+	return ack.reasons
+}
+
+func (ack *SubackResponse) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid suback fixed header flags.")
+	}
+	return decodeReasons(r, &ack.packetId, &ack.prop, &ack.reasons)
+}
+
+func (ack *SubackResponse) Type() CType {
+	return SUBACK
+}
+
+func (ack *SubackResponse) properties() propertySet {
+	return &ack.prop
+}
+
+func (ack *SubackResponse) WriteTo(w io.Writer) (int64, error) {
+	body, err := encodeReasons(ack.packetId, &ack.prop, ack.reasons)
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, SUBACK, Flag{}, body)
+}
+
+func (ack *SubackResponse) Encode(w io.Writer) error {
+	_, err := ack.WriteTo(w)
+	return err
+}
+
+func (ack *SubackResponse) Decode(r io.Reader) error {
+	return decodePacket(r, ack)
+}
+
+func (ack *SubackResponse) ToString() string {
+	return fmt.Sprintf("packet: SUBACK, packId: %d, reasons: %v", ack.packetId, ack.reasons)
+}
+
+// decodeReasons decodes the body shared by SUBACK and UNSUBACK, a reason code
+// for each topic filter following the packet identifier and properties.
+func decodeReasons(r *bytes.Buffer, packetId *TwoByteInteger, prop *AckProperties, reasons *[]ReasonCode) error {
+	*reasons = nil
+	if err := packetId.Decode(r); err != nil {
+		return err
+	} else if *packetId == 0 {
+		return errors.New("Packet identifier must not be 0.")
+	}
+	if err := prop.decode(r); err != nil {
+		return err
+	}
+
+	for r.Len() > 0 {
+		b, _ := r.ReadByte()
+		*reasons = append(*reasons, ReasonCode(b))
+	}
+	if len(*reasons) == 0 {
+		return errors.New("Acknowledgement must contain at least one reason code.")
+	}
+	return nil
+}
+
+func encodeReasons(packetId TwoByteInteger, prop *AckProperties, reasons []ReasonCode) (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	packetId.Encode(w)
+
+	if err := writeProperties(w, prop); err != nil {
+		return nil, err
+	}
+
+	for _, rc := range reasons {
+		rc.encode().WriteTo(w)
+	}
+
+	return w, nil
+}
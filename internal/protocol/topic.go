@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	TopicLevelSeparator = "/"
+	SingleLevelWildcard = "+"
+	MultiLevelWildcard  = "#"
+	// SharePrefix starts the topic filter of shared subscriptions,
+	// $share/{ShareName}/{filter}.
+	SharePrefix = "$share/"
+)
+
+// SplitSharedFilter returns the Share Name and the topic filter of a shared
+// subscription, ok being false for other topic filters.
+func SplitSharedFilter(filter string) (share string, topicFilter string, ok bool) {
+	rest, ok := strings.CutPrefix(filter, SharePrefix)
+	if !ok {
+		return "", "", false
+	}
+	share, topicFilter, _ = strings.Cut(rest, TopicLevelSeparator)
+	return share, topicFilter, true
+}
+
+func ValidTopicName(topic string) error {
+	if len(topic) == 0 {
+		return errors.New("Topic name must be at least one character long.")
+	} else if strings.ContainsAny(topic, SingleLevelWildcard+MultiLevelWildcard) {
+		return errors.New("Topic name must not contain wildcard characters.")
+	} else if strings.ContainsRune(topic, 0) {
+		return errors.New("Topic name must not contain null character.")
+	}
+	return nil
+}
+
+func ValidTopicFilter(filter string) error {
+	if len(filter) == 0 {
+		return errors.New("Topic filter must be at least one character long.")
+	} else if strings.ContainsRune(filter, 0) {
+		return errors.New("Topic filter must not contain null character.")
+	}
+
+	if share, topicFilter, ok := SplitSharedFilter(filter); ok {
+		if len(share) == 0 || strings.ContainsAny(share, SingleLevelWildcard+MultiLevelWildcard) {
+			return errors.New("Share Name must be at least one character long and without wildcard characters.")
+		} else if len(topicFilter) == 0 {
+			return errors.New("Shared subscription must have a topic filter after the Share Name.")
+		}
+		filter = topicFilter
+	}
+
+	levels := strings.Split(filter, TopicLevelSeparator)
+	for i, level := range levels {
+		switch {
+		case level == MultiLevelWildcard:
+			if i != len(levels)-1 {
+				return errors.New("Multi-level wildcard must be the last level of topic filter.")
+			}
+		case level == SingleLevelWildcard:
+		case strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard):
+			return errors.New("Wildcard must occupy an entire level of topic filter.")
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether the topic name matches the topic filter. Topics
+// starting with '$' are not matched by wildcards at the first level.
+func MatchTopic(filter string, topic string) bool {
+	fLevels := strings.Split(filter, TopicLevelSeparator)
+	tLevels := strings.Split(topic, TopicLevelSeparator)
+
+	if strings.HasPrefix(topic, "$") && (fLevels[0] == SingleLevelWildcard || fLevels[0] == MultiLevelWildcard) {
+		return false
+	}
+
+	for i, level := range fLevels {
+		if level == MultiLevelWildcard {
+			return true
+		} else if i >= len(tLevels) {
+			return false
+		} else if level != SingleLevelWildcard && level != tLevels[i] {
+			return false
+		}
+	}
+	return len(fLevels) == len(tLevels)
+}
@@ -4,82 +4,124 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"math"
+	"strings"
 	"unicode/utf8"
 )
 
+// Every data type of the protocol encodes into and decodes from a buffer with
+// the same rules, so that anything Encode accepts is read back unchanged by
+// Decode, and anything Decode refuses cannot be encoded. Size is the length
+// of the encoded value.
+
+// MaxVarByteInt is the largest value of a Variable Byte Integer.
+const MaxVarByteInt = 268435455
+
+// next returns the n following bytes of r, failing instead of returning less.
+func next(r *bytes.Buffer, n int) ([]byte, error) {
+	if r.Len() < n {
+		return nil, errors.New("Unexpected end of packet.")
+	}
+	return r.Next(n), nil
+}
+
 type VarByteInt uint32
 
 func (v *VarByteInt) Add(n int) {
 	*v += VarByteInt(n)
 }
 
-func (v VarByteInt) encode() *bytes.Buffer {
-	encodedByte := uint32(0)
+func (v VarByteInt) Size() int {
+	switch {
+	case v < 128:
+		return 1
+	case v < 128*128:
+		return 2
+	case v < 128*128*128:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func (v VarByteInt) Encode(w *bytes.Buffer) error {
+	if v > MaxVarByteInt {
+		return errors.New("Variable Byte Integer exceeds 268435455.")
+	}
 	for {
-		encodedByte = uint32(v % 128)
+		encodedByte := byte(v % 128)
 		v /= 128
 		if v > 0 {
 			encodedByte |= 128
-		} else {
-			break
+		}
+		w.WriteByte(encodedByte)
+		if v == 0 {
+			return nil
 		}
 	}
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, encodedByte)
-	b = bytes.Trim(b, "\x00")
-
-	return bytes.NewBuffer(b)
 }
 
-func (v *VarByteInt) decode(r *bytes.Buffer) error {
-	multiplier := uint32(1)
-	x := uint32(0)
-	var encodedByte uint32
-	for {
+func (v *VarByteInt) Decode(r *bytes.Buffer) error {
+	var x uint32
+	for i := 0; i < 4; i++ {
 		b, err := r.ReadByte()
-		if multiplier > 128*128*128 || err != nil {
+		if err != nil {
 			return errors.New("Unable to decode Variable Byte Integer")
 		}
-		encodedByte = uint32(b)
-		x += (encodedByte & 127) * multiplier
-
-		multiplier *= 128
-		if (encodedByte & 128) == 0 {
-			break
+		x |= uint32(b&127) << (7 * i)
+		if b&128 == 0 {
+			// A last byte of 0 adds nothing, so a shorter encoding exists.
+			if i > 0 && b == 0 {
+				return errors.New("Variable Byte Integer is not minimally encoded.")
+			}
+			*v = VarByteInt(x)
+			return nil
 		}
 	}
-	*v = VarByteInt(x)
-	return nil
+	return errors.New("Variable Byte Integer exceeds 4 bytes.")
 }
 
 type UTF8String string
 
-func (v *UTF8String) decode(r *bytes.Buffer) error {
-	*v = ""
-	b := make([]byte, 2)
-	if _, err := r.Read(b); err != nil {
-		return errors.New("Unable to decode UTF-8 string.")
+// validUTF8 checks the rules of UTF-8 Encoded Strings: well-formed UTF-8
+// without null character, and no longer than a Two Byte Integer can tell.
+func validUTF8(s string) error {
+	if len(s) > math.MaxUint16 {
+		return errors.New("UTF-8 string exceeds 65535 bytes.")
+	} else if !utf8.ValidString(s) {
+		return errors.New("UTF-8 string is not valid utf-8.")
+	} else if strings.IndexByte(s, 0) >= 0 {
+		return errors.New("UTF-8 string must not contain null character.")
 	}
-	slen := binary.BigEndian.Uint16(b)
-	if slen == 0 {
-		return nil
+	return nil
+}
+
+func (v UTF8String) Size() int {
+	return 2 + len(v)
+}
+
+func (v UTF8String) Encode(w *bytes.Buffer) error {
+	if err := validUTF8(string(v)); err != nil {
+		return err
 	}
+	TwoByteInteger(len(v)).Encode(w)
+	w.WriteString(string(v))
+	return nil
+}
 
-	if r.Len() < int(slen) {
+func (v *UTF8String) Decode(r *bytes.Buffer) error {
+	var slen TwoByteInteger
+	if err := slen.Decode(r); err != nil {
+		return errors.New("Unable to decode UTF-8 string.")
+	}
+	b, err := next(r, int(slen))
+	if err != nil {
 		return errors.New("UTF-8 string doesn't match set length.")
-	} else if !utf8.Valid(r.Bytes()) {
-		return errors.New("UTF-8 string is not valid utf-8.")
 	}
-
-	remain := r.Len()
-	for remain-r.Len() < int(slen) {
-		rune, size := utf8.DecodeRune(r.Bytes())
-		if rune == utf8.RuneError {
-			continue
-		}
-		*v += UTF8String(rune)
-		r.Next(size)
+	if err = validUTF8(string(b)); err != nil {
+		return err
 	}
+	*v = UTF8String(b)
 	return nil
 }
 
@@ -88,11 +130,40 @@ type UTF8StringPair struct {
 	value UTF8String
 }
 
-func (v *UTF8StringPair) decode(r *bytes.Buffer) error {
-	if err := v.key.decode(r); err != nil {
+func NewUTF8StringPair(key string, value string) UTF8StringPair {
+	return UTF8StringPair{key: UTF8String(key), value: UTF8String(value)}
+}
+
+func (v UTF8StringPair) Key() string {
+	return string(v.key)
+}
+
+func (v UTF8StringPair) Value() string {
+	return string(v.value)
+}
+
+func (v UTF8StringPair) Size() int {
+	return v.key.Size() + v.value.Size()
+}
+
+func (v UTF8StringPair) Encode(w *bytes.Buffer) error {
+	if err := validUTF8(string(v.key)); err != nil {
+		return errors.New("Unable to encode key in UTF-8 string pair, err:" + err.Error())
+	} else if err = validUTF8(string(v.value)); err != nil {
+		return errors.New("Unable to encode value in UTF-8 string pair, err:" + err.Error())
+	}
+	// Both strings are valid, so the pair is never written partially.
+	if err := v.key.Encode(w); err != nil {
+		return err
+	}
+	return v.value.Encode(w)
+}
+
+func (v *UTF8StringPair) Decode(r *bytes.Buffer) error {
+	if err := v.key.Decode(r); err != nil {
 		return errors.New("Unable to decode key in UTF-8 string pair, err:" + err.Error())
 	}
-	if err := v.value.decode(r); err != nil {
+	if err := v.value.Decode(r); err != nil {
 		return errors.New("Unable to decode value in UTF-8 string pair, err:" + err.Error())
 	}
 	return nil
@@ -100,45 +171,71 @@ func (v *UTF8StringPair) decode(r *bytes.Buffer) error {
 
 type BinaryData []byte
 
-func (v *BinaryData) decode(r *bytes.Buffer) error {
-	b := make([]byte, 2)
-	if _, err := r.Read(b); err != nil {
-		return errors.New("Unable to decode BinaryData.")
+func (v BinaryData) Size() int {
+	return 2 + len(v)
+}
+
+func (v BinaryData) Encode(w *bytes.Buffer) error {
+	if len(v) > math.MaxUint16 {
+		return errors.New("Binary Data exceeds 65535 bytes.")
+	}
+	TwoByteInteger(len(v)).Encode(w)
+	w.Write(v)
+	return nil
+}
+
+func (v *BinaryData) Decode(r *bytes.Buffer) error {
+	var vLen TwoByteInteger
+	if err := vLen.Decode(r); err != nil {
+		return errors.New("Unable to decode Binary Data.")
 	}
-	vLen := binary.BigEndian.Uint16(b)
-	*v = make([]byte, vLen)
-	if _, err := r.Read(*v); err != nil {
-		return errors.New("Unable to decode BinaryData.")
+	b, err := next(r, int(vLen))
+	if err != nil {
+		return errors.New("Binary Data doesn't match set length.")
 	}
+	*v = bytes.Clone(b)
 	return nil
 }
 
+// ByteInteger is a Byte holding a boolean, which only has the values 0 and 1.
 type ByteInteger bool
 
-func (v ByteInteger) encode() *bytes.Buffer {
-	w := bytes.NewBuffer(make([]byte, 0))
+func (v ByteInteger) Size() int {
+	return 1
+}
+
+func (v ByteInteger) Encode(w *bytes.Buffer) error {
 	if v {
 		w.WriteByte(0b1)
 	} else {
 		w.WriteByte(0b0)
 	}
-	return w
+	return nil
 }
 
-func (v *ByteInteger) decode(r *bytes.Buffer) error {
-	b := make([]byte, 1)
-	if _, err := r.Read(b); err != nil || b[0] >= 1 {
+func (v *ByteInteger) Decode(r *bytes.Buffer) error {
+	b, err := r.ReadByte()
+	if err != nil || b > 1 {
 		return errors.New("Unable to decode Byte Integer.")
 	}
-	*v = ByteInteger(b[0] == 1)
+	*v = ByteInteger(b == 1)
 	return nil
 }
 
 type TwoByteInteger uint16
 
-func (v *TwoByteInteger) decode(r *bytes.Buffer) error {
-	b := make([]byte, 2)
-	if _, err := r.Read(b); err != nil {
+func (v TwoByteInteger) Size() int {
+	return 2
+}
+
+func (v TwoByteInteger) Encode(w *bytes.Buffer) error {
+	w.Write(binary.BigEndian.AppendUint16(nil, uint16(v)))
+	return nil
+}
+
+func (v *TwoByteInteger) Decode(r *bytes.Buffer) error {
+	b, err := next(r, 2)
+	if err != nil {
 		return errors.New("Unable to decode Two Byte Integer.")
 	}
 	*v = TwoByteInteger(binary.BigEndian.Uint16(b))
@@ -147,10 +244,19 @@ func (v *TwoByteInteger) decode(r *bytes.Buffer) error {
 
 type FourByteInteger uint32
 
-func (v *FourByteInteger) decode(r *bytes.Buffer) error {
-	b := make([]byte, 4)
-	if _, err := r.Read(b); err != nil {
-		return errors.New("Unable to decode Two Byte Integer.")
+func (v FourByteInteger) Size() int {
+	return 4
+}
+
+func (v FourByteInteger) Encode(w *bytes.Buffer) error {
+	w.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	return nil
+}
+
+func (v *FourByteInteger) Decode(r *bytes.Buffer) error {
+	b, err := next(r, 4)
+	if err != nil {
+		return errors.New("Unable to decode Four Byte Integer.")
 	}
 	*v = FourByteInteger(binary.BigEndian.Uint32(b))
 	return nil
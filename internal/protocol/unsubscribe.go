@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type UnsubscribeProperties struct {
+	PacketProperties
+	userProperties UserProperties
+}
+
+func (p *UnsubscribeProperties) scope() propertyScope {
+	return scopeOf(UNSUBSCRIBE)
+}
+
+func (p *UnsubscribeProperties) value(mProp MqttProperty) propertyValue {
+	switch mProp {
+	case UserProperty:
+		return &p.userProperties
+	default:
+		return nil
+	}
+}
+
+func (p *UnsubscribeProperties) decode(r *bytes.Buffer) error {
+	*p = UnsubscribeProperties{}
+	return decodeProperties(r, p)
+}
+
+type UnsubscribeRequest struct {
+	packetId TwoByteInteger
+	prop     UnsubscribeProperties
+	filters  []UTF8String
+	// reasons are answered in the UNSUBACK, one for each topic filter.
+	reasons []ReasonCode
+}
+
+func NewUnsubscribe(packetId uint16, filters ...string) *UnsubscribeRequest {
+	req := &UnsubscribeRequest{packetId: TwoByteInteger(packetId)}
+	for _, filter := range filters {
+		req.filters = append(req.filters, UTF8String(filter))
+	}
+	req.reasons = make([]ReasonCode, len(req.filters))
+	return req
+}
+
+func (req *UnsubscribeRequest) PacketId() uint16 {
+	return uint16(req.packetId)
+}
+
+func (req *UnsubscribeRequest) Filters() []string {
+	filters := make([]string, len(req.filters))
+	for i, filter := range req.filters {
+		filters[i] = string(filter)
+	}
+	return filters
+}
+
+func (req *UnsubscribeRequest) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{qos: QoS1}) {
+		return errors.New("Invalid unsubscribe fixed header flags.")
+	}
+
+	*req = UnsubscribeRequest{}
+	if err := req.packetId.Decode(r); err != nil {
+		return err
+	} else if req.packetId == 0 {
+		return errors.New("Unsubscribe packet identifier must not be 0.")
+	}
+
+	if err := req.prop.decode(r); err != nil {
+		return err
+	}
+
+	for r.Len() > 0 {
+		var filter UTF8String
+		if err := filter.Decode(r); err != nil {
+			return errors.New("Unable to parse topic filter, err:" + err.Error())
+		}
+		req.filters = append(req.filters, filter)
+	}
+
+	if len(req.filters) == 0 {
+		return errors.New("Unsubscribe packet must contain at least one topic filter.")
+	}
+	req.reasons = make([]ReasonCode, len(req.filters))
+
+	return nil
+}
+
+func (req *UnsubscribeRequest) encode() (*bytes.Buffer, error) {
+	w := bytes.NewBuffer(make([]byte, 0))
+
+	req.packetId.Encode(w)
+
+	if err := writeProperties(w, &req.prop); err != nil {
+		return nil, err
+	}
+
+	for _, filter := range req.filters {
+		if err := filter.Encode(w); err != nil {
+			return nil, errors.New("Unable to encode topic filter, err:" + err.Error())
+		}
+	}
+
+	return w, nil
+}
+
+func (req *UnsubscribeRequest) Type() CType {
+	return UNSUBSCRIBE
+}
+
+func (req *UnsubscribeRequest) WriteTo(w io.Writer) (int64, error) {
+	body, err := req.encode()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, UNSUBSCRIBE, Flag{qos: QoS1}, body)
+}
+
+func (req *UnsubscribeRequest) Encode(w io.Writer) error {
+	_, err := req.WriteTo(w)
+	return err
+}
+
+func (req *UnsubscribeRequest) Decode(r io.Reader) error {
+	return decodePacket(r, req)
+}
+
+func (req *UnsubscribeRequest) ToString() string {
+	return fmt.Sprintf("packet: UNSUBSCRIBE, packId: %d, filters: %v", req.packetId, req.filters)
+}
+
+// SetReason sets the reason code answered for the topic filter at index i,
+// Success unless set.
+func (req *UnsubscribeRequest) SetReason(i int, rc ReasonCode) {
+	req.reasons[i] = rc
+}
+
+// Unsuback returns the UNSUBACK answering the UNSUBSCRIBE with the reason code
+// of each topic filter.
+func (req *UnsubscribeRequest) Unsuback() *UnsubackResponse {
+	return NewUnsuback(req.PacketId(), req.reasons...)
+}
+
+func (req *UnsubscribeRequest) ResponseTo(w io.Writer) (int64, error) {
+	return req.Unsuback().WriteTo(w)
+}
+
+// UnsubackResponse carries a reason code for each topic filter of an
+// UNSUBSCRIBE, in the same order.
+type UnsubackResponse struct {
+	packetId TwoByteInteger
+	prop     AckProperties
+	reasons  []ReasonCode
+}
+
+func NewUnsuback(packetId uint16, reasons ...ReasonCode) *UnsubackResponse {
+	return &UnsubackResponse{packetId: TwoByteInteger(packetId), reasons: reasons}
+}
+
+func (ack *UnsubackResponse) PacketId() uint16 {
+	return uint16(ack.packetId)
+}
+
+func (ack *UnsubackResponse) Reasons() []ReasonCode {
+	return ack.reasons
+}
+
+func (ack *UnsubackResponse) decode(h *MqttHeader, r *bytes.Buffer) error {
+	if h.flag != (Flag{}) {
+		return errors.New("Invalid unsuback fixed header flags.")
+	}
+	return decodeReasons(r, &ack.packetId, &ack.prop, &ack.reasons)
+}
+
+func (ack *UnsubackResponse) Type() CType {
+	return UNSUBACK
+}
+
+func (ack *UnsubackResponse) properties() propertySet {
+	return &ack.prop
+}
+
+func (ack *UnsubackResponse) WriteTo(w io.Writer) (int64, error) {
+	body, err := encodeReasons(ack.packetId, &ack.prop, ack.reasons)
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(w, UNSUBACK, Flag{}, body)
+}
+
+func (ack *UnsubackResponse) Encode(w io.Writer) error {
+	_, err := ack.WriteTo(w)
+	return err
+}
+
+func (ack *UnsubackResponse) Decode(r io.Reader) error {
+	return decodePacket(r, ack)
+}
+
+func (ack *UnsubackResponse) ToString() string {
+	return fmt.Sprintf("packet: UNSUBACK, packId: %d, reasons: %v", ack.packetId, ack.reasons)
+}
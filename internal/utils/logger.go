@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"sync"
 )
 
 type level int
@@ -75,17 +76,17 @@ type logger struct {
 }
 
 var gLogger *logger = nil
+var gLoggerOnce sync.Once
 
 func InitLogger() {
-	if gLogger != nil {
-		return
-	}
-	gLogger = &logger{c: make(chan logMsg)}
-	go func() {
-		for msg := range gLogger.c {
-			msgHandle(msg)
-		}
-	}()
+	gLoggerOnce.Do(func() {
+		gLogger = &logger{c: make(chan logMsg)}
+		go func() {
+			for msg := range gLogger.c {
+				msgHandle(msg)
+			}
+		}()
+	})
 }
 
 func LogDebug(v ...any) {
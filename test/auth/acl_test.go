@@ -0,0 +1,142 @@
+package test
+
+import (
+	"goker/internal/auth"
+	"strings"
+	"testing"
+)
+
+func TestACLFirstMatchingRule(t *testing.T) {
+	acl := auth.NewACL(false,
+		auth.Rule{Allow: false, Actions: auth.Publish, Filter: "devices/+/config"},
+		auth.Rule{Allow: true, Actions: auth.AllActions, Filter: "devices/#"},
+		auth.Rule{Allow: true, Actions: auth.Receive, Filter: "admin/#", Username: "root"},
+	)
+	alice := auth.Identity{Username: "alice", ClientId: "a1"}
+	root := auth.Identity{Username: "root", ClientId: "r1"}
+
+	cases := []struct {
+		id     auth.Identity
+		action auth.Action
+		topic  string
+		allow  bool
+	}{
+		{alice, auth.Publish, "devices/1/state", true},
+		{alice, auth.Publish, "devices/1/config", false},
+		{alice, auth.Receive, "devices/1/config", true},
+		{alice, auth.Receive, "admin/log", false},
+		{root, auth.Receive, "admin/log", true},
+		{root, auth.Publish, "admin/log", false},
+		{alice, auth.Publish, "other", false},
+	}
+	for _, c := range cases {
+		if acl.Authorize(c.id, c.action, c.topic) != c.allow {
+			t.Errorf("Expected %v for %s on %s", c.allow, c.id.Username, c.topic)
+		}
+	}
+
+	if !auth.NewACL(true).Authorize(alice, auth.Publish, "other") {
+		t.Error("Expected default to allow")
+	}
+}
+
+func TestACLSubstitution(t *testing.T) {
+	acl := auth.NewACL(false,
+		auth.Rule{Allow: true, Actions: auth.AllActions, Filter: "users/%u/#"},
+		auth.Rule{Allow: true, Actions: auth.Publish, Filter: "clients/%c/status"},
+	)
+	alice := auth.Identity{Username: "alice", ClientId: "a1"}
+
+	if !acl.Authorize(alice, auth.Publish, "users/alice/inbox") {
+		t.Error("Expected user name to be substituted")
+	} else if acl.Authorize(alice, auth.Publish, "users/bob/inbox") {
+		t.Error("Expected topics of other users to be denied")
+	} else if !acl.Authorize(alice, auth.Publish, "clients/a1/status") {
+		t.Error("Expected client identifier to be substituted")
+	}
+
+	if acl.Authorize(auth.Identity{Username: "#", ClientId: "x"}, auth.Publish, "users/bob/inbox") {
+		t.Error("Expected wildcard user name not to widen the rule")
+	} else if acl.Authorize(auth.Identity{ClientId: "x"}, auth.Publish, "users//inbox") {
+		t.Error("Expected anonymous client not to match user name rules")
+	}
+}
+
+func TestACLSubscribeCoverage(t *testing.T) {
+	acl := auth.NewACL(false, auth.Rule{Allow: true, Actions: auth.Subscribe, Filter: "sensors/+/temp"})
+	id := auth.Identity{Username: "alice", ClientId: "a1"}
+
+	for filter, allow := range map[string]bool{
+		"sensors/+/temp":          true,
+		"sensors/1/temp":          true,
+		"sensors/#":               false,
+		"sensors/+/+":             false,
+		"sensors/1/temp/":         false,
+		"#":                       false,
+		"$share/g/sensors/+/temp": true,
+		"$share/g/sensors/#":      false,
+	} {
+		if acl.Authorize(id, auth.Subscribe, filter) != allow {
+			t.Errorf("Expected subscribe to %s to be %v", filter, allow)
+		}
+	}
+}
+
+func TestACLSubscribeDenyOverlap(t *testing.T) {
+	acl := auth.NewACL(true,
+		auth.Rule{Allow: false, Actions: auth.Subscribe, Filter: "secret/#"},
+		auth.Rule{Allow: false, Actions: auth.Subscribe, Filter: "+/private"},
+	)
+	id := auth.Identity{Username: "alice", ClientId: "a1"}
+
+	for filter, allow := range map[string]bool{
+		"secret/#":          false,
+		"secret":            false,
+		"#":                 false,
+		"+/x":               false,
+		"+/+/y":             false,
+		"+":                 false,
+		"$share/g/#":        false,
+		"home/private":      false,
+		"home/+":            false,
+		"home/#":            false,
+		"public/x/#":        true,
+		"public/+/x":        true,
+		"home/public":       true,
+		"$share/g/public/x": true,
+	} {
+		if acl.Authorize(id, auth.Subscribe, filter) != allow {
+			t.Errorf("Expected subscribe to %s to be %v", filter, allow)
+		}
+	}
+}
+
+func TestParseACL(t *testing.T) {
+	acl, err := auth.ParseACL(strings.NewReader(`
+# Everyone may use their own tree.
+default deny
+allow all users/%u/#
+deny subscribe # client spy
+allow receive # user root
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := auth.Identity{Username: "root", ClientId: "spy"}
+	if !acl.Authorize(root, auth.Publish, "users/root/a") {
+		t.Error("Expected user tree to be allowed")
+	} else if acl.Authorize(root, auth.Subscribe, "#") {
+		t.Error("Expected client spy not to subscribe to everything")
+	} else if !acl.Authorize(root, auth.Receive, "users/alice/a") {
+		t.Error("Expected root to receive everything")
+	} else if acl.Authorize(root, auth.Publish, "other") {
+		t.Error("Expected default to deny")
+	}
+
+	for _, rules := range []string{"allow", "permit all #", "allow write #", "allow all a/#/b", "allow all # user", "allow all # group x"} {
+		if _, err = auth.ParseACL(strings.NewReader(rules)); err == nil {
+			t.Error("Missing malformed rule case:", rules)
+		}
+	}
+}
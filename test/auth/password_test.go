@@ -0,0 +1,151 @@
+package test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"goker/internal/auth"
+	"goker/internal/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+
+	f, err := auth.LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Set("alice", []byte("wonderland")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = auth.LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Authenticate("alice", []byte("wonderland"), nil); err != nil {
+		t.Error(err)
+	}
+	if err = f.Authenticate("alice", []byte("looking-glass"), nil); protocol.ReasonOf(err, protocol.Unspecified) != protocol.BadUsernamePassword {
+		t.Error("Expected Bad User Name or Password, got", err)
+	}
+	if err = f.Authenticate("bob", []byte("wonderland"), nil); protocol.ReasonOf(err, protocol.Unspecified) != protocol.BadUsernamePassword {
+		t.Error("Expected Bad User Name or Password for unknown user, got", err)
+	}
+
+	if err = f.Set("bad:name", []byte("x")); err == nil {
+		t.Error("Missing user name containing ':' case")
+	}
+	if err = f.Set("bad\nname", []byte("x")); err == nil {
+		t.Error("Missing user name containing a newline case")
+	}
+}
+
+func TestPasswordFileScram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+
+	f, err := auth.LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Set("alice", []byte("wonderland")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = auth.LoadPasswordFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	ex, err := auth.NewRegistry(auth.NewScram(f)).Begin(auth.ScramSHA256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFirst := "n,,n=alice,r=abcdef"
+	serverFirst, _, err := ex.Next([]byte(clientFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFinal, _ := scramClient(t, "wonderland", clientFirst, serverFirst)
+	if _, done, err := ex.Next([]byte(clientFinal)); err != nil || !done {
+		t.Fatal("Expected SCRAM authentication with the password file to succeed, err:", err)
+	} else if ex.Username() != "alice" {
+		t.Error("Expected the exchange to authenticate alice, got", ex.Username())
+	}
+
+	bcrypt, err := auth.HashPassword([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, []byte("dave:"+bcrypt+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Lookup("dave"); ok {
+		t.Error("Expected no SCRAM credential for a user without one")
+	}
+
+	if err = os.WriteFile(path, []byte("dave:"+bcrypt+":SCRAM-SHA-256$4096:c2FsdA==\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Reload(); err == nil {
+		t.Error("Missing malformed SCRAM credential case")
+	}
+}
+
+func TestPasswordFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("secret"), salt, 1, 64*1024, 2, 32)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=65536,t=1,p=2$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	if err := os.WriteFile(path, []byte("# users\ncarol:"+hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := auth.LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Authenticate("carol", []byte("secret"), nil); err != nil {
+		t.Error(err)
+	}
+
+	bcrypt, err := auth.HashPassword([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, []byte("dave:"+bcrypt+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Authenticate("dave", []byte("hunter2"), nil); err != nil {
+		t.Error(err)
+	}
+	if err = f.Authenticate("carol", []byte("secret"), nil); err == nil {
+		t.Error("Expected user removed from the file to be rejected after reload")
+	}
+
+	if err = os.WriteFile(path, []byte("malformed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Reload(); err == nil {
+		t.Error("Missing malformed password file case")
+	}
+	if err = f.Authenticate("dave", []byte("hunter2"), nil); err != nil {
+		t.Error("Expected users to be kept when reload fails, err:", err)
+	}
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"goker/internal/auth"
+	"goker/internal/protocol"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func scramHmac(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramClient plays the client side of SCRAM-SHA-256 and returns the client
+// final message along with the server signature it expects.
+func scramClient(t *testing.T, password string, clientFirst string, serverFirst []byte) (string, string) {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(string(serverFirst), ",") {
+		attrs[part[:1]] = part[2:]
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iter, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := scramHmac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + attrs["r"]
+	authMessage := strings.TrimPrefix(clientFirst, "n,,") + "," + string(serverFirst) + "," + withoutProof
+	signature := scramHmac(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+
+	verifier := scramHmac(scramHmac(salted, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey),
+		"v=" + base64.StdEncoding.EncodeToString(verifier)
+}
+
+func scramRegistry(t *testing.T) *auth.Registry {
+	cred, err := auth.NewScramCredential("secret", []byte("saltsaltsaltsalt"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := auth.NewScramCredentials()
+	creds.Set("user", cred)
+	return auth.NewRegistry(auth.NewScram(creds))
+}
+
+func TestScramExchange(t *testing.T) {
+	r := scramRegistry(t)
+
+	ex, err := r.Begin(auth.ScramSHA256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFirst := "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"
+	serverFirst, done, err := ex.Next([]byte(clientFirst))
+	if err != nil || done {
+		t.Fatal("Expected server first message, err:", err)
+	} else if !strings.HasPrefix(string(serverFirst), "r=fyko+d2lbbFgONRv9qkxdawL") {
+		t.Error("Expected server nonce to extend client nonce, got", string(serverFirst))
+	}
+
+	clientFinal, verifier := scramClient(t, "secret", clientFirst, serverFirst)
+	serverFinal, done, err := ex.Next([]byte(clientFinal))
+	if err != nil || !done {
+		t.Fatal("Expected authentication to succeed, err:", err)
+	} else if string(serverFinal) != verifier {
+		t.Error("Expected server signature", verifier, "got", string(serverFinal))
+	}
+	if ex.Username() != "user" {
+		t.Error("Expected the exchange to authenticate user, got", ex.Username())
+	}
+}
+
+func TestScramCredentialEncoding(t *testing.T) {
+	cred, err := auth.NewScramCredential("secret", []byte("saltsaltsaltsalt"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := auth.ParseScramCredential(cred.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != cred.String() || parsed.Iterations != 4096 {
+		t.Error("Expected credential to survive encoding, got", parsed.String())
+	}
+
+	for _, s := range []string{"SCRAM-SHA-1$4096:c2FsdA==$a:b", "SCRAM-SHA-256$x:c2FsdA==$a:b", "SCRAM-SHA-256$4096:c2FsdA=="} {
+		if _, err = auth.ParseScramCredential(s); err == nil {
+			t.Error("Missing malformed credential case", s)
+		}
+	}
+}
+
+func TestScramWrongPassword(t *testing.T) {
+	r := scramRegistry(t)
+
+	ex, _ := r.Begin(auth.ScramSHA256, nil)
+	clientFirst := "n,,n=user,r=abcdef"
+	serverFirst, _, err := ex.Next([]byte(clientFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientFinal, _ := scramClient(t, "guess", clientFirst, serverFirst)
+	if _, _, err = ex.Next([]byte(clientFinal)); protocol.ReasonOf(err, protocol.Unspecified) != protocol.NotAuthorized {
+		t.Error("Expected Not Authorized, got", err)
+	}
+
+	// An unknown user fails at the proof, with a salt which does not change
+	// between attempts, as for a known user.
+	var salts []string
+	for range 2 {
+		ex, _ = r.Begin(auth.ScramSHA256, nil)
+		clientFirst = "n,,n=nobody,r=abcdef"
+		if serverFirst, _, err = ex.Next([]byte(clientFirst)); err != nil {
+			t.Fatal("Expected server first message for unknown user, err:", err)
+		}
+		salts = append(salts, strings.Split(string(serverFirst), ",")[1])
+		clientFinal, _ = scramClient(t, "guess", clientFirst, serverFirst)
+		if _, _, err = ex.Next([]byte(clientFinal)); protocol.ReasonOf(err, protocol.Unspecified) != protocol.NotAuthorized || err.Error() != "SCRAM authentication failed." {
+			t.Error("Expected Not Authorized for unknown user, got", err)
+		}
+	}
+	if salts[0] != salts[1] {
+		t.Error("Expected the same salt for unknown user, got", salts)
+	}
+
+	ex, _ = r.Begin(auth.ScramSHA256, nil)
+	if _, _, err = ex.Next([]byte("p=tls-unique,,n=user,r=abcdef")); err == nil {
+		t.Error("Missing channel binding case")
+	}
+}
+
+func TestUnknownAuthenticationMethod(t *testing.T) {
+	r := scramRegistry(t)
+
+	if _, err := r.Begin("KERBEROS", nil); protocol.ReasonOf(err, protocol.Unspecified) != protocol.BadAuthenticationMethod {
+		t.Error("Expected Bad Authentication Method, got", err)
+	}
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"goker/internal/auth"
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func aclBroker() *broker.Broker {
+	cfg := broker.DefaultConfig()
+	cfg.ACL = auth.NewACL(false,
+		auth.Rule{Allow: true, Actions: auth.AllActions, Filter: "users/%u/#"},
+		auth.Rule{Allow: true, Actions: auth.Receive, Filter: "news/secret", Username: "admin"},
+		auth.Rule{Allow: false, Actions: auth.Receive, Filter: "news/secret"},
+		auth.Rule{Allow: true, Actions: auth.Subscribe | auth.Receive, Filter: "news/#"},
+		auth.Rule{Allow: true, Actions: auth.Publish, Filter: "news/#", Username: "admin"},
+	)
+	return broker.NewBroker(cfg)
+}
+
+func TestBrokerACLPublish(t *testing.T) {
+	b := aclBroker()
+
+	sub := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "sub", UsernameFlag: true, Username: "alice", Properties: &packets.Properties{}}, sub)
+	subscribe(t, b, s, sub, packets.SubOptions{Topic: "news/#", QoS: 1})
+
+	pub := &conn{}
+	p, _ := connack(t, b, &packets.Connect{ClientID: "pub", UsernameFlag: true, Username: "bob", Properties: &packets.Properties{}}, pub)
+
+	if err := b.Publish(p, publishRequest(t, &packets.Publish{QoS: 1, Topic: "news/today", Payload: []byte("fake")})); err != nil {
+		t.Fatal(err)
+	}
+	recv := pub.packets(t)
+	if len(recv) != 1 || recv[0].Type != packets.PUBACK {
+		t.Fatal("Expected PUBACK, got", recv)
+	} else if rc := recv[0].Content.(*packets.Puback).ReasonCode; rc != byte(protocol.NotAuthorized) {
+		t.Errorf("Expected reason %x, got %x", protocol.NotAuthorized, rc)
+	}
+	if len(sub.packets(t)) != 0 {
+		t.Error("Expected denied message not to be routed")
+	}
+
+	if err := b.Publish(p, publishRequest(t, &packets.Publish{PacketID: 2, QoS: 2, Topic: "news/today", Payload: []byte("fake")})); err != nil {
+		t.Fatal(err)
+	}
+	recv = pub.packets(t)
+	if len(recv) != 1 || recv[0].Type != packets.PUBREC {
+		t.Fatal("Expected PUBREC, got", recv)
+	} else if rc := recv[0].Content.(*packets.Pubrec).ReasonCode; rc != byte(protocol.NotAuthorized) {
+		t.Errorf("Expected reason %x, got %x", protocol.NotAuthorized, rc)
+	}
+
+	if err := b.Publish(p, publishRequest(t, &packets.Publish{QoS: 1, Topic: "users/bob/notes", Payload: []byte("mine")})); err != nil {
+		t.Fatal(err)
+	}
+	if rc := pub.packets(t)[0].Content.(*packets.Puback).ReasonCode; rc >= byte(protocol.Unspecified) {
+		t.Errorf("Expected own topic to be allowed, got %x", rc)
+	}
+}
+
+func TestBrokerACLSubscribe(t *testing.T) {
+	b := aclBroker()
+
+	c := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "sub", UsernameFlag: true, Username: "alice", Properties: &packets.Properties{}}, c)
+	ack := subscribe(t, b, s, c,
+		packets.SubOptions{Topic: "news/#", QoS: 1},
+		packets.SubOptions{Topic: "users/bob/#", QoS: 1},
+		packets.SubOptions{Topic: "users/alice/#", QoS: 1},
+	)
+	expected := []byte{0x01, 0x87, 0x01}
+	for i, rc := range ack.Reasons {
+		if rc != expected[i] {
+			t.Errorf("Expected reason %x for filter %d, got %x", expected[i], i, rc)
+		}
+	}
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "users/bob/notes", Payload: []byte("private")}))
+	if len(c.packets(t)) != 0 {
+		t.Error("Expected denied subscription not to be registered")
+	}
+}
+
+func TestBrokerACLReceive(t *testing.T) {
+	b := aclBroker()
+
+	alice := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "alice", UsernameFlag: true, Username: "alice", Properties: &packets.Properties{}}, alice)
+	subscribe(t, b, s, alice, packets.SubOptions{Topic: "news/#"})
+
+	admin := &conn{}
+	s, _ = connack(t, b, &packets.Connect{ClientID: "admin", UsernameFlag: true, Username: "admin", Properties: &packets.Properties{}}, admin)
+	subscribe(t, b, s, admin, packets.SubOptions{Topic: "news/#"})
+
+	b.Publish(s, publishRequest(t, &packets.Publish{Topic: "news/secret", Retain: true, Payload: []byte("classified")}))
+	if len(alice.packets(t)) != 0 {
+		t.Error("Expected alice not to receive news/secret")
+	}
+	if len(admin.packets(t)) != 1 {
+		t.Error("Expected admin to receive news/secret")
+	}
+
+	late := &conn{}
+	s, _ = connack(t, b, &packets.Connect{ClientID: "late", UsernameFlag: true, Username: "carol", Properties: &packets.Properties{}}, late)
+	subscribe(t, b, s, late, packets.SubOptions{Topic: "news/#"})
+	if len(late.packets(t)) != 0 {
+		t.Error("Expected retained news/secret not to be sent to carol")
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestBrokerInboundTopicAlias(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.TopicAliasMaximum = 2
+	b := broker.NewBroker(cfg)
+	one, two, three := uint16(1), uint16(2), uint16(3)
+
+	sub := &conn{}
+	s := connect(t, b, "sub", true, 0, sub)
+	subscribe(t, b, s, sub, packets.SubOptions{Topic: "#"})
+
+	pub := &conn{}
+	p, ack := connack(t, b, &packets.Connect{ClientID: "pub", Properties: &packets.Properties{}}, pub)
+	if ack.Properties.TopicAliasMaximum == nil || *ack.Properties.TopicAliasMaximum != 2 {
+		t.Fatal("Expected CONNACK to advertise Topic Alias Maximum 2, got", ack.Properties.TopicAliasMaximum)
+	}
+
+	for _, req := range []*protocol.PublishRequest{
+		publishRequest(t, &packets.Publish{Topic: "fleet/truck-17/gps", Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &one}}),
+		publishRequest(t, &packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &one}}),
+		publishRequest(t, &packets.Publish{Topic: "fleet/truck-17/fuel", Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &one}}),
+		publishRequest(t, &packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &one}}),
+	} {
+		if err := b.Publish(p, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var topics []string
+	for _, pkt := range sub.packets(t) {
+		topics = append(topics, pkt.Content.(*packets.Publish).Topic)
+	}
+	expected := []string{"fleet/truck-17/gps", "fleet/truck-17/gps", "fleet/truck-17/fuel", "fleet/truck-17/fuel"}
+	if len(topics) != len(expected) {
+		t.Fatal("Expected topics", expected, "got", topics)
+	}
+	for i := range expected {
+		if topics[i] != expected[i] {
+			t.Error("Expected topics", expected, "got", topics)
+			break
+		}
+	}
+
+	if err := b.Publish(p, publishRequest(t, &packets.Publish{Topic: "fleet/truck-17/gps", Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &three}})); protocol.ReasonOf(err, protocol.Success) != protocol.TopicAliasInvalid {
+		t.Error("Expected Topic Alias above maximum to be invalid, got", err)
+	}
+	if err := b.Publish(p, publishRequest(t, &packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &two}})); protocol.ReasonOf(err, protocol.Success) != protocol.ProtocolError {
+		t.Error("Expected unmapped Topic Alias to be a Protocol Error, got", err)
+	}
+
+	// Aliases belong to the network connection.
+	p, _ = connack(t, b, &packets.Connect{ClientID: "pub", Properties: &packets.Properties{}}, pub)
+	if err := b.Publish(p, publishRequest(t, &packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &one}})); protocol.ReasonOf(err, protocol.Success) != protocol.ProtocolError {
+		t.Error("Expected Topic Alias of previous connection to be unmapped, got", err)
+	}
+
+	d := broker.NewBroker(broker.DefaultConfig())
+	p = connect(t, d, "pub", true, 0, &conn{})
+	if err := d.Publish(p, publishRequest(t, &packets.Publish{Topic: "fleet/truck-17/gps", Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &one}})); protocol.ReasonOf(err, protocol.Success) != protocol.TopicAliasInvalid {
+		t.Error("Expected Topic Alias to be invalid without maximum, got", err)
+	}
+}
+
+func TestBrokerOutboundTopicAlias(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	max := uint16(2)
+	sub := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "sub", Properties: &packets.Properties{TopicAliasMaximum: &max}}, sub)
+	subscribe(t, b, s, sub, packets.SubOptions{Topic: "#"})
+
+	type sent struct {
+		topic string
+		alias uint16
+	}
+	for _, tc := range []struct {
+		topic    string
+		expected sent
+	}{
+		{"a", sent{"a", 1}},
+		{"a", sent{"", 1}},
+		{"b", sent{"b", 2}},
+		{"a", sent{"", 1}},
+		// b is the least recently used, so its alias is taken over by c.
+		{"c", sent{"c", 2}},
+		{"b", sent{"b", 1}},
+		{"c", sent{"", 2}},
+	} {
+		if err := b.Publish(nil, publishRequest(t, &packets.Publish{Topic: tc.topic, Payload: []byte("x")})); err != nil {
+			t.Fatal(err)
+		}
+		recv := sub.packets(t)
+		if len(recv) != 1 {
+			t.Fatal("Expected a message on", tc.topic, "got", recv)
+		}
+		pub := recv[0].Content.(*packets.Publish)
+		if pub.Properties.TopicAlias == nil || (sent{pub.Topic, *pub.Properties.TopicAlias}) != tc.expected {
+			t.Errorf("Expected message on %s sent as %v, got %q %v", tc.topic, tc.expected, pub.Topic, pub.Properties.TopicAlias)
+		}
+	}
+
+	// Clients without Topic Alias Maximum receive no alias.
+	plain := &conn{}
+	p := connect(t, b, "plain", true, 0, plain)
+	subscribe(t, b, p, plain, packets.SubOptions{Topic: "#"})
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "a", Payload: []byte("x")}))
+	if pub := plain.packets(t)[0].Content.(*packets.Publish); pub.Topic != "a" || pub.Properties.TopicAlias != nil {
+		t.Error("Expected message without Topic Alias, got", pub)
+	}
+}
@@ -0,0 +1,667 @@
+package test
+
+import (
+	"bytes"
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+type conn struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(b)
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *conn) packets(t *testing.T) []*packets.ControlPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pkts []*packets.ControlPacket
+	for c.buf.Len() > 0 {
+		pkt, err := packets.ReadPacket(&c.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+func parsePacket(t *testing.T, p io.WriterTo) protocol.Request {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	p.WriteTo(buf)
+
+	h, err := protocol.ParseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := h.ParseBody(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func connect(t *testing.T, b *broker.Broker, clientId string, cleanStart bool, expiry uint32, c io.WriteCloser) *broker.Session {
+	cp := &packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		ClientID:        clientId,
+		CleanStart:      cleanStart,
+		Properties:      &packets.Properties{SessionExpiryInterval: &expiry},
+	}
+	s := b.Connect(parsePacket(t, cp).(*protocol.ConnectRequest))
+	b.Attach(s, c)
+	return s
+}
+
+func subscribeRequest(t *testing.T, opts ...packets.SubOptions) *protocol.SubscribeRequest {
+	sp := &packets.Subscribe{PacketID: 1, Properties: &packets.Properties{}, Subscriptions: opts}
+	return parsePacket(t, sp).(*protocol.SubscribeRequest)
+}
+
+func subscribe(t *testing.T, b *broker.Broker, s *broker.Session, c *conn, opts ...packets.SubOptions) *packets.Suback {
+	if err := b.Subscribe(s, subscribeRequest(t, opts...)); err != nil {
+		t.Fatal(err)
+	}
+	recv := c.packets(t)
+	if len(recv) == 0 || recv[0].Type != packets.SUBACK {
+		t.Fatal("Expected SUBACK, got", recv)
+	}
+	return recv[0].Content.(*packets.Suback)
+}
+
+// publishRequest parses the PUBLISH, giving it empty Properties when it has
+// none and Packet Identifier 1 when its QoS needs one.
+func publishRequest(t *testing.T, pp *packets.Publish) *protocol.PublishRequest {
+	if pp.Properties == nil {
+		pp.Properties = &packets.Properties{}
+	}
+	if pp.QoS > 0 && pp.PacketID == 0 {
+		pp.PacketID = 1
+	}
+	return parsePacket(t, pp).(*protocol.PublishRequest)
+}
+
+func TestBrokerRouting(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	ca, cb, cc := &conn{}, &conn{}, &conn{}
+	sa := connect(t, b, "a", true, 0, ca)
+	sb := connect(t, b, "b", true, 0, cb)
+	sc := connect(t, b, "c", true, 0, cc)
+
+	subscribe(t, b, sa, ca, packets.SubOptions{Topic: "sensor/+/temp"}, packets.SubOptions{Topic: "sensor/#"})
+	subscribe(t, b, sb, cb, packets.SubOptions{Topic: "sensor/#", NoLocal: true})
+	subscribe(t, b, sc, cc, packets.SubOptions{Topic: "actuator/#"})
+
+	b.Publish(sb, publishRequest(t, &packets.Publish{Topic: "sensor/1/temp", Payload: []byte("21.5")}))
+
+	recv := ca.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected a single copy for overlapping subscriptions, got", len(recv))
+	}
+	pub, ok := recv[0].Content.(*packets.Publish)
+	if !ok || pub.Topic != "sensor/1/temp" || string(pub.Payload) != "21.5" {
+		t.Error("Unexpected message", recv[0])
+	}
+	if len(cb.packets(t)) != 0 {
+		t.Error("Expected No Local subscription to skip the publisher")
+	}
+	if len(cc.packets(t)) != 0 {
+		t.Error("Expected no delivery to non-matching subscription")
+	}
+
+	b.Detach(sa)
+	b.Publish(sb, publishRequest(t, &packets.Publish{Topic: "sensor/1/temp", Payload: []byte("22.0")}))
+	if len(ca.packets(t)) != 0 {
+		t.Error("Expected no delivery after disconnect")
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	ca, cb := &conn{}, &conn{}
+	sa := connect(t, b, "a", true, 0, ca)
+	sb := connect(t, b, "b", true, 0, cb)
+	subscribe(t, b, sa, ca, packets.SubOptions{Topic: "sensor/#"}, packets.SubOptions{Topic: "$share/g/jobs/#"})
+
+	up := &packets.Unsubscribe{PacketID: 4, Topics: []string{"sensor/#", "$share/g/jobs/#", "other/#"}, Properties: &packets.Properties{}}
+	if err := b.Unsubscribe(sa, parsePacket(t, up).(*protocol.UnsubscribeRequest)); err != nil {
+		t.Fatal(err)
+	}
+	recv := ca.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected UNSUBACK, got", len(recv))
+	}
+	ack, ok := recv[0].Content.(*packets.Unsuback)
+	if !ok || ack.PacketID != 4 {
+		t.Fatal("Expected UNSUBACK, got", recv[0])
+	} else if !bytes.Equal(ack.Reasons, []byte{0, 0, byte(protocol.NoSubscriptionExisted)}) {
+		t.Error("Expected No Subscription Existed for the unknown filter only, got", ack.Reasons)
+	}
+
+	b.Publish(sb, publishRequest(t, &packets.Publish{Topic: "sensor/1", Payload: []byte("x")}))
+	b.Publish(sb, publishRequest(t, &packets.Publish{Topic: "jobs/1", Payload: []byte("x")}))
+	if recv = ca.packets(t); len(recv) != 0 {
+		t.Error("Expected no delivery after UNSUBSCRIBE, got", len(recv))
+	}
+}
+
+func TestBrokerConcurrentPublish(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	sub := &conn{}
+	s := connect(t, b, "sub", true, 0, sub)
+	subscribe(t, b, s, sub, packets.SubOptions{Topic: "load/#"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		pub := connect(t, b, string(rune('a'+i)), true, 0, &conn{})
+		req := publishRequest(t, &packets.Publish{Topic: "load/test", Payload: []byte("payload")})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				b.Publish(pub, req)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(sub.packets(t)); n != 8*50 {
+		t.Error("Expected", 8*50, "messages, got", n)
+	}
+}
+
+func TestBrokerSessionTakeover(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	old := &conn{}
+	s := connect(t, b, "dup", true, 0, old)
+	subscribe(t, b, s, old, packets.SubOptions{Topic: "a"})
+
+	cur := &conn{}
+	connect(t, b, "dup", true, 0, cur)
+	if !old.closed {
+		t.Error("Expected previous connection to be closed")
+	}
+	pkts := old.packets(t)
+	if len(pkts) != 1 || pkts[0].Type != packets.DISCONNECT {
+		t.Fatal("Expected DISCONNECT before closing previous connection")
+	} else if rc := pkts[0].Content.(*packets.Disconnect).ReasonCode; rc != byte(protocol.SessionTakenOver) {
+		t.Errorf("Expected reason %x, got %x", protocol.SessionTakenOver, rc)
+	}
+
+	b.Detach(s)
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "a", Payload: []byte("x")}))
+	if len(old.packets(t))+len(cur.packets(t)) != 0 {
+		t.Error("Expected subscriptions of the previous session to be discarded")
+	}
+}
+
+func TestBrokerSlowTakeover(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.WriteTimeout = 500 * time.Millisecond
+	b := broker.NewBroker(cfg)
+
+	// Nothing reads the previous connection, so its DISCONNECT cannot be
+	// written.
+	stuck, peer := net.Pipe()
+	defer peer.Close()
+	connect(t, b, "dup", true, 0, stuck)
+
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "dup", CleanStart: true, Properties: &packets.Properties{}}
+	req := parsePacket(t, cp).(*protocol.ConnectRequest)
+	done := make(chan struct{})
+	go func() {
+		b.Attach(b.Connect(req), &conn{})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	c := &conn{}
+	s := connect(t, b, "other", true, 0, c)
+	subscribe(t, b, s, c, packets.SubOptions{Topic: "a"})
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Error("Expected the broker not to wait for the DISCONNECT of the previous connection, took", elapsed)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the takeover to give up on the DISCONNECT after the write timeout")
+	}
+}
+
+func TestBrokerSlowSubscriber(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.WriteTimeout = 200 * time.Millisecond
+	b := broker.NewBroker(cfg)
+
+	stuck, peer := net.Pipe()
+	defer peer.Close()
+	slow := connect(t, b, "slow", true, 0, stuck)
+	req := subscribeRequest(t, packets.SubOptions{Topic: "a"})
+	go b.Subscribe(slow, req)
+	if _, err := packets.ReadPacket(peer); err != nil {
+		t.Fatal("Expected a SUBACK, got", err)
+	}
+
+	// The subscriber stops reading, so the message cannot be written to it.
+	pc := &conn{}
+	pub := connect(t, b, "pub", true, 0, pc)
+	done := make(chan struct{})
+	go func() {
+		b.Publish(pub, publishRequest(t, &packets.Publish{Topic: "a", Payload: []byte("hello")}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the publisher not to wait for a subscriber which does not read")
+	}
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Expected the connection of the subscriber to be closed, got", err)
+	}
+}
+
+func ackRequest(t *testing.T, packetId uint16) *protocol.AckRequest {
+	pa := &packets.Puback{PacketID: packetId, Properties: &packets.Properties{}}
+	return parsePacket(t, pa).(*protocol.AckRequest)
+}
+
+func TestBrokerQoS1Inflight(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	first := &conn{}
+	s := connect(t, b, "dev", true, 0, first)
+	subscribe(t, b, s, first, packets.SubOptions{Topic: "cmd/#", QoS: 1}, packets.SubOptions{Topic: "log", QoS: 0})
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/1", Payload: []byte("one")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/2", Payload: []byte("two")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "log", Payload: []byte("downgraded")}))
+
+	recv := first.packets(t)
+	if len(recv) != 3 {
+		t.Fatal("Expected 3 messages, got", len(recv))
+	}
+	ids := make([]uint16, 0)
+	for _, pkt := range recv[:2] {
+		pub := pkt.Content.(*packets.Publish)
+		if pub.QoS != 1 || pub.PacketID == 0 || pub.Duplicate {
+			t.Error("Expected fresh QoS 1 message with packet identifier, got", pub)
+		}
+		ids = append(ids, pub.PacketID)
+	}
+	if ids[0] == ids[1] {
+		t.Error("Expected distinct packet identifiers, got", ids)
+	}
+	if pub := recv[2].Content.(*packets.Publish); pub.QoS != 0 {
+		t.Error("Expected QoS downgraded to the granted QoS 0, got", pub.QoS)
+	}
+	if s.Inflight() != 2 {
+		t.Error("Expected 2 messages in flight, got", s.Inflight())
+	}
+
+	b.Acknowledge(s, ackRequest(t, ids[0]))
+	if s.Inflight() != 1 {
+		t.Error("Expected 1 message in flight, got", s.Inflight())
+	}
+
+	second := &conn{}
+	resumed := connect(t, b, "dev", false, 0, second)
+	if !first.closed {
+		t.Error("Expected previous connection to be closed")
+	}
+	recv = second.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected 1 redelivered message, got", len(recv))
+	}
+	pub := recv[0].Content.(*packets.Publish)
+	if !pub.Duplicate || pub.PacketID != ids[1] || string(pub.Payload) != "two" {
+		t.Error("Expected redelivery of packet", ids[1], "with DUP flag, got", pub)
+	}
+
+	b.Acknowledge(resumed, ackRequest(t, ids[1]))
+	if resumed.Inflight() != 0 {
+		t.Error("Expected no message in flight, got", resumed.Inflight())
+	}
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/3", Payload: []byte("three")}))
+	if len(second.packets(t)) != 1 {
+		t.Error("Expected subscriptions to survive the reconnect")
+	}
+}
+
+func TestBrokerQoS2Inbound(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	sub := &conn{}
+	ss := connect(t, b, "sub", true, 0, sub)
+	subscribe(t, b, ss, sub, packets.SubOptions{Topic: "billing/#", QoS: 2})
+
+	pub := &conn{}
+	ps := connect(t, b, "pub", true, 0, pub)
+	b.Publish(ps, publishRequest(t, &packets.Publish{PacketID: 5, QoS: 2, Topic: "billing/1", Payload: []byte("42")}))
+	b.Publish(ps, publishRequest(t, &packets.Publish{PacketID: 5, QoS: 2, Topic: "billing/1", Payload: []byte("42")}))
+	if n := len(sub.packets(t)); n != 1 {
+		t.Error("Expected duplicate QoS 2 message to be delivered once, got", n)
+	}
+	for _, pkt := range pub.packets(t) {
+		if rec, ok := pkt.Content.(*packets.Pubrec); !ok || rec.PacketID != 5 || rec.ReasonCode != 0 {
+			t.Error("Expected PUBREC with Success for every copy, got", pkt)
+		}
+	}
+
+	b.Acknowledge(ps, parsePacket(t, &packets.Pubrel{PacketID: 5, Properties: &packets.Properties{}}).(*protocol.AckRequest))
+	b.Acknowledge(ps, parsePacket(t, &packets.Pubrel{PacketID: 5, Properties: &packets.Properties{}}).(*protocol.AckRequest))
+	recv := pub.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected 2 PUBCOMP, got", len(recv))
+	}
+	if comp := recv[0].Content.(*packets.Pubcomp); comp.PacketID != 5 || comp.ReasonCode != 0 {
+		t.Error("Expected PUBCOMP with Success, got", comp)
+	}
+	if comp := recv[1].Content.(*packets.Pubcomp); comp.PacketID != 5 || comp.ReasonCode != 0x92 {
+		t.Error("Expected PUBCOMP with Packet Identifier Not Found, got", comp)
+	}
+
+	b.Publish(ps, publishRequest(t, &packets.Publish{PacketID: 5, QoS: 2, Topic: "billing/1", Payload: []byte("43")}))
+	if n := len(sub.packets(t)); n != 1 {
+		t.Error("Expected released packet identifier to be reusable, got", n)
+	}
+}
+
+func TestBrokerQoS2Outbound(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	first := &conn{}
+	s := connect(t, b, "dev", true, 0, first)
+	subscribe(t, b, s, first, packets.SubOptions{Topic: "billing/#", QoS: 2})
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{PacketID: 1, QoS: 2, Topic: "billing/1", Payload: []byte("a")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{PacketID: 2, QoS: 2, Topic: "billing/2", Payload: []byte("b")}))
+	recv := first.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected 2 messages, got", len(recv))
+	}
+	idA := recv[0].Content.(*packets.Publish).PacketID
+	idB := recv[1].Content.(*packets.Publish).PacketID
+
+	b.Acknowledge(s, parsePacket(t, &packets.Pubrec{PacketID: idA, Properties: &packets.Properties{}}).(*protocol.AckRequest))
+	b.Acknowledge(s, parsePacket(t, &packets.Pubrec{PacketID: 999, Properties: &packets.Properties{}}).(*protocol.AckRequest))
+	recv = first.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected 2 PUBREL, got", len(recv))
+	}
+	if rel := recv[0].Content.(*packets.Pubrel); rel.PacketID != idA || rel.ReasonCode != 0 {
+		t.Error("Expected PUBREL with Success, got", rel)
+	}
+	if rel := recv[1].Content.(*packets.Pubrel); rel.PacketID != 999 || rel.ReasonCode != 0x92 {
+		t.Error("Expected PUBREL with Packet Identifier Not Found, got", rel)
+	}
+
+	second := &conn{}
+	s = connect(t, b, "dev", false, 0, second)
+	recv = second.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected 2 retransmissions, got", len(recv))
+	}
+	if rel, ok := recv[0].Content.(*packets.Pubrel); !ok || rel.PacketID != idA {
+		t.Error("Expected PUBREL retransmission for released message, got", recv[0])
+	}
+	if pub, ok := recv[1].Content.(*packets.Publish); !ok || pub.PacketID != idB || !pub.Duplicate {
+		t.Error("Expected PUBLISH retransmission with DUP flag, got", recv[1])
+	}
+
+	b.Acknowledge(s, parsePacket(t, &packets.Pubcomp{PacketID: idA, Properties: &packets.Properties{}}).(*protocol.AckRequest))
+	b.Acknowledge(s, parsePacket(t, &packets.Pubrec{PacketID: idB, ReasonCode: 0x80, Properties: &packets.Properties{}}).(*protocol.AckRequest))
+	if s.Inflight() != 0 {
+		t.Error("Expected no message in flight, got", s.Inflight())
+	}
+}
+
+func connack(t *testing.T, b *broker.Broker, cp *packets.Connect, c *conn) (*broker.Session, *packets.Connack) {
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 5
+	req := parsePacket(t, cp).(*protocol.ConnectRequest)
+	s := b.Connect(req)
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if _, err := req.ResponseTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Attach(s, c)
+	return s, recv.Content.(*packets.Connack)
+}
+
+func TestBrokerPersistentSession(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	expiry := uint32(60)
+
+	first := &conn{}
+	s, ack := connack(t, b, &packets.Connect{ClientID: "dev", CleanStart: true, Properties: &packets.Properties{SessionExpiryInterval: &expiry}}, first)
+	if ack.SessionPresent {
+		t.Error("Expected no session present for a new session")
+	}
+	subscribe(t, b, s, first, packets.SubOptions{Topic: "cmd/#", QoS: 1})
+	b.Detach(s)
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/1", Payload: []byte("one")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "cmd/2", Payload: []byte("dropped")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/3", Payload: []byte("three")}))
+	if s.Queued() != 2 {
+		t.Error("Expected 2 queued messages, got", s.Queued())
+	}
+
+	second := &conn{}
+	s, ack = connack(t, b, &packets.Connect{ClientID: "dev", Properties: &packets.Properties{SessionExpiryInterval: &expiry}}, second)
+	if !ack.SessionPresent {
+		t.Error("Expected session present when resuming a session")
+	}
+	recv := second.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected 2 queued messages, got", len(recv))
+	}
+	for i, payload := range []string{"one", "three"} {
+		pub := recv[i].Content.(*packets.Publish)
+		if string(pub.Payload) != payload || pub.Duplicate || pub.PacketID == 0 {
+			t.Error("Expected queued message", payload, ", got", pub)
+		}
+	}
+
+	b.Detach(s)
+	third := &conn{}
+	s, ack = connack(t, b, &packets.Connect{ClientID: "dev", CleanStart: true, Properties: &packets.Properties{}}, third)
+	if ack.SessionPresent {
+		t.Error("Expected Clean Start to discard the session")
+	}
+	if s.Inflight() != 0 {
+		t.Error("Expected no message in flight after Clean Start, got", s.Inflight())
+	}
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/4", Payload: []byte("four")}))
+	if len(third.packets(t)) != 0 {
+		t.Error("Expected subscriptions to be discarded by Clean Start")
+	}
+}
+
+func TestBrokerSessionExpiry(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	expiry := uint32(1)
+
+	c := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "dev", CleanStart: true, Properties: &packets.Properties{SessionExpiryInterval: &expiry}}, c)
+	subscribe(t, b, s, c, packets.SubOptions{Topic: "cmd/#", QoS: 1})
+	b.Detach(s)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	c = &conn{}
+	_, ack := connack(t, b, &packets.Connect{ClientID: "dev", Properties: &packets.Properties{}}, c)
+	if ack.SessionPresent {
+		t.Error("Expected session to be expired")
+	}
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/1", Payload: []byte("one")}))
+	if len(c.packets(t)) != 0 {
+		t.Error("Expected subscriptions of the expired session to be discarded")
+	}
+}
+
+func TestBrokerDisconnectSessionExpiry(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	zero, expiry := uint32(0), uint32(60)
+	update := func() *protocol.DisconnectRequest {
+		dp := &packets.Disconnect{Properties: &packets.Properties{SessionExpiryInterval: &expiry}}
+		return parsePacket(t, dp).(*protocol.DisconnectRequest)
+	}
+
+	s, _ := connack(t, b, &packets.Connect{ClientID: "dev", CleanStart: true, Properties: &packets.Properties{SessionExpiryInterval: &zero}}, &conn{})
+	if err := b.Disconnect(s, update()); protocol.ReasonOf(err, protocol.Unspecified) != protocol.ProtocolError {
+		t.Error("Expected Protocol Error when Session Expiry Interval was 0 on CONNECT, got", err)
+	}
+	b.Detach(s)
+
+	expiry = 60
+	s, _ = connack(t, b, &packets.Connect{ClientID: "tmp", CleanStart: true, Properties: &packets.Properties{SessionExpiryInterval: &expiry}}, &conn{})
+	expiry = 0
+	b.Disconnect(s, update())
+	b.Detach(s)
+	_, ack := connack(t, b, &packets.Connect{ClientID: "tmp", Properties: &packets.Properties{}}, &conn{})
+	if ack.SessionPresent {
+		t.Error("Expected session to be discarded after Session Expiry Interval set to 0 on DISCONNECT")
+	}
+}
+
+func TestBrokerAssignedClientIdentifier(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	s, ack := connack(t, b, &packets.Connect{CleanStart: true, Properties: &packets.Properties{}}, &conn{})
+	if ack.Properties.AssignedClientID == "" || ack.Properties.AssignedClientID != s.ClientId() {
+		t.Error("Expected assigned client identifier in CONNACK, got", ack.Properties.AssignedClientID)
+	}
+}
+
+func TestBrokerServerKeepAlive(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	_, ack := connack(t, b, &packets.Connect{ClientID: "a", KeepAlive: 30, CleanStart: true, Properties: &packets.Properties{}}, &conn{})
+	if ack.Properties.ServerKeepAlive != nil {
+		t.Error("Expected no Server Keep Alive without override, got", *ack.Properties.ServerKeepAlive)
+	}
+
+	cfg := broker.DefaultConfig()
+	cfg.ServerKeepAlive = 10 * time.Second
+	b = broker.NewBroker(cfg)
+
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "b", KeepAlive: 300, CleanStart: true, Properties: &packets.Properties{}}
+	req := parsePacket(t, cp).(*protocol.ConnectRequest)
+	b.Connect(req)
+	if req.KeepAlive() != 10*time.Second {
+		t.Error("Expected Keep Alive to be overridden, got", req.KeepAlive())
+	}
+
+	_, ack = connack(t, b, &packets.Connect{ClientID: "c", KeepAlive: 300, CleanStart: true, Properties: &packets.Properties{}}, &conn{})
+	if ack.Properties.ServerKeepAlive == nil || *ack.Properties.ServerKeepAlive != 10 {
+		t.Error("Expected Server Keep Alive 10 in CONNACK")
+	}
+}
+
+func TestBrokerUserProperties(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	user := []packets.User{{Key: "trace-id", Value: "4bf92f3577b34da6"}, {Key: "tenant", Value: "acme"}, {Key: "tenant", Value: "globex"}}
+	ca, cb := &conn{}, &conn{}
+	sa, _ := connack(t, b, &packets.Connect{ClientID: "a", Properties: &packets.Properties{User: user[1:]}}, ca)
+	sb := connect(t, b, "b", true, 0, cb)
+	subscribe(t, b, sa, ca, packets.SubOptions{Topic: "orders/#"})
+	subscribe(t, b, sb, cb, packets.SubOptions{Topic: "orders/#", QoS: 1})
+
+	if tenant, _ := sa.UserProperties().Get("tenant"); len(sa.UserProperties()) != 2 || tenant != "acme" {
+		t.Error("Expected session to keep the User Properties of CONNECT, got", sa.UserProperties())
+	}
+
+	pp := &packets.Publish{PacketID: 1, QoS: 1, Topic: "orders/42", Payload: []byte("new"), Properties: &packets.Properties{User: user}}
+	if err := b.Publish(sa, publishRequest(t, pp)); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]*conn{"a": ca, "b": cb} {
+		var pub *packets.Publish
+		for _, pkt := range c.packets(t) {
+			if p, ok := pkt.Content.(*packets.Publish); ok {
+				pub = p
+			}
+		}
+		if pub == nil {
+			t.Error("Expected", name, "to receive the message")
+			continue
+		}
+		if len(pub.Properties.User) != len(user) {
+			t.Error("Expected", name, "to receive", user, "got", pub.Properties.User)
+			continue
+		}
+		for i := range user {
+			if pub.Properties.User[i] != user[i] {
+				t.Error("Expected", name, "to receive", user, "in order, got", pub.Properties.User)
+				break
+			}
+		}
+	}
+}
+
+func TestBrokerSubscriptionIdentifier(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	id := 42
+
+	c := &conn{}
+	s, ack := connack(t, b, &packets.Connect{ClientID: "a", CleanStart: true, Properties: &packets.Properties{}}, c)
+	if ack.Properties.SubIDAvailable == nil || *ack.Properties.SubIDAvailable != 0 {
+		t.Error("Expected CONNACK to advertise Subscription Identifiers unavailable")
+	}
+
+	sp := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.SubOptions{{Topic: "a/#"}}, Properties: &packets.Properties{SubscriptionIdentifier: &id}}
+	if err := b.Subscribe(s, parsePacket(t, sp).(*protocol.SubscribeRequest)); err != nil {
+		t.Fatal(err)
+	}
+	suback := c.packets(t)[0].Content.(*packets.Suback)
+	if len(suback.Reasons) != 1 || suback.Reasons[0] != byte(protocol.SubscriptionIdentifiersNotSupported) {
+		t.Error("Expected Subscription Identifiers not supported, got", suback.Reasons)
+	}
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "a/b", Payload: []byte("x")}))
+	if got := c.packets(t); len(got) != 0 {
+		t.Error("Expected the subscription to be refused, got", got)
+	}
+
+	pp := &packets.Publish{Topic: "a/b", Payload: []byte("x"), Properties: &packets.Properties{SubscriptionIdentifier: &id}}
+	if err := b.Publish(s, publishRequest(t, pp)); protocol.ReasonOf(err, protocol.Success) != protocol.ProtocolError {
+		t.Error("Expected a Subscription Identifier from the client to be a Protocol Error, got", err)
+	}
+}
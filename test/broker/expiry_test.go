@@ -0,0 +1,86 @@
+package test
+
+import (
+	"goker/internal/broker"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestBrokerMessageExpiry(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	expiry := uint32(60)
+	stale, fresh := uint32(1), uint32(10)
+
+	c := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "dev", CleanStart: true, Properties: &packets.Properties{SessionExpiryInterval: &expiry}}, c)
+	subscribe(t, b, s, c, packets.SubOptions{Topic: "cmd/#", QoS: 1})
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/0", Payload: []byte("sent-stale"), Properties: &packets.Properties{MessageExpiry: &stale}}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/0", Payload: []byte("sent-fresh"), Properties: &packets.Properties{MessageExpiry: &fresh}}))
+	if got := len(c.packets(t)); got != 2 {
+		t.Fatal("Expected 2 messages in flight, got", got)
+	}
+	b.Detach(s)
+
+	// A message in flight with a shared subscription member which goes away
+	// is given to another member, unless it expired meanwhile.
+	w1, w2 := &conn{}, &conn{}
+	sw1 := connect(t, b, "w1", true, 0, w1)
+	sw2 := connect(t, b, "w2", true, 0, w2)
+	subscribe(t, b, sw1, w1, packets.SubOptions{Topic: "$share/g/jobs/#", QoS: 1})
+	subscribe(t, b, sw2, w2, packets.SubOptions{Topic: "$share/g/jobs/#", QoS: 1})
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte("stale"), Properties: &packets.Properties{MessageExpiry: &stale}}))
+	if got := len(w1.packets(t)) + len(w2.packets(t)); got != 1 {
+		t.Fatal("Expected the shared message in flight with a single member, got", got)
+	}
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/1", Payload: []byte("stale"), Properties: &packets.Properties{MessageExpiry: &stale}}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/2", Payload: []byte("fresh"), Properties: &packets.Properties{MessageExpiry: &fresh}}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "cmd/3", Payload: []byte("forever")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Retain: true, Topic: "state/1", Payload: []byte("stale"), Properties: &packets.Properties{MessageExpiry: &stale}}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Retain: true, Topic: "state/2", Payload: []byte("fresh"), Properties: &packets.Properties{MessageExpiry: &fresh}}))
+	if s.Queued() != 3 {
+		t.Fatal("Expected 3 queued messages, got", s.Queued())
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	b.Detach(sw1)
+	b.Detach(sw2)
+	if sw1.Inflight()+sw2.Inflight() != 0 || len(w1.packets(t))+len(w2.packets(t)) != 0 {
+		t.Error("Expected the expired shared message to be discarded")
+	}
+
+	c = &conn{}
+	s, _ = connack(t, b, &packets.Connect{ClientID: "dev", Properties: &packets.Properties{SessionExpiryInterval: &expiry}}, c)
+	recv := c.packets(t)
+	if len(recv) != 3 {
+		t.Fatal("Expected the expired messages to be discarded, got", len(recv))
+	}
+	if pub := recv[0].Content.(*packets.Publish); string(pub.Payload) != "sent-fresh" || !pub.Duplicate || pub.Properties.MessageExpiry == nil || *pub.Properties.MessageExpiry > 9 {
+		t.Error("Expected message in flight resent with reduced Message Expiry Interval, got", pub)
+	}
+	if s.Inflight() != 3 {
+		t.Error("Expected the expired message in flight to be dropped, got", s.Inflight())
+	}
+	if pub := recv[1].Content.(*packets.Publish); string(pub.Payload) != "fresh" || pub.Properties.MessageExpiry == nil || *pub.Properties.MessageExpiry > 9 {
+		t.Error("Expected Message Expiry Interval reduced by the time spent queued, got", pub.Properties.MessageExpiry)
+	}
+	if pub := recv[2].Content.(*packets.Publish); string(pub.Payload) != "forever" || pub.Properties.MessageExpiry != nil {
+		t.Error("Expected message without Message Expiry Interval, got", pub)
+	}
+
+	other := &conn{}
+	o := connect(t, b, "other", true, 0, other)
+	if err := b.Subscribe(o, subscribeRequest(t, packets.SubOptions{Topic: "state/#", QoS: 1})); err != nil {
+		t.Fatal(err)
+	}
+	recv = other.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected SUBACK and the retained message which did not expire, got", len(recv))
+	}
+	if pub := recv[1].Content.(*packets.Publish); string(pub.Payload) != "fresh" || !pub.Retain || pub.Properties.MessageExpiry == nil || *pub.Properties.MessageExpiry > 9 {
+		t.Error("Expected retained message with reduced Message Expiry Interval, got", pub)
+	}
+}
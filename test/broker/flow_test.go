@@ -0,0 +1,85 @@
+package test
+
+import (
+	"fmt"
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestBrokerSendQuota(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	max := uint16(2)
+	c := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "slow", CleanStart: true, Properties: &packets.Properties{ReceiveMaximum: &max}}, c)
+	subscribe(t, b, s, c, packets.SubOptions{Topic: "jobs/#", QoS: 1})
+
+	for i := 0; i < 5; i++ {
+		b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/new", Payload: []byte(fmt.Sprint(i))}))
+	}
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "jobs/tick", Payload: []byte("qos0")}))
+
+	var payloads []string
+	var ids []uint16
+	read := func() {
+		for _, pkt := range c.packets(t) {
+			pub := pkt.Content.(*packets.Publish)
+			if pub.QoS == 1 {
+				payloads = append(payloads, string(pub.Payload))
+				ids = append(ids, pub.PacketID)
+			}
+		}
+	}
+	read()
+	if len(payloads) != 2 || s.Inflight() != 2 || s.Queued() != 3 {
+		t.Fatal("Expected 2 messages in flight and 3 queued, got", payloads, s.Inflight(), s.Queued())
+	}
+
+	for i := 0; i < len(ids); i++ {
+		if err := b.Acknowledge(s, ackRequest(t, ids[i])); err != nil {
+			t.Fatal(err)
+		}
+		read()
+		if s.Inflight() > int(max) {
+			t.Fatal("Expected at most", max, "messages in flight, got", s.Inflight())
+		}
+	}
+	if fmt.Sprint(payloads) != "[0 1 2 3 4]" || s.Queued() != 0 {
+		t.Error("Expected every message in order once acknowledged, got", payloads, "with", s.Queued(), "queued")
+	}
+}
+
+func TestBrokerReceiveMaximum(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.ReceiveMaximum = 1
+	b := broker.NewBroker(cfg)
+
+	c := &conn{}
+	s, ack := connack(t, b, &packets.Connect{ClientID: "fast", CleanStart: true, Properties: &packets.Properties{}}, c)
+	if ack.Properties.ReceiveMaximum == nil || *ack.Properties.ReceiveMaximum != 1 {
+		t.Fatal("Expected CONNACK to advertise Receive Maximum 1, got", ack.Properties.ReceiveMaximum)
+	}
+
+	if err := b.Publish(s, publishRequest(t, &packets.Publish{PacketID: 1, QoS: 2, Topic: "jobs/new", Payload: []byte("a")})); err != nil {
+		t.Fatal(err)
+	}
+	// A retransmission is no new message in flight.
+	if err := b.Publish(s, publishRequest(t, &packets.Publish{PacketID: 1, QoS: 2, Topic: "jobs/new", Payload: []byte("a")})); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Publish(s, publishRequest(t, &packets.Publish{PacketID: 2, QoS: 2, Topic: "jobs/new", Payload: []byte("b")}))
+	if protocol.ReasonOf(err, protocol.Success) != protocol.ReceiveMaximumExceeded {
+		t.Error("Expected Receive Maximum Exceeded, got", err)
+	}
+
+	pr := &packets.Pubrel{PacketID: 1, Properties: &packets.Properties{}}
+	if err = b.Acknowledge(s, parsePacket(t, pr).(*protocol.AckRequest)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish(s, publishRequest(t, &packets.Publish{PacketID: 2, QoS: 2, Topic: "jobs/new", Payload: []byte("b")})); err != nil {
+		t.Error("Expected message once the previous one is completed, got", err)
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"bytes"
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"strings"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestBrokerMaximumPacketSize(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.MaximumPacketSize = 1024
+	b := broker.NewBroker(cfg)
+
+	max := uint32(60)
+	small := &conn{}
+	s, ack := connack(t, b, &packets.Connect{ClientID: "small", CleanStart: true, Properties: &packets.Properties{MaximumPacketSize: &max}}, small)
+	if ack.Properties.MaximumPacketSize == nil || *ack.Properties.MaximumPacketSize != 1024 {
+		t.Fatal("Expected CONNACK to advertise Maximum Packet Size 1024, got", ack.Properties.MaximumPacketSize)
+	}
+	subscribe(t, b, s, small, packets.SubOptions{Topic: "meters/#", QoS: 1})
+
+	large := &conn{}
+	l := connect(t, b, "large", true, 0, large)
+	subscribe(t, b, l, large, packets.SubOptions{Topic: "meters/#", QoS: 1})
+
+	user := []packets.User{{Key: "trace-id", Value: "4bf92f3577b34da6"}, {Key: "tenant", Value: "acme"}}
+	for _, payload := range [][]byte{[]byte("17.2"), bytes.Repeat([]byte("x"), 100)} {
+		pp := &packets.Publish{PacketID: 1, QoS: 1, Topic: "meters/42", Payload: payload, Properties: &packets.Properties{User: user}}
+		if err := b.Publish(nil, publishRequest(t, pp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recv := small.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected the message too large even without User Properties to be discarded, got", recv)
+	}
+	if pub := recv[0].Content.(*packets.Publish); string(pub.Payload) != "17.2" || len(pub.Properties.User) != 0 {
+		t.Error("Expected the message without its User Properties, got", pub)
+	}
+	if s.Inflight() != 1 {
+		t.Error("Expected the discarded message not to be in flight, got", s.Inflight())
+	}
+
+	recv = large.packets(t)
+	if len(recv) != 2 {
+		t.Fatal("Expected both messages for the client without limit, got", len(recv))
+	}
+	for _, pkt := range recv {
+		if pub := pkt.Content.(*packets.Publish); len(pub.Properties.User) != len(user) {
+			t.Error("Expected User Properties to be kept, got", pub.Properties.User)
+		}
+	}
+}
+
+func TestBrokerMaximumPacketSizeSend(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	max := uint32(40)
+	c := &conn{}
+	s, _ := connack(t, b, &packets.Connect{ClientID: "small", CleanStart: true, Properties: &packets.Properties{MaximumPacketSize: &max}}, c)
+
+	reason := strings.Repeat("r", 50)
+	if err := s.Send(protocol.NewDisconnect(protocol.ProtocolError, reason)); err != nil {
+		t.Fatal(err)
+	}
+	recv := c.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected a DISCONNECT, got", recv)
+	}
+	if d := recv[0].Content.(*packets.Disconnect); d.ReasonCode != byte(protocol.ProtocolError) || d.Properties.ReasonString != "" {
+		t.Error("Expected the DISCONNECT without its Reason String, got", d)
+	}
+
+	if err := s.Send(protocol.NewDisconnect(protocol.ProtocolError, "short")); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.packets(t)[0].Content.(*packets.Disconnect); d.Properties.ReasonString != "short" {
+		t.Error("Expected the Reason String which fits to be kept, got", d.Properties.ReasonString)
+	}
+
+	err := s.Send(protocol.NewAuth(protocol.ContinueAuthentication, "SCRAM-SHA-256", bytes.Repeat([]byte("x"), 50)))
+	if protocol.ReasonOf(err, protocol.Success) != protocol.PacketTooLarge {
+		t.Error("Expected an AUTH which does not fit to fail with Packet Too Large, got", err)
+	}
+	if recv := c.packets(t); len(recv) != 0 {
+		t.Error("Expected nothing to be written, got", recv)
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestRetainedStore(t *testing.T) {
+	store := broker.NewRetainedStore()
+
+	store.Store(publishRequest(t, &packets.Publish{Retain: true, Topic: "home/kitchen/temp", Payload: []byte("20")}))
+	store.Store(publishRequest(t, &packets.Publish{Retain: true, Topic: "home/kitchen/temp", Payload: []byte("21")}))
+	store.Store(publishRequest(t, &packets.Publish{Retain: true, Topic: "home/garage/temp", Payload: []byte("12")}))
+	store.Store(publishRequest(t, &packets.Publish{Retain: true, Topic: "$SYS/uptime", Payload: []byte("1")}))
+
+	if store.Len() != 3 {
+		t.Error("Expected 3 retained messages, got", store.Len())
+	}
+	msgs := store.Match("home/kitchen/#")
+	if len(msgs) != 1 || string(msgs[0].Payload()) != "21" || !msgs[0].Retain() {
+		t.Error("Expected retained message to be replaced, got", msgs)
+	}
+	if msgs = store.Match("+/+/temp"); len(msgs) != 2 {
+		t.Error("Expected 2 retained messages, got", len(msgs))
+	}
+	if msgs = store.Match("#"); len(msgs) != 2 {
+		t.Error("Expected $SYS topics not to match wildcard, got", len(msgs))
+	}
+
+	store.Store(publishRequest(t, &packets.Publish{Retain: true, Topic: "home/kitchen/temp", Payload: []byte("")}))
+	if msgs = store.Match("home/kitchen/temp"); len(msgs) != 0 {
+		t.Error("Expected zero-length payload to delete the retained message")
+	}
+}
+
+func TestBrokerRetainHandling(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Retain: true, Topic: "status/dev1", Payload: []byte("online")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{Retain: true, Topic: "status/dev2", Payload: []byte("offline")}))
+
+	c := &conn{}
+	s := connect(t, b, "dash", true, 0, c)
+
+	b.Subscribe(s, subscribeRequest(t, packets.SubOptions{Topic: "status/+", QoS: 1, RetainHandling: 0}))
+	recv := c.packets(t)
+	if len(recv) != 3 || recv[0].Type != packets.SUBACK {
+		t.Fatal("Expected SUBACK followed by 2 retained messages, got", len(recv))
+	}
+	for _, pkt := range recv[1:] {
+		pub := pkt.Content.(*packets.Publish)
+		if !pub.Retain {
+			t.Error("Expected retained message with RETAIN flag, got", pub)
+		}
+		if pub.Topic == "status/dev1" && pub.QoS != 1 || pub.Topic == "status/dev2" && pub.QoS != 0 {
+			t.Error("Expected retained message with its original QoS, got", pub)
+		}
+	}
+
+	b.Subscribe(s, subscribeRequest(t, packets.SubOptions{Topic: "status/+", QoS: 1, RetainHandling: 1}))
+	if recv = c.packets(t); len(recv) != 1 {
+		t.Error("Expected no retained message for an existing subscription, got", len(recv)-1)
+	}
+
+	b.Subscribe(s, subscribeRequest(t, packets.SubOptions{Topic: "status/dev1", RetainHandling: 1}))
+	if recv = c.packets(t); len(recv) != 2 {
+		t.Error("Expected retained message for a new subscription, got", len(recv)-1)
+	} else if pub := recv[1].Content.(*packets.Publish); pub.QoS != 0 {
+		t.Error("Expected retained message downgraded to QoS 0, got", pub.QoS)
+	}
+
+	b.Subscribe(s, subscribeRequest(t, packets.SubOptions{Topic: "status/#", RetainHandling: 2}))
+	if recv = c.packets(t); len(recv) != 1 {
+		t.Error("Expected no retained message with Retain Handling 2, got", len(recv)-1)
+	}
+}
+
+func TestBrokerRetainAsPublished(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+
+	keep, clear := &conn{}, &conn{}
+	subscribe(t, b, connect(t, b, "keep", true, 0, keep), keep, packets.SubOptions{Topic: "a", RetainAsPublished: true})
+	subscribe(t, b, connect(t, b, "clear", true, 0, clear), clear, packets.SubOptions{Topic: "a"})
+
+	b.Publish(nil, publishRequest(t, &packets.Publish{Retain: true, Topic: "a", Payload: []byte("x")}))
+	if recv := keep.packets(t); len(recv) != 1 || !recv[0].Content.(*packets.Publish).Retain {
+		t.Error("Expected RETAIN flag to be kept with Retain As Published")
+	}
+	if recv := clear.packets(t); len(recv) != 1 || recv[0].Content.(*packets.Publish).Retain {
+		t.Error("Expected RETAIN flag to be cleared without Retain As Published")
+	}
+}
+
+func TestBrokerRetainUnavailable(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.RetainAvailable = false
+	b := broker.NewBroker(cfg)
+
+	live := &conn{}
+	_, ack := connack(t, b, &packets.Connect{ClientID: "dev", CleanStart: true, Properties: &packets.Properties{}}, live)
+	if ack.Properties.RetainAvailable == nil || *ack.Properties.RetainAvailable != 0 {
+		t.Error("Expected CONNACK to advertise retain unavailable")
+	}
+
+	if err := b.Publish(nil, publishRequest(t, &packets.Publish{Retain: true, Topic: "a", Payload: []byte("x")})); err == nil {
+		t.Error("Expected retained PUBLISH to be rejected")
+	}
+
+	refused := parsePacket(t, &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "dev", Properties: &packets.Properties{}}).(*protocol.ConnectRequest)
+	refused.Refuse(protocol.NotAuthorized)
+	if s := b.Connect(refused); s != nil {
+		t.Error("Expected no session for a refused CONNECT")
+	}
+	if live.closed {
+		t.Error("Expected a refused CONNECT not to take over the connected session")
+	}
+
+	cp := &packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		ClientID:        "dev",
+		Properties:      &packets.Properties{},
+		WillFlag:        true,
+		WillQOS:         2,
+		WillTopic:       "status/dev",
+		WillMessage:     []byte("offline"),
+		WillProperties:  &packets.Properties{},
+	}
+	req := parsePacket(t, cp).(*protocol.ConnectRequest)
+	if s := b.Connect(req); s == nil || req.Connack().Reason() != protocol.Success {
+		t.Error("Expected a Will of QoS 2 without retain to be accepted, got", req.Connack().Reason())
+	}
+}
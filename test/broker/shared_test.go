@@ -0,0 +1,171 @@
+package test
+
+import (
+	"fmt"
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+// shareBroker connects the members of the shared subscription $share/g/jobs/#
+// to a broker using the strategy.
+func shareBroker(t *testing.T, strategy string, members ...string) (*broker.Broker, []*broker.Session, []*conn) {
+	cfg := broker.DefaultConfig()
+	share, err := broker.NewShareStrategy(strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ShareStrategy = share
+	b := broker.NewBroker(cfg)
+
+	var sessions []*broker.Session
+	var conns []*conn
+	for _, clientId := range members {
+		c := &conn{}
+		s := connect(t, b, clientId, true, 60, c)
+		subscribe(t, b, s, c, packets.SubOptions{Topic: "$share/g/jobs/#", QoS: 1})
+		sessions, conns = append(sessions, s), append(conns, c)
+	}
+	return b, sessions, conns
+}
+
+func payloads(t *testing.T, c *conn) []string {
+	var got []string
+	for _, pkt := range c.packets(t) {
+		if pub, ok := pkt.Content.(*packets.Publish); ok {
+			got = append(got, string(pub.Payload))
+		}
+	}
+	return got
+}
+
+func TestBrokerSharedSubscription(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	b.Publish(nil, publishRequest(t, &packets.Publish{Retain: true, Topic: "jobs/0", Payload: []byte("retained")}))
+
+	w1, w2, all := &conn{}, &conn{}, &conn{}
+	s1, ack := connack(t, b, &packets.Connect{ClientID: "w1", CleanStart: true, Properties: &packets.Properties{}}, w1)
+	if ack.Properties.SharedSubAvailable == nil || *ack.Properties.SharedSubAvailable != 1 {
+		t.Error("Expected CONNACK to advertise shared subscriptions")
+	}
+	s2 := connect(t, b, "w2", true, 0, w2)
+	sa := connect(t, b, "all", true, 0, all)
+	for _, member := range []struct {
+		s *broker.Session
+		c *conn
+	}{{s1, w1}, {s2, w2}} {
+		if err := b.Subscribe(member.s, subscribeRequest(t, packets.SubOptions{Topic: "$share/g/jobs/#", QoS: 1})); err != nil {
+			t.Fatal(err)
+		}
+		if recv := member.c.packets(t); len(recv) != 1 {
+			t.Error("Expected SUBACK without retained message for a shared subscription, got", len(recv))
+		}
+	}
+	subscribe(t, b, sa, all, packets.SubOptions{Topic: "jobs/#", QoS: 1, RetainHandling: 2})
+
+	for i := 1; i <= 4; i++ {
+		b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte(fmt.Sprint(i))}))
+	}
+	if got := payloads(t, w1); fmt.Sprint(got) != "[1 3]" {
+		t.Error("Expected w1 to receive every other message, got", got)
+	}
+	if got := payloads(t, w2); fmt.Sprint(got) != "[2 4]" {
+		t.Error("Expected w2 to receive every other message, got", got)
+	}
+	if got := payloads(t, all); len(got) != 4 {
+		t.Error("Expected every message for the non-shared subscription, got", got)
+	}
+}
+
+func TestBrokerShareStrategies(t *testing.T) {
+	if _, err := broker.NewShareStrategy("fastest"); err == nil {
+		t.Error("Missing unknown strategy case")
+	}
+
+	b, _, conns := shareBroker(t, "random", "w1", "w2", "w3")
+	for i := 0; i < 30; i++ {
+		b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte(fmt.Sprint(i))}))
+	}
+	total := 0
+	for _, c := range conns {
+		total += len(payloads(t, c))
+	}
+	if total != 30 {
+		t.Error("Expected each message to go to a single member, got", total)
+	}
+
+	b, _, conns = shareBroker(t, "sticky", "w1", "w2", "w3")
+	for _, publisher := range []string{"p1", "p2", "p3", "p4"} {
+		p := connect(t, b, publisher, true, 0, &conn{})
+		for i := 0; i < 3; i++ {
+			b.Publish(p, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/" + publisher, Payload: []byte(fmt.Sprint(i))}))
+		}
+		received := 0
+		for _, c := range conns {
+			if got := len(payloads(t, c)); got == 3 {
+				received++
+			} else if got != 0 {
+				t.Error("Expected the messages of", publisher, "to go to the same member, got", got)
+			}
+		}
+		if received != 1 {
+			t.Error("Expected a single member to receive the messages of", publisher, ", got", received)
+		}
+	}
+
+	b, sessions, conns := shareBroker(t, "least-inflight", "w1", "w2")
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte("1")}))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte("2")}))
+	pub := conns[0].packets(t)[0].Content.(*packets.Publish)
+	if got := payloads(t, conns[1]); fmt.Sprint(got) != "[2]" {
+		t.Error("Expected the member without message in flight to receive the second message, got", got)
+	}
+	b.Acknowledge(sessions[0], ackRequest(t, pub.PacketID))
+	b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte("3")}))
+	if got := payloads(t, conns[0]); fmt.Sprint(got) != "[3]" {
+		t.Error("Expected the member which acknowledged its message to receive the third message, got", got)
+	}
+}
+
+func TestBrokerSharedRedistribution(t *testing.T) {
+	b, sessions, conns := shareBroker(t, "round-robin", "w1", "w2")
+	b.Publish(nil, publishRequest(t, &packets.Publish{Topic: "jobs/1", Payload: []byte("qos0")}))
+	for i := 1; i <= 4; i++ {
+		b.Publish(nil, publishRequest(t, &packets.Publish{QoS: 1, Topic: "jobs/1", Payload: []byte(fmt.Sprint(i))}))
+	}
+	conns[0].packets(t)
+	if got := payloads(t, conns[1]); fmt.Sprint(got) != "[1 3]" {
+		t.Fatal("Expected w2 to receive every other message, got", got)
+	}
+
+	b.Detach(sessions[0])
+	if sessions[0].Inflight() != 0 || sessions[0].Queued() != 0 {
+		t.Error("Expected the unacknowledged messages to be taken from w1, got", sessions[0].Inflight(), sessions[0].Queued())
+	}
+	if got := payloads(t, conns[1]); fmt.Sprint(got) != "[2 4]" {
+		t.Error("Expected the messages of w1 to be given to w2, got", got)
+	}
+
+	b.Detach(sessions[1])
+	if sessions[1].Inflight() != 4 {
+		t.Error("Expected the messages to stay with the last member, got", sessions[1].Inflight())
+	}
+}
+
+func TestBrokerSharedSubscriptionUnavailable(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.SharedSubscriptionAvailable = false
+	b := broker.NewBroker(cfg)
+
+	c := &conn{}
+	s, ack := connack(t, b, &packets.Connect{ClientID: "w1", CleanStart: true, Properties: &packets.Properties{}}, c)
+	if ack.Properties.SharedSubAvailable == nil || *ack.Properties.SharedSubAvailable != 0 {
+		t.Error("Expected CONNACK to advertise shared subscriptions unavailable")
+	}
+	suback := subscribe(t, b, s, c, packets.SubOptions{Topic: "$share/g/jobs/#", QoS: 1})
+	if suback.Reasons[0] != byte(protocol.SharedSubscriptionsNotSupported) {
+		t.Error("Expected Shared Subscriptions not supported, got", suback.Reasons)
+	}
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func subscribeTree(t *testing.T, tree *broker.SubscriptionTree, clientId string, filters ...string) {
+	sp := &packets.Subscribe{PacketID: 1, Properties: &packets.Properties{}}
+	for _, filter := range filters {
+		sp.Subscriptions = append(sp.Subscriptions, packets.SubOptions{Topic: filter})
+	}
+
+	for _, sub := range parsePacket(t, sp).(*protocol.SubscribeRequest).Subscriptions() {
+		tree.Subscribe(clientId, *sub)
+	}
+}
+
+func match(tree *broker.SubscriptionTree, topic string) []string {
+	var filters []string
+	for _, s := range tree.Match(topic) {
+		filters = append(filters, s.ClientId+":"+s.Subscription.Filter())
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+func TestSubscriptionTreeMatch(t *testing.T) {
+	tree := broker.NewSubscriptionTree()
+	subscribeTree(t, tree, "a", "sport/tennis/player1", "sport/tennis/+", "sport/#")
+	subscribeTree(t, tree, "b", "+/+", "#", "+/tennis/#")
+	subscribeTree(t, tree, "c", "$SYS/#", "/finance")
+
+	cases := []struct {
+		topic    string
+		expected []string
+	}{
+		{"sport/tennis/player1", []string{"a:sport/#", "a:sport/tennis/+", "a:sport/tennis/player1", "b:#", "b:+/tennis/#"}},
+		{"sport/tennis", []string{"a:sport/#", "b:#", "b:+/+", "b:+/tennis/#"}},
+		{"sport", []string{"a:sport/#", "b:#"}},
+		{"/finance", []string{"b:#", "b:+/+", "c:/finance"}},
+		{"$SYS/monitor", []string{"c:$SYS/#"}},
+		{"finance/stock/ibm", []string{"b:#"}},
+	}
+
+	for _, c := range cases {
+		got := match(tree, c.topic)
+		if len(got) != len(c.expected) {
+			t.Error("Topic", c.topic, "expected", c.expected, ", got", got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.expected[i] {
+				t.Error("Topic", c.topic, "expected", c.expected, ", got", got)
+				break
+			}
+		}
+	}
+
+	if !tree.Unsubscribe("a", "sport/#") || tree.Unsubscribe("a", "sport/#") {
+		t.Error("Expected sport/# to be unsubscribed exactly once")
+	}
+	if got := match(tree, "sport"); len(got) != 1 || got[0] != "b:#" {
+		t.Error("Expected only b:# after unsubscribe, got", got)
+	}
+}
+
+func TestSubscriptionTreeShared(t *testing.T) {
+	tree := broker.NewSubscriptionTree()
+	subscribeTree(t, tree, "a", "$share/g/jobs/#", "jobs/+")
+	subscribeTree(t, tree, "b", "$share/g/jobs/#", "$share/h/jobs/#")
+
+	expected := []string{"a:$share/g/jobs/#", "a:jobs/+", "b:$share/g/jobs/#", "b:$share/h/jobs/#"}
+	if got := match(tree, "jobs/1"); !slices.Equal(got, expected) {
+		t.Error("Expected", expected, ", got", got)
+	}
+	if members := tree.Members("$share/g/jobs/#"); len(members) != 2 {
+		t.Error("Expected 2 members of $share/g/jobs/#, got", members)
+	}
+
+	if !tree.Unsubscribe("b", "$share/g/jobs/#") || tree.Unsubscribe("b", "$share/g/jobs/#") {
+		t.Error("Expected $share/g/jobs/# to be unsubscribed exactly once")
+	}
+	tree.Unsubscribe("b", "$share/h/jobs/#")
+	if members := tree.Members("$share/h/jobs/#"); len(members) != 0 {
+		t.Error("Expected no member of $share/h/jobs/#, got", members)
+	}
+	expected = []string{"a:$share/g/jobs/#", "a:jobs/+"}
+	if got := match(tree, "jobs/1"); !slices.Equal(got, expected) {
+		t.Error("Expected", expected, ", got", got)
+	}
+}
+
+func TestTopicFilterValidation(t *testing.T) {
+	valid := []string{"#", "+", "sport/#", "sport/+/player1", "+/+", "/", "$SYS/#", "$share/g/sport/#", "$share/g/+"}
+	for _, filter := range valid {
+		if err := protocol.ValidTopicFilter(filter); err != nil {
+			t.Error("Expected", filter, "to be valid, err:", err)
+		}
+	}
+
+	invalid := []string{"", "sport/tennis#", "sport/#/ranking", "sport+", "#/a", "a/b+/c", "$share/g", "$share/g/", "$share//sport", "$share/g+/sport", "$share/g/sport#"}
+	for _, filter := range invalid {
+		if protocol.ValidTopicFilter(filter) == nil {
+			t.Error("Expected", filter, "to be invalid")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"goker/internal/broker"
+	"goker/internal/protocol"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func connectWithWill(t *testing.T, b *broker.Broker, clientId string, delay uint32, expiry uint32) *broker.Session {
+	cp := &packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		ClientID:        clientId,
+		CleanStart:      true,
+		Properties:      &packets.Properties{SessionExpiryInterval: &expiry},
+		WillFlag:        true,
+		WillQOS:         1,
+		WillTopic:       "status/" + clientId,
+		WillMessage:     []byte("offline"),
+		WillProperties:  &packets.Properties{WillDelayInterval: &delay, User: []packets.User{{Key: "fleet", Value: "north"}}},
+	}
+	s := b.Connect(parsePacket(t, cp).(*protocol.ConnectRequest))
+	b.Attach(s, &conn{})
+	return s
+}
+
+func disconnectRequest(t *testing.T, rc byte) *protocol.DisconnectRequest {
+	dp := &packets.Disconnect{ReasonCode: rc, Properties: &packets.Properties{}}
+	return parsePacket(t, dp).(*protocol.DisconnectRequest)
+}
+
+func watcher(t *testing.T, b *broker.Broker) *conn {
+	c := &conn{}
+	subscribe(t, b, connect(t, b, "watcher", true, 0, c), c, packets.SubOptions{Topic: "status/#", QoS: 1})
+	return c
+}
+
+func TestBrokerWillOnConnectionLoss(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	w := watcher(t, b)
+
+	b.Detach(connectWithWill(t, b, "dev", 0, 0))
+
+	recv := w.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected will message, got", len(recv))
+	}
+	pub := recv[0].Content.(*packets.Publish)
+	if pub.Topic != "status/dev" || string(pub.Payload) != "offline" || pub.QoS != 1 {
+		t.Error("Unexpected will message", pub)
+	}
+	if pub.Properties == nil || len(pub.Properties.User) != 1 || pub.Properties.User[0].Value != "north" {
+		t.Error("Expected will properties to be forwarded, got", pub.Properties)
+	}
+}
+
+func TestBrokerWillOnDisconnect(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	w := watcher(t, b)
+
+	s := connectWithWill(t, b, "normal", 0, 0)
+	b.Disconnect(s, disconnectRequest(t, 0x00))
+	b.Detach(s)
+	if n := len(w.packets(t)); n != 0 {
+		t.Error("Expected will message to be discarded on Normal Disconnection, got", n)
+	}
+
+	s = connectWithWill(t, b, "will", 0, 0)
+	b.Disconnect(s, disconnectRequest(t, 0x04))
+	b.Detach(s)
+	if n := len(w.packets(t)); n != 1 {
+		t.Error("Expected will message on Disconnect with Will Message, got", n)
+	}
+}
+
+func TestBrokerWillDelay(t *testing.T) {
+	b := broker.NewBroker(broker.DefaultConfig())
+	w := watcher(t, b)
+
+	b.Detach(connectWithWill(t, b, "back", 1, 60))
+	b.Detach(connectWithWill(t, b, "gone", 1, 60))
+
+	connect(t, b, "back", false, 60, &conn{})
+	if n := len(w.packets(t)); n != 0 {
+		t.Error("Expected will message to wait for the Will Delay Interval, got", n)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	recv := w.packets(t)
+	if len(recv) != 1 {
+		t.Fatal("Expected a single will message, got", len(recv))
+	}
+	if pub := recv[0].Content.(*packets.Publish); pub.Topic != "status/gone" {
+		t.Error("Expected will message of the client that did not reconnect, got", pub.Topic)
+	}
+}
@@ -0,0 +1,272 @@
+package test
+
+import (
+	"bytes"
+	"goker/internal/broker"
+	"goker/internal/gateway"
+	"goker/internal/protocol"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestParseListener(t *testing.T) {
+	cfg, err := gateway.ParseListener("tcp://0.0.0.0:1883")
+	if err != nil || cfg.Transport != gateway.TCP || cfg.Addr != "0.0.0.0:1883" {
+		t.Error("Expected TCP listener, got", cfg, err)
+	}
+
+	cfg, err = gateway.ParseListener("unix:///run/goker.sock")
+	if err != nil || cfg.Transport != gateway.Unix || cfg.Addr != "/run/goker.sock" {
+		t.Error("Expected Unix listener, got", cfg, err)
+	}
+
+	cfg, err = gateway.ParseListener("tls://:8883?cert=s.crt&key=s.key&client-ca=ca.crt&require-client-cert=true&username-from=cn&clientid-from=san")
+	if err != nil || cfg.Transport != gateway.TLS || cfg.Addr != ":8883" {
+		t.Fatal("Expected TLS listener, got", cfg, err)
+	}
+	tc := cfg.TLS
+	if tc.CertFile != "s.crt" || tc.KeyFile != "s.key" || tc.ClientCAFile != "ca.crt" || !tc.RequireClientCert ||
+		tc.UsernameFrom != gateway.CertCommonName || tc.ClientIdFrom != gateway.CertSAN {
+		t.Error("Expected TLS settings of the listener, got", *tc)
+	}
+
+	cfg, err = gateway.ParseListener("ws://:8080/mqtt?origin=https://a.example.com&origin=https://b.example.com")
+	if err != nil || cfg.Transport != gateway.WS || cfg.Addr != ":8080" || cfg.Path != "/mqtt" || len(cfg.Origins) != 2 || cfg.TLS != nil {
+		t.Error("Expected WebSocket listener, got", cfg, err)
+	}
+
+	cfg, err = gateway.ParseListener("wss://:8443/?cert=s.crt&key=s.key")
+	if err != nil || cfg.Transport != gateway.WSS || cfg.Path != "/" || cfg.TLS == nil || cfg.TLS.CertFile != "s.crt" {
+		t.Error("Expected secure WebSocket listener, got", cfg, err)
+	}
+
+	for _, s := range []string{
+		"udp://:1883",
+		"tcp://",
+		"tls://:8883",
+		"tls://:8883?cert=s.crt&key=s.key&username-from=subject",
+		"tls://:8883?cert=s.crt&key=s.key&require-client-cert=maybe",
+		"wss://:8443/mqtt",
+	} {
+		if _, err = gateway.ParseListener(s); err == nil {
+			t.Error("Missing invalid listener case:", s)
+		}
+	}
+}
+
+// connectTo sends a CONNECT through the listener and returns the CONNACK.
+func connectTo(t *testing.T, network string, addr string, clientId string) *packets.Connack {
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: clientId, CleanStart: true, Properties: &packets.Properties{}}
+	return sendConnect(t, network, addr, cp)
+}
+
+// sendConnect sends the CONNECT on a new connection and returns the CONNACK.
+func sendConnect(t *testing.T, network string, addr string, cp *packets.Connect) *packets.Connack {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = cp.WriteTo(c); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	recv, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := recv.Content.(*packets.Connack)
+	if !ok {
+		t.Fatal("Expected CONNACK, got", recv)
+	}
+	return ack
+}
+
+func TestListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "goker.sock")
+
+	// A socket file left by a previous process must not prevent listening.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	var listeners []*gateway.Listener
+	for _, cfg := range []gateway.ListenerConfig{
+		{Transport: gateway.TCP, Addr: "127.0.0.1:0"},
+		{Transport: gateway.Unix, Addr: sock},
+	} {
+		l, err := gateway.Listen(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go l.Serve()
+		listeners = append(listeners, l)
+	}
+
+	if ack := connectTo(t, "tcp", listeners[0].Addr().String(), "over-tcp"); ack.ReasonCode != 0 {
+		t.Error("Expected CONNACK over TCP, got", ack.ReasonCode)
+	}
+	if ack := connectTo(t, "unix", sock, "over-unix"); ack.ReasonCode != 0 {
+		t.Error("Expected CONNACK over Unix socket, got", ack.ReasonCode)
+	}
+
+	if _, err = gateway.Listen(gateway.ListenerConfig{Transport: gateway.Unix, Addr: sock}); err == nil {
+		t.Error("Expected socket in use not to be replaced")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.Serve() }()
+	l.Close()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error("Expected closed listener to stop without error, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected listener to stop once closed")
+	}
+
+	sock := filepath.Join(t.TempDir(), "goker.sock")
+	if err = gateway.ListenAndServe(gateway.ListenerConfig{Transport: gateway.Unix, Addr: sock}, gateway.ListenerConfig{Transport: gateway.TLS, Addr: ":0"}); err == nil {
+		t.Error("Expected misconfigured listener to fail")
+	}
+	if _, err = os.Stat(sock); err == nil {
+		t.Error("Expected listeners opened before the failure to be closed")
+	}
+}
+
+func TestLargePublish(t *testing.T) {
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	var conns [2]net.Conn
+	for i, clientId := range []string{"large-sub", "large-pub"} {
+		if conns[i], err = net.Dial("tcp", l.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+		cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: clientId, CleanStart: true, Properties: &packets.Properties{}}
+		cp.WriteTo(conns[i])
+		conns[i].SetReadDeadline(time.Now().Add(time.Second))
+		if recv, err := packets.ReadPacket(conns[i]); err != nil || recv.Type != packets.CONNACK {
+			t.Fatal("Expected CONNACK, got", recv, err)
+		}
+	}
+
+	sp := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.SubOptions{{Topic: "large/#"}}, Properties: &packets.Properties{}}
+	sp.WriteTo(conns[0])
+	if recv, err := packets.ReadPacket(conns[0]); err != nil || recv.Type != packets.SUBACK {
+		t.Fatal("Expected SUBACK, got", recv, err)
+	}
+
+	payload := make([]byte, 100000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pp := &packets.Publish{Topic: "large/payload", Payload: payload, Properties: &packets.Properties{}}
+	pp.WriteTo(conns[1])
+
+	recv, err := packets.ReadPacket(conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := recv.Content.(*packets.Publish); !ok || pub.Topic != "large/payload" || !bytes.Equal(pub.Payload, payload) {
+		t.Error("Expected large PUBLISH to be forwarded intact, got", recv)
+	}
+}
+
+func TestPacketTooLarge(t *testing.T) {
+	cfg := broker.DefaultConfig()
+	cfg.MaximumPacketSize = 1024
+	gateway.Configure(cfg)
+	defer gateway.Configure(broker.DefaultConfig())
+
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "too-large", CleanStart: true, Properties: &packets.Properties{}}
+	cp.WriteTo(c)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if recv, err := packets.ReadPacket(c); err != nil || recv.Type != packets.CONNACK {
+		t.Fatal("Expected CONNACK, got", recv, err)
+	}
+
+	pp := &packets.Publish{Topic: "large/payload", Payload: make([]byte, 1024), Properties: &packets.Properties{}}
+	pp.WriteTo(c)
+	recv, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := recv.Content.(*packets.Disconnect); !ok || d.ReasonCode != byte(protocol.PacketTooLarge) {
+		t.Error("Expected DISCONNECT with Packet Too Large, got", recv)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "silent", CleanStart: true, KeepAlive: 1, Properties: &packets.Properties{}}
+	cp.WriteTo(c)
+
+	// The server waits one and a half times the Keep Alive before closing.
+	start := time.Now()
+	c.SetReadDeadline(start.Add(3 * time.Second))
+	if recv, err := packets.ReadPacket(c); err != nil || recv.Type != packets.CONNACK {
+		t.Fatal("Expected CONNACK, got", recv, err)
+	}
+	recv, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal("Expected DISCONNECT, got", err)
+	}
+	if dp, ok := recv.Content.(*packets.Disconnect); !ok || dp.ReasonCode != byte(protocol.KeepAliveTimeout) {
+		t.Error("Expected DISCONNECT with Keep Alive timeout, got", recv)
+	}
+	if elapsed := time.Since(start); elapsed < 1400*time.Millisecond {
+		t.Error("Expected the connection to be kept for 1.5 times the Keep Alive, closed after", elapsed)
+	}
+	if _, err = packets.ReadPacket(c); err != io.EOF {
+		t.Error("Expected the connection to be closed, got", err)
+	}
+}
@@ -0,0 +1,212 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"goker/internal/auth"
+	"goker/internal/broker"
+	"goker/internal/gateway"
+	"goker/internal/protocol"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestPasswordLogin(t *testing.T) {
+	f, err := auth.LoadPasswordFile(filepath.Join(t.TempDir(), "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Set("alice", []byte("wonderland")); err != nil {
+		t.Fatal(err)
+	}
+	gateway.UseCredentials(f)
+	defer gateway.UseCredentials(nil)
+
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	for password, rc := range map[string]byte{"wonderland": 0, "looking-glass": byte(protocol.BadUsernamePassword)} {
+		cp := &packets.Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: 5,
+			ClientID:        "alice-1",
+			CleanStart:      true,
+			UsernameFlag:    true,
+			Username:        "alice",
+			PasswordFlag:    true,
+			Password:        []byte(password),
+			Properties:      &packets.Properties{},
+		}
+		if ack := sendConnect(t, "tcp", l.Addr().String(), cp); ack.ReasonCode != rc {
+			t.Error("Expected reason code", rc, "for password", password, ", got", ack.ReasonCode)
+		}
+	}
+}
+
+// tenantCredentials accepts the password of each tenant, told by the tenant
+// User Property of the CONNECT.
+type tenantCredentials map[string]string
+
+func (c tenantCredentials) Authenticate(username string, password []byte, props protocol.UserProperties) error {
+	if tenant, ok := props.Get("tenant"); !ok || c[tenant] != string(password) {
+		return protocol.NewReasonError(protocol.BadUsernamePassword, "Bad password for tenant "+tenant)
+	}
+	return nil
+}
+
+func TestTenantLogin(t *testing.T) {
+	gateway.UseCredentials(tenantCredentials{"acme": "anvil", "globex": "hammock"})
+	defer gateway.UseCredentials(nil)
+
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	for _, c := range []struct {
+		tenant string
+		rc     byte
+	}{{"acme", 0}, {"globex", byte(protocol.BadUsernamePassword)}} {
+		cp := &packets.Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: 5,
+			ClientID:        "wile",
+			CleanStart:      true,
+			UsernameFlag:    true,
+			Username:        "wile",
+			PasswordFlag:    true,
+			Password:        []byte("anvil"),
+			Properties:      &packets.Properties{User: []packets.User{{Key: "tenant", Value: c.tenant}}},
+		}
+		if ack := sendConnect(t, "tcp", l.Addr().String(), cp); ack.ReasonCode != c.rc {
+			t.Error("Expected reason code", c.rc, "for tenant", c.tenant, ", got", ack.ReasonCode)
+		}
+	}
+}
+
+func scramHmac(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramConnect logs in with SCRAM-SHA-256 on a new connection and returns it
+// along with the CONNACK.
+func scramConnect(t *testing.T, addr string, cp *packets.Connect, user string, password string) (net.Conn, *packets.Connack) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	clientFirst := "n=" + user + ",r=rOprNGfwEbeRWgbNEkqO"
+	cp.Properties.AuthMethod = auth.ScramSHA256
+	cp.Properties.AuthData = []byte("n,," + clientFirst)
+	cp.WriteTo(c)
+	recv, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, ok := recv.Content.(*packets.Auth)
+	if !ok {
+		c.Close()
+		t.Fatal("Expected AUTH, got", recv)
+	}
+
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(string(challenge.Properties.AuthData), ",") {
+		attrs[part[:1]] = part[2:]
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iter, _ := strconv.Atoi(attrs["i"])
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iter, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := scramHmac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + attrs["r"]
+	signature := scramHmac(storedKey[:], clientFirst+","+string(challenge.Properties.AuthData)+","+withoutProof)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+
+	ap := &packets.Auth{ReasonCode: byte(protocol.ContinueAuthentication), Properties: &packets.Properties{
+		AuthMethod: auth.ScramSHA256,
+		AuthData:   []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)),
+	}}
+	ap.WriteTo(c)
+	if recv, err = packets.ReadPacket(c); err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := recv.Content.(*packets.Connack)
+	if !ok {
+		c.Close()
+		t.Fatal("Expected CONNACK, got", recv)
+	}
+	return c, ack
+}
+
+func TestScramLogin(t *testing.T) {
+	f, err := auth.LoadPasswordFile(filepath.Join(t.TempDir(), "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Set("alice", []byte("wonderland")); err != nil {
+		t.Fatal(err)
+	}
+	gateway.UseCredentials(f)
+	defer gateway.UseCredentials(nil)
+	cfg := broker.DefaultConfig()
+	cfg.ACL = auth.NewACL(false, auth.Rule{Allow: true, Actions: auth.Subscribe, Filter: "%u/#"})
+	gateway.Configure(cfg)
+	defer gateway.Configure(broker.DefaultConfig())
+
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TCP, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "alice-2", CleanStart: true,
+		UsernameFlag: true, Username: "bob", Properties: &packets.Properties{}}
+	c, ack := scramConnect(t, l.Addr().String(), cp, "alice", "wonderland")
+	c.Close()
+	if ack.ReasonCode != byte(protocol.NotAuthorized) {
+		t.Error("Expected Not Authorized for a User Name other than the SCRAM user, got", ack.ReasonCode)
+	}
+
+	cp = &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "alice-2", CleanStart: true, Properties: &packets.Properties{}}
+	c, ack = scramConnect(t, l.Addr().String(), cp, "alice", "wonderland")
+	defer c.Close()
+	if ack.ReasonCode != 0 {
+		t.Fatal("Expected SCRAM login with the password file to succeed, got", ack.ReasonCode)
+	}
+
+	// The ACL only lets users subscribe below their own name, so the session
+	// must carry the SCRAM user.
+	sp := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.SubOptions{{Topic: "alice/inbox", QoS: 1}}, Properties: &packets.Properties{}}
+	sp.WriteTo(c)
+	recv, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suback, ok := recv.Content.(*packets.Suback); !ok || suback.Reasons[0] != 1 {
+		t.Error("Expected the subscription of the SCRAM user to be granted, got", recv)
+	}
+}
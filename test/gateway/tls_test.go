@@ -0,0 +1,320 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"goker/internal/auth"
+	"goker/internal/gateway"
+	"goker/internal/protocol"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+type certificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func issue(t *testing.T, tmpl *x509.Certificate, parent *certificate) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certificate{cert: cert, key: key}
+}
+
+func newCA(t *testing.T) *certificate {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "goker test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newServerCert(t *testing.T, ca *certificate, cn string) *certificate {
+	return issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func newClientCert(t *testing.T, ca *certificate, cn string, email string) *certificate {
+	return issue(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: cn},
+		EmailAddresses: []string{email},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func (c *certificate) write(t *testing.T, certFile string, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *certificate) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+type tlsFiles struct {
+	cert, key, ca string
+}
+
+func writeTLSFiles(t *testing.T, ca *certificate, server *certificate) tlsFiles {
+	dir := t.TempDir()
+	files := tlsFiles{cert: filepath.Join(dir, "server.crt"), key: filepath.Join(dir, "server.key"), ca: filepath.Join(dir, "ca.crt")}
+	server.write(t, files.cert, files.key)
+	ca.write(t, files.ca, filepath.Join(dir, "ca.key"))
+	return files
+}
+
+func clientConfig(ca *certificate, client *certificate) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conf := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if client != nil {
+		conf.Certificates = []tls.Certificate{client.tls()}
+	}
+	return conf
+}
+
+// handshake dials the listener and returns the common name of the server
+// certificate.
+func handshake(l net.Listener, conf *tls.Config) (string, error) {
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.(*tls.Conn).Handshake()
+	}()
+
+	c, err := tls.Dial("tcp", l.Addr().String(), conf)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	// The server verifies the client certificate after the client completed
+	// its handshake, so a refused certificate shows up on the first read.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != nil && !isTimeoutOrEOF(err) {
+		return "", err
+	}
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func isTimeoutOrEOF(err error) bool {
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+		return true
+	}
+	return err.Error() == "EOF"
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newCA(t)
+	files := writeTLSFiles(t, ca, newServerCert(t, ca, "server"))
+
+	conf, err := gateway.NewTLSConfig(gateway.TLSConfig{CertFile: files.cert, KeyFile: files.key, ClientCAFile: files.ca, RequireClientCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err = handshake(l, clientConfig(ca, newClientCert(t, ca, "alice", "alice@example.com"))); err != nil {
+		t.Error("Expected client certificate to be accepted, err:", err)
+	}
+	if _, err = handshake(l, clientConfig(ca, nil)); err == nil {
+		t.Error("Expected client without certificate to be refused")
+	}
+	if _, err = handshake(l, clientConfig(ca, newClientCert(t, newCA(t), "mallory", "mallory@example.com"))); err == nil {
+		t.Error("Expected client certificate of another CA to be refused")
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	ca := newCA(t)
+	files := writeTLSFiles(t, ca, newServerCert(t, ca, "before"))
+
+	conf, err := gateway.NewTLSConfig(gateway.TLSConfig{CertFile: files.cert, KeyFile: files.key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if cn, err := handshake(l, clientConfig(ca, nil)); err != nil || cn != "before" {
+		t.Fatal("Expected initial certificate, got", cn, err)
+	}
+
+	newServerCert(t, ca, "after").write(t, files.cert, files.key)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(files.cert, later, later)
+	os.Chtimes(files.key, later, later)
+	if cn, err := handshake(l, clientConfig(ca, nil)); err != nil || cn != "after" {
+		t.Error("Expected rotated certificate, got", cn, err)
+	}
+
+	os.WriteFile(files.cert, []byte("partial"), 0600)
+	os.Chtimes(files.cert, later.Add(time.Minute), later.Add(time.Minute))
+	if cn, err := handshake(l, clientConfig(ca, nil)); err != nil || cn != "after" {
+		t.Error("Expected previous certificate to be kept when reload fails, got", cn, err)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	ca := newCA(t)
+	client := newClientCert(t, ca, "alice", "alice@example.com")
+
+	if id, ok := gateway.CertIdentity(client.cert, gateway.CertCommonName); !ok || id != "alice" {
+		t.Error("Expected common name, got", id)
+	}
+	if id, ok := gateway.CertIdentity(client.cert, gateway.CertSAN); !ok || id != "alice@example.com" {
+		t.Error("Expected email SAN, got", id)
+	}
+
+	uri, _ := url.Parse("spiffe://example.com/sensor")
+	client = issue(t, &x509.Certificate{URIs: []*url.URL{uri}}, ca)
+	if id, ok := gateway.CertIdentity(client.cert, gateway.CertSAN); !ok || id != uri.String() {
+		t.Error("Expected URI SAN, got", id)
+	}
+	if _, ok := gateway.CertIdentity(client.cert, gateway.CertCommonName); ok {
+		t.Error("Expected missing common name")
+	}
+}
+
+func TestTLSClientIdentity(t *testing.T) {
+	ca := newCA(t)
+	files := writeTLSFiles(t, ca, newServerCert(t, ca, "server"))
+
+	cfg := gateway.TLSConfig{CertFile: files.cert, KeyFile: files.key, ClientCAFile: files.ca, RequireClientCert: true, ClientIdFrom: gateway.CertCommonName}
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TLS, Addr: "127.0.0.1:0", TLS: &cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	c, err := tls.Dial("tcp", l.Addr().String(), clientConfig(ca, newClientCert(t, ca, "sensor-1", "sensor@example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "spoofed", CleanStart: true, Properties: &packets.Properties{}}
+	if _, err = cp.WriteTo(c); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	recv, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := recv.Content.(*packets.Connack)
+	if !ok || ack.ReasonCode != 0 {
+		t.Fatal("Expected successful CONNACK, got", recv)
+	} else if ack.Properties.AssignedClientID != "sensor-1" {
+		t.Error("Expected client identifier from certificate, got", ack.Properties.AssignedClientID)
+	}
+}
+
+func TestTLSClientIdentityPassword(t *testing.T) {
+	f, err := auth.LoadPasswordFile(filepath.Join(t.TempDir(), "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Set("alice", []byte("wonderland")); err != nil {
+		t.Fatal(err)
+	}
+	gateway.UseCredentials(f)
+	defer gateway.UseCredentials(nil)
+
+	ca := newCA(t)
+	files := writeTLSFiles(t, ca, newServerCert(t, ca, "server"))
+	client := clientConfig(ca, newClientCert(t, ca, "sensor-1", "sensor@example.com"))
+
+	for _, c := range []struct {
+		from     gateway.TLSConfig
+		password string
+		rc       byte
+	}{
+		{gateway.TLSConfig{ClientIdFrom: gateway.CertCommonName}, "", byte(protocol.BadUsernamePassword)},
+		{gateway.TLSConfig{ClientIdFrom: gateway.CertCommonName}, "wonderland", 0},
+		{gateway.TLSConfig{UsernameFrom: gateway.CertCommonName}, "", 0},
+	} {
+		cfg := c.from
+		cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile, cfg.RequireClientCert = files.cert, files.key, files.ca, true
+		l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.TLS, Addr: "127.0.0.1:0", TLS: &cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go l.Serve()
+
+		conn, err := tls.Dial("tcp", l.Addr().String(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, CleanStart: true, UsernameFlag: true, Username: "alice", Properties: &packets.Properties{}}
+		if len(c.password) > 0 {
+			cp.PasswordFlag, cp.Password = true, []byte(c.password)
+		}
+		cp.WriteTo(conn)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		recv, err := packets.ReadPacket(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack, ok := recv.Content.(*packets.Connack); !ok || ack.ReasonCode != c.rc {
+			t.Error("Expected reason code", c.rc, "with password", c.password, ", got", recv)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package test
+
+import (
+	"bytes"
+	"goker/internal/gateway"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/gorilla/websocket"
+)
+
+func serveWS(t *testing.T, cfg gateway.ListenerConfig) string {
+	cfg.Transport, cfg.Addr = gateway.WS, "127.0.0.1:0"
+	l, err := gateway.Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go l.Serve()
+	return "ws://" + l.Addr().String()
+}
+
+func dialWS(url string, origin string, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{Subprotocols: subprotocols, HandshakeTimeout: time.Second}
+	header := http.Header{}
+	if len(origin) > 0 {
+		header.Set("Origin", origin)
+	}
+	return dialer.Dial(url, header)
+}
+
+// wsReader reads control packets from the binary messages of the broker.
+type wsReader struct {
+	c   *websocket.Conn
+	buf bytes.Buffer
+}
+
+func (r *wsReader) Read(b []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		_, msg, err := r.c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		r.buf.Write(msg)
+	}
+	return r.buf.Read(b)
+}
+
+func TestWebSocket(t *testing.T) {
+	url := serveWS(t, gateway.ListenerConfig{Path: "/mqtt"})
+
+	c, resp, err := dialWS(url+"/mqtt", "", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		t.Error("Expected mqtt subprotocol, got", resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+
+	// The CONNECT is split across two frames, then a SUBSCRIBE and a PINGREQ
+	// are coalesced into a single one.
+	var buf bytes.Buffer
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "over-ws", CleanStart: true, Properties: &packets.Properties{}}
+	cp.WriteTo(&buf)
+	connect := buf.Bytes()
+	for _, frame := range [][]byte{connect[:3], connect[3:]} {
+		if err = c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	r := &wsReader{c: c}
+	recv, err := packets.ReadPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, ok := recv.Content.(*packets.Connack); !ok || ack.ReasonCode != 0 {
+		t.Fatal("Expected successful CONNACK, got", recv)
+	}
+
+	buf.Reset()
+	sp := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.SubOptions{{Topic: "ws/topic", QoS: 1}}, Properties: &packets.Properties{}}
+	sp.WriteTo(&buf)
+	(&packets.Pingreq{}).WriteTo(&buf)
+	if err = c.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if recv, err = packets.ReadPacket(r); err != nil {
+		t.Fatal(err)
+	} else if ack, ok := recv.Content.(*packets.Suback); !ok || ack.PacketID != 1 {
+		t.Error("Expected SUBACK, got", recv)
+	}
+	if recv, err = packets.ReadPacket(r); err != nil {
+		t.Fatal(err)
+	} else if _, ok := recv.Content.(*packets.Pingresp); !ok {
+		t.Error("Expected PINGRESP, got", recv)
+	}
+
+	// Text frames are not allowed to carry MQTT.
+	if err = c.WriteMessage(websocket.TextMessage, []byte{0xC0, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.ReadMessage(); err == nil {
+		t.Error("Expected connection to be closed after a text frame")
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	url := serveWS(t, gateway.ListenerConfig{Origins: []string{"https://dashboard.example.com"}})
+
+	for _, tc := range []struct {
+		name         string
+		path         string
+		origin       string
+		subprotocols []string
+		status       int
+	}{
+		{"default path", "/mqtt", "", []string{"mqtt"}, http.StatusSwitchingProtocols},
+		{"allowed origin", "/mqtt", "https://DASHBOARD.example.com", []string{"mqtt"}, http.StatusSwitchingProtocols},
+		{"other path", "/", "", []string{"mqtt"}, http.StatusNotFound},
+		{"missing subprotocol", "/mqtt", "", nil, http.StatusBadRequest},
+		{"other subprotocol", "/mqtt", "", []string{"mqttv3.1"}, http.StatusBadRequest},
+		{"other origin", "/mqtt", "https://evil.example.com", []string{"mqtt"}, http.StatusForbidden},
+	} {
+		c, resp, err := dialWS(url+tc.path, tc.origin, tc.subprotocols...)
+		if c != nil {
+			c.Close()
+		}
+		if resp == nil {
+			t.Error(tc.name, "failed without response, err:", err)
+		} else if resp.StatusCode != tc.status {
+			t.Error(tc.name, "expected status", tc.status, "got", resp.StatusCode)
+		}
+	}
+}
+
+func TestSecureWebSocketClientIdentity(t *testing.T) {
+	ca := newCA(t)
+	files := writeTLSFiles(t, ca, newServerCert(t, ca, "server"))
+
+	cfg := gateway.TLSConfig{CertFile: files.cert, KeyFile: files.key, ClientCAFile: files.ca, RequireClientCert: true, ClientIdFrom: gateway.CertCommonName}
+	l, err := gateway.Listen(gateway.ListenerConfig{Transport: gateway.WSS, Addr: "127.0.0.1:0", TLS: &cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve()
+
+	dialer := websocket.Dialer{
+		Subprotocols:    []string{"mqtt"},
+		TLSClientConfig: clientConfig(ca, newClientCert(t, ca, "dashboard-1", "dashboard@example.com")),
+	}
+	c, _, err := dialer.Dial("wss://"+l.Addr().String()+"/mqtt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf bytes.Buffer
+	cp := &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, ClientID: "spoofed", CleanStart: true, Properties: &packets.Properties{}}
+	cp.WriteTo(&buf)
+	if err = c.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	recv, err := packets.ReadPacket(&wsReader{c: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := recv.Content.(*packets.Connack)
+	if !ok || ack.ReasonCode != 0 {
+		t.Fatal("Expected successful CONNACK, got", recv)
+	} else if ack.Properties.AssignedClientID != "dashboard-1" {
+		t.Error("Expected client identifier from certificate, got", ack.Properties.AssignedClientID)
+	}
+}
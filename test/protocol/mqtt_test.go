@@ -5,6 +5,7 @@ import (
 	"goker/internal/protocol"
 	"goker/internal/utils"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho"
@@ -94,8 +95,8 @@ func testConnackProp(pkt *packets.Connack, t *testing.T) {
 	if *pkt.Properties.SubIDAvailable == 1 {
 		t.Error("Expected subscription identifiers should be unvailable")
 	}
-	if *pkt.Properties.WildcardSubAvailable == 1 {
-		t.Error("Expected wildcard subscriptions should be unvailable")
+	if *pkt.Properties.WildcardSubAvailable != 1 {
+		t.Error("Expected wildcard subscriptions should be available")
 	}
 	if *pkt.Properties.SharedSubAvailable == 1 {
 		t.Error("Expected shared subscriptions should be unvailable")
@@ -124,3 +125,413 @@ func TestPublishPacket(t *testing.T) {
 	req.ResponseTo(buf)
 	utils.LogDebug(req.ToString())
 }
+
+func TestSubscribePacket(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	sp := &packets.Subscribe{
+		PacketID:   10,
+		Properties: &packets.Properties{},
+		Subscriptions: []packets.SubOptions{
+			{Topic: "sport/tennis/+", QoS: 0},
+			{Topic: "sport/#", QoS: 2, NoLocal: true},
+			{Topic: "sport/tennis#", QoS: 0},
+			{Topic: "sport/#/player", QoS: 1},
+		},
+	}
+	sp.WriteTo(buf)
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	sub, ok := req.(*protocol.SubscribeRequest)
+	if !ok || len(sub.Subscriptions()) != 4 {
+		t.Error("Expected SUBSCRIBE with 4 topic filters")
+		t.FailNow()
+	}
+	if !sub.Subscriptions()[1].Options().NoLocal() {
+		t.Error("Expected No Local option to be set")
+	}
+
+	buf.Reset()
+	req.ResponseTo(buf)
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ack, ok := recv.Content.(*packets.Suback)
+	if recv.Type != packets.SUBACK || !ok {
+		t.Error("Expected SUBACK got", recv.PacketType())
+		t.FailNow()
+	}
+	if ack.PacketID != 10 {
+		t.Error("Expected packet identifier 10, got", ack.PacketID)
+	}
+	expected := []byte{0x00, 0x02, 0x8F, 0x8F}
+	if !bytes.Equal(ack.Reasons, expected) {
+		t.Error("Expected reason codes", expected, ", got", ack.Reasons)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0x82, 0x08, 0x00, 0x01, 0x00, 0x00, 0x02, 'a', '/', 0xC0})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing reserved subscription options case")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0x82, 0x03, 0x00, 0x01, 0x00})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing empty topic filter list case")
+	}
+}
+
+func TestSharedSubscriptionFilter(t *testing.T) {
+	share, filter, ok := protocol.SplitSharedFilter("$share/workers/jobs/#")
+	if !ok || share != "workers" || filter != "jobs/#" {
+		t.Error("Expected Share Name workers and topic filter jobs/#, got", share, filter, ok)
+	}
+	if _, _, ok = protocol.SplitSharedFilter("$SYS/share/jobs"); ok {
+		t.Error("Expected $SYS/share/jobs not to be a shared subscription")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	sp := &packets.Subscribe{PacketID: 1, Properties: &packets.Properties{}, Subscriptions: []packets.SubOptions{{Topic: "$share/workers/jobs", NoLocal: true}}}
+	sp.WriteTo(buf)
+	if _, err := parsePacket(buf); protocol.ReasonOf(err, protocol.Unspecified) != protocol.ProtocolError {
+		t.Error("Expected Protocol Error for No Local on a shared subscription, got", err)
+	}
+}
+
+func TestPublishQoS1Packet(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	pp := &packets.Publish{PacketID: 7, QoS: 1, Topic: "a/b", Payload: []byte("x"), Properties: &packets.Properties{}}
+	pp.WriteTo(buf)
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	buf.Reset()
+	req.ResponseTo(buf)
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ack, ok := recv.Content.(*packets.Puback)
+	if recv.Type != packets.PUBACK || !ok {
+		t.Error("Expected PUBACK got", recv.PacketType())
+		t.FailNow()
+	}
+	if ack.PacketID != 7 || ack.ReasonCode != 0 {
+		t.Error("Expected PUBACK for packet 7 with Success, got", ack.PacketID, ack.ReasonCode)
+	}
+
+	buf.Reset()
+	pa := &packets.Puback{PacketID: 7, ReasonCode: 0x10, Properties: &packets.Properties{ReasonString: "none"}}
+	pa.WriteTo(buf)
+	req, err = parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	puback, ok := req.(*protocol.AckRequest)
+	if !ok || puback.PacketId() != 7 || puback.Reason() != protocol.NoMatchingSubscribers {
+		t.Error("Expected PUBACK for packet 7 with No Matching Subscribers")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0x32, 0x06, 0x00, 0x01, 'a', 0x00, 0x00, 0x00})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing zero packet identifier case")
+	}
+}
+
+func TestPublishQoS2Packet(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	pp := &packets.Publish{PacketID: 9, QoS: 2, Topic: "a/b", Payload: []byte("x"), Properties: &packets.Properties{}}
+	pp.WriteTo(buf)
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	buf.Reset()
+	req.ResponseTo(buf)
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if rec, ok := recv.Content.(*packets.Pubrec); !ok || rec.PacketID != 9 {
+		t.Error("Expected PUBREC for packet 9 got", recv.PacketType())
+	}
+
+	buf.Reset()
+	pr := &packets.Pubrel{PacketID: 9, Properties: &packets.Properties{}}
+	pr.WriteTo(buf)
+	req, err = parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if rel, ok := req.(*protocol.AckRequest); !ok || rel.Type() != protocol.PUBREL || rel.PacketId() != 9 {
+		t.Error("Expected PUBREL for packet 9")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0x60, 0x02, 0x00, 0x09})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing invalid PUBREL fixed header flags case")
+	}
+
+	buf.Reset()
+	protocol.NewAck(protocol.PUBCOMP, 9, protocol.PacketIdentifierNotFound).WriteTo(buf)
+	recv, err = packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if comp, ok := recv.Content.(*packets.Pubcomp); !ok || comp.PacketID != 9 || comp.ReasonCode != 0x92 {
+		t.Error("Expected PUBCOMP for packet 9 with Packet Identifier Not Found")
+	}
+}
+
+func TestConnectWillFlags(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	buf.Write([]byte{16, 13, 0, 4, 'M', 'Q', 'T', 'T', 5, 0b00001010, 0, 30, 0, 0, 0})
+	if _, err := parsePacket(buf); err == nil {
+		t.Error("Missing will QoS without will flag case")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{16, 13, 0, 4, 'M', 'Q', 'T', 'T', 5, 0b00100010, 0, 30, 0, 0, 0})
+	if _, err := parsePacket(buf); err == nil {
+		t.Error("Missing will retain without will flag case")
+	}
+
+	for _, tc := range []struct {
+		qos    byte
+		retain bool
+	}{{0, true}, {2, false}, {1, true}} {
+		buf.Reset()
+		cp := &packets.Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: 5,
+			ClientID:        "dev",
+			Properties:      &packets.Properties{},
+			WillFlag:        true,
+			WillQOS:         tc.qos,
+			WillRetain:      tc.retain,
+			WillTopic:       "status/dev",
+			WillMessage:     []byte("offline"),
+			WillProperties:  &packets.Properties{},
+		}
+		cp.WriteTo(buf)
+		req, err := parsePacket(buf)
+		if err != nil {
+			t.Error("Failed to parse will with QoS", tc.qos, "and retain", tc.retain, ", err:", err)
+			continue
+		}
+		connect := req.(*protocol.ConnectRequest)
+		if will := connect.Will(); will.QoS() != protocol.QoS(tc.qos) || will.Retain() != tc.retain {
+			t.Error("Expected will with QoS", tc.qos, "and retain", tc.retain, ", got", will.QoS(), will.Retain())
+		}
+		connect.SetRetainAvailable(false)
+		if rc := connect.Connack().Reason(); (rc == protocol.RetainNotSupported) != tc.retain {
+			t.Error("Expected only a retained will to be refused when retain is unavailable, got", rc)
+		}
+	}
+
+	buf.Reset()
+	cp := &packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		ClientID:        "dev",
+		Properties:      &packets.Properties{},
+		WillFlag:        true,
+		WillTopic:       "status/+",
+		WillMessage:     []byte("offline"),
+		WillProperties:  &packets.Properties{},
+	}
+	cp.WriteTo(buf)
+	if _, err := parsePacket(buf); err == nil {
+		t.Error("Missing wildcard will topic case")
+	}
+}
+
+func TestPingPacket(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	buf.Write([]byte{0xC0, 0x00})
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	buf.Reset()
+	req.ResponseTo(buf)
+	if !bytes.Equal(buf.Bytes(), []byte{0xD0, 0x00}) {
+		t.Error("Expected PINGRESP, got", buf.Bytes())
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0xC1, 0x00})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing invalid PINGREQ fixed header flags case")
+	}
+}
+
+func TestDisconnectPacket(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	expiry := uint32(30)
+	dp := &packets.Disconnect{
+		ReasonCode: 0x04,
+		Properties: &packets.Properties{SessionExpiryInterval: &expiry, ReasonString: "bye"},
+	}
+	dp.WriteTo(buf)
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	disc, ok := req.(*protocol.DisconnectRequest)
+	if !ok || disc.Reason() != protocol.DisconnectWithWillMessage || disc.ReasonString() != "bye" {
+		t.Error("Expected DISCONNECT with will message and reason string")
+	}
+	if d, ok := disc.SessionExpiryInterval(); !ok || d != 30*time.Second {
+		t.Error("Expected Session Expiry Interval of 30 seconds, got", d)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0xE0, 0x00})
+	if req, err = parsePacket(buf); err != nil {
+		t.Error(err)
+	} else if req.(*protocol.DisconnectRequest).Reason() != protocol.NormalDisconnection {
+		t.Error("Expected Normal Disconnection when reason code is omitted")
+	}
+
+	buf.Reset()
+	protocol.NewDisconnect(protocol.KeepAliveTimeout, "timeout").WriteTo(buf)
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if d, ok := recv.Content.(*packets.Disconnect); !ok || d.ReasonCode != 0x8D || d.Properties.ReasonString != "timeout" {
+		t.Error("Expected DISCONNECT with Keep Alive timeout")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0xE0, 0x02, 0x00, 0x00})
+	buf.Write([]byte{0xD0, 0x00})
+	if _, err = parsePacket(buf); err != nil {
+		t.Error(err)
+	}
+	if _, err = parsePacket(buf); protocol.ReasonOf(err, protocol.Unspecified) != protocol.ProtocolError {
+		t.Error("Expected Protocol Error for unsupported packet, got", err)
+	}
+}
+
+func TestAuthPacket(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	ap := &packets.Auth{
+		ReasonCode: 0x19,
+		Properties: &packets.Properties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte("n,,n=user,r=abc")},
+	}
+	ap.WriteTo(buf)
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	a, ok := req.(*protocol.AuthRequest)
+	if !ok || a.Reason() != protocol.ReAuthenticate || a.AuthenticationMethod() != "SCRAM-SHA-256" || string(a.AuthenticationData()) != "n,,n=user,r=abc" {
+		t.Error("Expected AUTH to re-authenticate with SCRAM-SHA-256")
+	}
+
+	buf.Reset()
+	protocol.NewAuth(protocol.ContinueAuthentication, "SCRAM-SHA-256", []byte("r=abc,s=c2FsdA==,i=4096")).WriteTo(buf)
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if a, ok := recv.Content.(*packets.Auth); !ok || a.ReasonCode != 0x18 || a.Properties.AuthMethod != "SCRAM-SHA-256" || string(a.Properties.AuthData) != "r=abc,s=c2FsdA==,i=4096" {
+		t.Error("Expected AUTH continuing authentication")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0xF0, 0x02, 0x04, 0x00})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing invalid AUTH reason code case")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0xF0, 0x05, 0x18, 0x03, 0x16, 0x00, 0x00})
+	if _, err = parsePacket(buf); err == nil {
+		t.Error("Missing Authentication Data without Authentication Method case")
+	}
+}
+
+func TestConnectAuthentication(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	cp := &packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		ClientID:        "dev",
+		Properties:      &packets.Properties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte("n,,n=user,r=abc")},
+	}
+	cp.WriteTo(buf)
+	req, err := parsePacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	connect := req.(*protocol.ConnectRequest)
+	if connect.AuthenticationMethod() != "SCRAM-SHA-256" || string(connect.AuthenticationData()) != "n,,n=user,r=abc" {
+		t.Error("Expected SCRAM-SHA-256 authentication in CONNECT")
+	}
+
+	buf.Reset()
+	connect.SetAuthenticationData([]byte("v=signature"))
+	if _, err = connect.ResponseTo(buf); err != nil {
+		t.Error(err)
+	}
+	recv, err := packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ack := recv.Content.(*packets.Connack)
+	if ack.Properties.AuthMethod != "SCRAM-SHA-256" || string(ack.Properties.AuthData) != "v=signature" {
+		t.Error("Expected final authentication data in CONNACK")
+	}
+
+	buf.Reset()
+	connect.SetSessionPresent(true)
+	connect.Refuse(protocol.BadAuthenticationMethod)
+	if _, err = connect.ResponseTo(buf); err == nil {
+		t.Error("Expected refused CONNACK to return an error")
+	}
+	recv, err = packets.ReadPacket(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if ack = recv.Content.(*packets.Connack); ack.ReasonCode != 0x8C || ack.SessionPresent {
+		t.Error("Expected CONNACK with Bad Authentication Method, got", ack.ReasonCode)
+	}
+}
@@ -0,0 +1,188 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"goker/internal/protocol"
+	"strings"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// TestPacketRoundTrip checks that every control packet written by paho is
+// decoded, then encoded into a packet paho reads back unchanged.
+func TestPacketRoundTrip(t *testing.T) {
+	user := []packets.User{{Key: "trace-id", Value: "4bf92f3577b34da6"}, {Key: "tenant", Value: "acme"}, {Key: "tenant", Value: "globex"}}
+	for _, tc := range []struct {
+		ctl    protocol.CType
+		packet *packets.ControlPacket
+	}{
+		{protocol.CONNECT, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.CONNECT}, Content: &packets.Connect{
+			ProtocolName: "MQTT", ProtocolVersion: 5, CleanStart: true, KeepAlive: 30, ClientID: "client-1",
+			UsernameFlag: true, Username: "user", PasswordFlag: true, Password: []byte("secret"),
+			WillFlag: true, WillQOS: 1, WillRetain: true, WillTopic: "clients/client-1/status", WillMessage: []byte("offline"),
+			WillProperties: &packets.Properties{WillDelayInterval: ptr(uint32(10)), MessageExpiry: ptr(uint32(60)), ContentType: "text/plain", User: user},
+			Properties:     &packets.Properties{SessionExpiryInterval: ptr(uint32(3600)), ReceiveMaximum: ptr(uint16(20)), MaximumPacketSize: ptr(uint32(1 << 20)), TopicAliasMaximum: ptr(uint16(8)), RequestResponseInfo: ptr(byte(1)), AuthMethod: "SCRAM-SHA-256", AuthData: []byte("n,,n=user,r=nonce")},
+		}}},
+		{protocol.CONNACK, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.CONNACK}, Content: &packets.Connack{
+			SessionPresent: true,
+			Properties:     &packets.Properties{AssignedClientID: "auto-1", ServerKeepAlive: ptr(uint16(60)), RetainAvailable: ptr(byte(0)), WildcardSubAvailable: ptr(byte(1)), SubIDAvailable: ptr(byte(0)), SharedSubAvailable: ptr(byte(0)), TopicAliasMaximum: ptr(uint16(10)), MaximumQOS: ptr(byte(1)), ReasonString: "welcome", User: user},
+		}}},
+		{protocol.CONNACK, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.CONNACK}, Content: &packets.Connack{
+			ReasonCode: byte(protocol.NotAuthorized), Properties: &packets.Properties{},
+		}}},
+		{protocol.PUBLISH, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBLISH, Flags: 0b1011}, Content: &packets.Publish{
+			Topic: "sensors/temperature", QoS: 1, Retain: true, Duplicate: true, PacketID: 7, Payload: []byte("21.5"),
+			Properties: &packets.Properties{PayloadFormat: ptr(byte(1)), MessageExpiry: ptr(uint32(120)), ContentType: "text/plain", ResponseTopic: "replies", CorrelationData: []byte{1, 2}, User: user},
+		}}},
+		{protocol.PUBLISH, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBLISH}, Content: &packets.Publish{
+			Topic: "sensors/humidity", Payload: []byte{}, Properties: &packets.Properties{},
+		}}},
+		{protocol.PUBACK, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBACK}, Content: &packets.Puback{
+			PacketID: 7, ReasonCode: byte(protocol.NoMatchingSubscribers), Properties: &packets.Properties{ReasonString: "nobody listens"},
+		}}},
+		{protocol.PUBREC, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBREC}, Content: &packets.Pubrec{
+			PacketID: 8, Properties: &packets.Properties{},
+		}}},
+		{protocol.PUBREL, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBREL, Flags: 0b0010}, Content: &packets.Pubrel{
+			PacketID: 8, Properties: &packets.Properties{User: user},
+		}}},
+		{protocol.PUBCOMP, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBCOMP}, Content: &packets.Pubcomp{
+			PacketID: 8, ReasonCode: byte(protocol.PacketIdentifierNotFound), Properties: &packets.Properties{},
+		}}},
+		{protocol.SUBSCRIBE, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.SUBSCRIBE, Flags: 0b0010}, Content: &packets.Subscribe{
+			PacketID: 9,
+			Subscriptions: []packets.SubOptions{
+				{Topic: "sensors/#", QoS: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+				{Topic: "alerts/+", QoS: 0, RetainHandling: 1},
+			},
+			Properties: &packets.Properties{SubscriptionIdentifier: ptr(42), User: user},
+		}}},
+		{protocol.SUBACK, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.SUBACK}, Content: &packets.Suback{
+			PacketID: 9, Reasons: []byte{2, 0, byte(protocol.TopicFilterInvalid)}, Properties: &packets.Properties{ReasonString: "partial"},
+		}}},
+		{protocol.UNSUBSCRIBE, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.UNSUBSCRIBE, Flags: 0b0010}, Content: &packets.Unsubscribe{
+			PacketID: 10, Topics: []string{"sensors/#", "alerts/+"}, Properties: &packets.Properties{User: user},
+		}}},
+		{protocol.UNSUBACK, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.UNSUBACK}, Content: &packets.Unsuback{
+			PacketID: 10, Reasons: []byte{0, byte(protocol.NoSubscriptionExisted)}, Properties: &packets.Properties{},
+		}}},
+		{protocol.PINGREQ, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PINGREQ}, Content: &packets.Pingreq{}}},
+		{protocol.PINGRESP, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PINGRESP}, Content: &packets.Pingresp{}}},
+		{protocol.DISCONNECT, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.DISCONNECT}, Content: &packets.Disconnect{
+			ReasonCode: byte(protocol.DisconnectWithWillMessage), Properties: &packets.Properties{SessionExpiryInterval: ptr(uint32(0)), ReasonString: "bye"},
+		}}},
+		{protocol.AUTH, &packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.AUTH}, Content: &packets.Auth{
+			ReasonCode: byte(protocol.ContinueAuthentication), Properties: &packets.Properties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte("r=nonce,s=salt,i=4096")},
+		}}},
+	} {
+		name := tc.packet.PacketType()
+		encoded := bytes.NewBuffer(make([]byte, 0))
+		if _, err := tc.packet.WriteTo(encoded); err != nil {
+			t.Fatal(name, err)
+		}
+		expected := bytes.Clone(encoded.Bytes())
+
+		p, err := protocol.DecodePacket(encoded)
+		if err != nil {
+			t.Error(name, "failed to decode, err:", err)
+			continue
+		} else if p.Type() != tc.ctl {
+			t.Error(name, "decoded as type", p.Type())
+			continue
+		} else if encoded.Len() != 0 {
+			t.Error(name, "left", encoded.Len(), "bytes unread")
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err = p.Encode(buf); err != nil {
+			t.Error(name, "failed to encode, err:", err)
+			continue
+		}
+		cp, err := packets.ReadPacket(buf)
+		if err != nil {
+			t.Error(name, "encoded a packet paho fails to read, err:", err)
+			continue
+		}
+		actual := bytes.NewBuffer(make([]byte, 0))
+		cp.WriteTo(actual)
+		if !bytes.Equal(actual.Bytes(), expected) {
+			t.Errorf("%s did not round-trip\nexpected %v\ngot      %v", name, expected, actual.Bytes())
+		}
+
+		// Decoding into a packet of the type gives the same packet.
+		again, _ := protocol.NewPacket(tc.ctl)
+		if err = again.Decode(bytes.NewBuffer(expected)); err != nil {
+			t.Error(name, "failed to decode into packet of its type, err:", err)
+		}
+	}
+}
+
+// TestPacketEncodeErrors checks that a packet which cannot be encoded fails
+// without writing anything, rather than writing a packet which cannot be
+// decoded.
+func TestPacketEncodeErrors(t *testing.T) {
+	long := strings.Repeat("k", 65536)
+	withProperty := protocol.NewPublish("a/b", []byte("x"), protocol.QoS0, false)
+	withProperty.AddUserProperty(long, "v")
+	connect := protocol.NewConnect("c1", true, 0)
+	connect.SetUsername("a\x00b")
+
+	for name, p := range map[string]protocol.Packet{
+		"topic with null character": protocol.NewPublish("a\x00b", []byte("x"), protocol.QoS0, false),
+		"invalid utf-8 topic":       protocol.NewPublish("a\xffb", []byte("x"), protocol.QoS0, false),
+		"long user property":        withProperty,
+		"user name":                 connect,
+		"unsubscribe filter":        protocol.NewUnsubscribe(1, long),
+		"disconnect reason string":  protocol.NewDisconnect(protocol.Unspecified, "a\x00b"),
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := p.Encode(buf); err == nil {
+			t.Error("Expected", name, "to fail encoding")
+		} else if buf.Len() != 0 {
+			t.Error("Expected nothing written for", name, "got", buf.Bytes())
+		}
+	}
+
+	// The same packets encode and decode back once valid.
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := protocol.NewPublish("a/b", []byte("x"), protocol.QoS0, false).Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := protocol.DecodePacket(buf); err != nil {
+		t.Error(err)
+	} else if pub, ok := p.(*protocol.PublishRequest); !ok || pub.Topic() != "a/b" {
+		t.Error("Expected PUBLISH on a/b, got", p)
+	}
+}
+
+func TestPacketDecodeErrors(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	(&packets.Pingreq{}).WriteTo(buf)
+	var reasonErr *protocol.ReasonError
+	if err := (&protocol.PublishRequest{}).Decode(buf); !errors.As(err, &reasonErr) || reasonErr.Reason() != protocol.ProtocolError {
+		t.Error("Expected Protocol Error decoding PINGREQ as PUBLISH, got", err)
+	}
+
+	for name, encoded := range map[string][]byte{
+		"reserved type":         {0x00, 0x00},
+		"subscribe flags":       {0x80, 0x06, 0x00, 0x01, 0x00, 0x00, 0x01, 'a'},
+		"subscribe without sub": {0x82, 0x03, 0x00, 0x01, 0x00},
+		"unsubscribe packet id": {0xa2, 0x06, 0x00, 0x00, 0x00, 0x00, 0x01, 'a'},
+		"suback without reason": {0x90, 0x03, 0x00, 0x01, 0x00},
+		"connack session flags": {0x20, 0x03, 0x02, 0x00, 0x00},
+		"pingresp with body":    {0xd0, 0x01, 0x00},
+		"truncated remaining":   {0x30, 0x80, 0x80, 0x80, 0x80, 0x01},
+		"non-minimal remaining": {0xc0, 0x80, 0x00},
+	} {
+		_, err := protocol.DecodePacket(bytes.NewBuffer(encoded))
+		if !errors.As(err, &reasonErr) {
+			t.Error("Expected a reason error for", name, "got", err)
+		}
+	}
+}
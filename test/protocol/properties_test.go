@@ -0,0 +1,61 @@
+package test
+
+import (
+	"bytes"
+	"goker/internal/protocol"
+	"testing"
+)
+
+// frame prepends the fixed header to the body of a packet.
+func frame(ctl byte, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	return append([]byte{ctl, byte(len(b))}, b...)
+}
+
+func props(p ...byte) []byte {
+	return append([]byte{byte(len(p))}, p...)
+}
+
+func TestPropertyValidity(t *testing.T) {
+	topic := []byte{0x00, 0x01, 'a'}
+	publish := func(p []byte) []byte {
+		return frame(0x30, topic, p)
+	}
+	connect := func(p []byte) []byte {
+		return frame(0x10, []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C}, p, []byte{0x00, 0x01, 'c'})
+	}
+	will := func(p []byte) []byte {
+		return frame(0x10, []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x06, 0x00, 0x3C}, props(), []byte{0x00, 0x01, 'c'}, p, topic, []byte{0x00, 0x00})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		encoded []byte
+		reason  protocol.ReasonCode
+	}{
+		{"publish", publish(props(0x01, 0x01, 0x03, 0x00, 0x01, 'x', 0x23, 0x00, 0x01)), protocol.Success},
+		{"repeated user property", publish(props(0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', 0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'w')), protocol.Success},
+		{"session expiry in publish", publish(props(0x11, 0x00, 0x00, 0x00, 0x0A)), protocol.ProtocolError},
+		{"duplicate content type", publish(props(0x03, 0x00, 0x01, 'x', 0x03, 0x00, 0x01, 'y')), protocol.ProtocolError},
+		{"topic alias without topic name", frame(0x30, []byte{0x00, 0x00}, props(0x23, 0x00, 0x01)), protocol.Success},
+		{"empty topic name", frame(0x30, []byte{0x00, 0x00}, props()), protocol.InvalidTopicName},
+		{"topic alias 0", publish(props(0x23, 0x00, 0x00)), protocol.ProtocolError},
+		{"unknown property", publish(props(0x7F, 0x00)), protocol.MalformedPacket},
+		{"property past its length", publish([]byte{0x02, 0x23, 0x00, 0x01}), protocol.MalformedPacket},
+		{"connect", connect(props(0x21, 0x00, 0x0A, 0x27, 0x00, 0x00, 0x10, 0x00)), protocol.Success},
+		{"receive maximum 0", connect(props(0x21, 0x00, 0x00)), protocol.ProtocolError},
+		{"topic alias in connect", connect(props(0x23, 0x00, 0x01)), protocol.ProtocolError},
+		{"will delay in connect", connect(props(0x18, 0x00, 0x00, 0x00, 0x01)), protocol.ProtocolError},
+		{"will", will(props(0x18, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x3C)), protocol.Success},
+		{"duplicate will delay", will(props(0x18, 0x00, 0x00, 0x00, 0x01, 0x18, 0x00, 0x00, 0x00, 0x02)), protocol.ProtocolError},
+		{"session expiry in will", will(props(0x11, 0x00, 0x00, 0x00, 0x01)), protocol.ProtocolError},
+		{"reason string in suback", frame(0x90, []byte{0x00, 0x01}, props(0x1F, 0x00, 0x01, 'x'), []byte{0x00}), protocol.Success},
+		{"server reference in suback", frame(0x90, []byte{0x00, 0x01}, props(0x1C, 0x00, 0x01, 'x'), []byte{0x00}), protocol.ProtocolError},
+		{"maximum qos in disconnect", frame(0xE0, []byte{0x00}, props(0x24, 0x01)), protocol.ProtocolError},
+	} {
+		_, err := protocol.DecodePacket(bytes.NewBuffer(tc.encoded))
+		if rc := protocol.ReasonOf(err, protocol.Success); rc != tc.reason {
+			t.Errorf("Expected %s to decode with reason %#x, got %v", tc.name, tc.reason, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"goker/internal/protocol"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestPacketReader(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	payload := bytes.Repeat([]byte("0123456789"), 2000)
+	pp := &packets.Publish{Topic: "large/payload", Payload: payload, Properties: &packets.Properties{}}
+	pp.WriteTo(buf)
+	(&packets.Unsubscribe{PacketID: 3, Topics: []string{"a/#", "b"}, Properties: &packets.Properties{}}).WriteTo(buf)
+	(&packets.Pingreq{}).WriteTo(buf)
+
+	// The PUBLISH needs a Remaining Length of 3 bytes, and every read returns
+	// a single byte as when a packet arrives in many segments.
+	r := protocol.NewPacketReader(iotest.OneByteReader(buf), 0)
+	req, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := req.(*protocol.PublishRequest)
+	if !ok {
+		t.Fatal("Expected PUBLISH, got", req.ToString())
+	} else if pub.Topic() != "large/payload" || !bytes.Equal(pub.Payload(), payload) {
+		t.Error("Expected PUBLISH to be read whole, got topic", pub.Topic(), "and", len(pub.Payload()), "bytes of payload")
+	}
+
+	if req, err = r.ReadPacket(); err != nil {
+		t.Fatal(err)
+	} else if unsub, ok := req.(*protocol.UnsubscribeRequest); !ok || unsub.PacketId() != 3 || len(unsub.Filters()) != 2 {
+		t.Error("Expected UNSUBSCRIBE, got", req.ToString())
+	}
+	if req, err = r.ReadPacket(); err != nil {
+		t.Fatal(err)
+	} else if _, ok = req.(*protocol.PingRequest); !ok {
+		t.Error("Expected PINGREQ, got", req.ToString())
+	}
+	if _, err = r.ReadPacket(); err != io.EOF {
+		t.Error("Expected end of stream, got", err)
+	}
+}
+
+func TestPacketReaderErrors(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	pp := &packets.Publish{Topic: "topic", Payload: make([]byte, 200), Properties: &packets.Properties{}}
+	pp.WriteTo(buf)
+	size := buf.Len()
+
+	if _, err := protocol.NewPacketReader(bytes.NewReader(buf.Bytes()), uint32(size)).ReadPacket(); err != nil {
+		t.Error("Expected packet of the maximum size to be accepted, err:", err)
+	}
+	_, err := protocol.NewPacketReader(bytes.NewReader(buf.Bytes()), uint32(size-1)).ReadPacket()
+	if protocol.ReasonOf(err, protocol.Success) != protocol.PacketTooLarge {
+		t.Error("Expected Packet Too Large, got", err)
+	}
+
+	_, err = protocol.NewPacketReader(bytes.NewReader(buf.Bytes()[:size-1]), 0).ReadPacket()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("Expected truncated packet to fail, got", err)
+	}
+
+	_, err = protocol.NewPacketReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}), 0).ReadPacket()
+	if protocol.ReasonOf(err, protocol.Success) != protocol.MalformedPacket {
+		t.Error("Expected Remaining Length of 5 bytes to be malformed, got", err)
+	}
+	_, err = protocol.NewPacketReader(bytes.NewReader([]byte{0xc0, 0x80, 0x00}), 0).ReadPacket()
+	if protocol.ReasonOf(err, protocol.Success) != protocol.MalformedPacket {
+		t.Error("Expected non-minimal Remaining Length to be malformed, got", err)
+	}
+
+	buf.Reset()
+	(&packets.Connack{Properties: &packets.Properties{}}).WriteTo(buf)
+	_, err = protocol.NewPacketReader(buf, 0).ReadPacket()
+	if protocol.ReasonOf(err, protocol.Success) != protocol.ProtocolError {
+		t.Error("Expected CONNACK from a client to be a Protocol Error, got", err)
+	}
+}
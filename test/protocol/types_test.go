@@ -0,0 +1,186 @@
+package test
+
+import (
+	"bytes"
+	"goker/internal/protocol"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestVarByteInt(t *testing.T) {
+	for _, tc := range []struct {
+		value   protocol.VarByteInt
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xFF, 0xFF, 0x7F}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := tc.value.Encode(buf); err != nil {
+			t.Error("Failed to encode", tc.value, "err:", err)
+			continue
+		} else if !bytes.Equal(buf.Bytes(), tc.encoded) {
+			t.Error("Expected", tc.value, "to encode as", tc.encoded, "got", buf.Bytes())
+		} else if tc.value.Size() != len(tc.encoded) {
+			t.Error("Expected size of", tc.value, "to be", len(tc.encoded), "got", tc.value.Size())
+		}
+
+		var v protocol.VarByteInt
+		if err := v.Decode(buf); err != nil || v != tc.value || buf.Len() != 0 {
+			t.Error("Expected to decode", tc.value, "got", v, err)
+		}
+	}
+
+	if err := protocol.VarByteInt(268435456).Encode(bytes.NewBuffer(make([]byte, 0))); err == nil {
+		t.Error("Missing too large Variable Byte Integer case")
+	}
+	var v protocol.VarByteInt
+	if err := v.Decode(bytes.NewBuffer([]byte{0x80, 0x80, 0x80, 0x80, 0x01})); err == nil {
+		t.Error("Missing Variable Byte Integer of 5 bytes case")
+	}
+	if err := v.Decode(bytes.NewBuffer([]byte{0x80, 0x80})); err == nil {
+		t.Error("Missing truncated Variable Byte Integer case")
+	}
+	for _, encoded := range [][]byte{{0x80, 0x00}, {0xFF, 0x80, 0x00}, {0x81, 0x80, 0x80, 0x00}} {
+		if err := v.Decode(bytes.NewBuffer(encoded)); err == nil {
+			t.Error("Missing non-minimal Variable Byte Integer case", encoded)
+		}
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	for _, value := range []protocol.TwoByteInteger{0, 1, 255, 256, 65535} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		value.Encode(buf)
+		var v protocol.TwoByteInteger
+		if buf.Len() != value.Size() || v.Decode(buf) != nil || v != value {
+			t.Error("Expected Two Byte Integer", value, "to round-trip, got", v)
+		}
+	}
+	for _, value := range []protocol.FourByteInteger{0, 1, 65535, 65536, 4294967295} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		value.Encode(buf)
+		var v protocol.FourByteInteger
+		if buf.Len() != value.Size() || v.Decode(buf) != nil || v != value {
+			t.Error("Expected Four Byte Integer", value, "to round-trip, got", v)
+		}
+	}
+
+	var two protocol.TwoByteInteger
+	if err := two.Decode(bytes.NewBuffer([]byte{0x01})); err == nil {
+		t.Error("Missing truncated Two Byte Integer case")
+	}
+	var four protocol.FourByteInteger
+	if err := four.Decode(bytes.NewBuffer([]byte{0x01, 0x02, 0x03})); err == nil {
+		t.Error("Missing truncated Four Byte Integer case")
+	}
+	var b protocol.ByteInteger
+	if err := b.Decode(bytes.NewBuffer([]byte{0x02})); err == nil {
+		t.Error("Missing Byte Integer other than 0 and 1 case")
+	}
+}
+
+func TestUTF8String(t *testing.T) {
+	for _, value := range []protocol.UTF8String{"", "a", "goker/ưu tiên/温度", protocol.UTF8String(strings.Repeat("x", 65535))} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := value.Encode(buf); err != nil {
+			t.Error("Failed to encode string of", len(value), "bytes, err:", err)
+			continue
+		} else if buf.Len() != value.Size() {
+			t.Error("Expected size", value.Size(), "got", buf.Len())
+		}
+		var v protocol.UTF8String
+		if err := v.Decode(buf); err != nil || v != value {
+			t.Error("Expected string of", len(value), "bytes to round-trip, err:", err)
+		}
+	}
+
+	for _, value := range []protocol.UTF8String{protocol.UTF8String(strings.Repeat("x", 65536)), "\xff\xfe", "null\x00char"} {
+		if err := value.Encode(bytes.NewBuffer(make([]byte, 0))); err == nil {
+			t.Errorf("Missing invalid string case %q", value[:min(len(value), 16)])
+		}
+	}
+	for _, encoded := range [][]byte{{0x00}, {0x00, 0x03, 'a', 'b'}, {0x00, 0x02, 0xff, 0xfe}, {0x00, 0x01, 0x00}} {
+		var v protocol.UTF8String
+		if err := v.Decode(bytes.NewBuffer(encoded)); err == nil {
+			t.Error("Missing invalid encoded string case", encoded)
+		}
+	}
+
+	pair := protocol.NewUTF8StringPair("trace-id", "4bf92f3577b34da6")
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := pair.Encode(buf); err != nil || buf.Len() != pair.Size() {
+		t.Error("Failed to encode string pair, err:", err)
+	}
+	var v protocol.UTF8StringPair
+	if err := v.Decode(buf); err != nil || v != pair {
+		t.Error("Expected string pair to round-trip, got", v.Key(), v.Value(), err)
+	}
+	if err := protocol.NewUTF8StringPair("key", "\x00").Encode(buf); err == nil {
+		t.Error("Missing invalid value of string pair case")
+	}
+}
+
+func TestBinaryData(t *testing.T) {
+	for _, value := range []protocol.BinaryData{{}, {0x00}, bytes.Repeat([]byte{0xff}, 65535)} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := value.Encode(buf); err != nil || buf.Len() != value.Size() {
+			t.Error("Failed to encode Binary Data of", len(value), "bytes, err:", err)
+			continue
+		}
+		var v protocol.BinaryData
+		if err := v.Decode(buf); err != nil || !bytes.Equal(v, value) {
+			t.Error("Expected Binary Data of", len(value), "bytes to round-trip, err:", err)
+		}
+	}
+
+	if err := protocol.BinaryData(make([]byte, 65536)).Encode(bytes.NewBuffer(make([]byte, 0))); err == nil {
+		t.Error("Missing too long Binary Data case")
+	}
+	var v protocol.BinaryData
+	if err := v.Decode(bytes.NewBuffer([]byte{0x00, 0x02, 0x01})); err == nil {
+		t.Error("Missing truncated Binary Data case")
+	}
+}
+
+// TestRoundTrip checks that arbitrary values decode to what they encode, and
+// that Size tells the length of the encoding.
+func TestRoundTrip(t *testing.T) {
+	varByteInt := func(x uint32) bool {
+		value := protocol.VarByteInt(x % (protocol.MaxVarByteInt + 1))
+		buf := bytes.NewBuffer(make([]byte, 0))
+		var v protocol.VarByteInt
+		return value.Encode(buf) == nil && buf.Len() == value.Size() && v.Decode(buf) == nil && v == value
+	}
+	utf8String := func(s string) bool {
+		value := protocol.UTF8String(strings.ReplaceAll(s, "\x00", ""))
+		buf := bytes.NewBuffer(make([]byte, 0))
+		var v protocol.UTF8String
+		return value.Encode(buf) == nil && buf.Len() == value.Size() && v.Decode(buf) == nil && v == value
+	}
+	binaryData := func(b []byte) bool {
+		value := protocol.BinaryData(b)
+		buf := bytes.NewBuffer(make([]byte, 0))
+		var v protocol.BinaryData
+		return value.Encode(buf) == nil && buf.Len() == value.Size() && v.Decode(buf) == nil && bytes.Equal(v, value)
+	}
+	fourByteInteger := func(x uint32) bool {
+		value := protocol.FourByteInteger(x)
+		buf := bytes.NewBuffer(make([]byte, 0))
+		var v protocol.FourByteInteger
+		return value.Encode(buf) == nil && v.Decode(buf) == nil && v == value
+	}
+
+	for name, f := range map[string]any{"VarByteInt": varByteInt, "UTF8String": utf8String, "BinaryData": binaryData, "FourByteInteger": fourByteInteger} {
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(name, "failed to round-trip:", err)
+		}
+	}
+}